@@ -0,0 +1,200 @@
+// Package archive sorts and threads messages stored in mbox files and Maildir
+// directories, with the same engines as the SORT and THREAD server
+// extensions.
+//
+// Messages are numbered in file order, starting at 1. These numbers are used
+// both as sequence numbers and as UIDs.
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap-sortthread"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+// ErrUnsupportedAlgorithm is returned by Archive.Thread when the threading
+// algorithm isn't supported.
+var ErrUnsupportedAlgorithm = errors.New("archive: unsupported threading algorithm")
+
+// Message is a message read from an archive.
+type Message struct {
+	// The message number, starting at 1, in file order.
+	SeqNum uint32
+	// The internal date: the mbox "From " line date, or the Maildir file
+	// modification time.
+	InternalDate time.Time
+	Flags        []string
+	// The raw message, with CRLF line endings.
+	Body []byte
+}
+
+func newMessage(seqNum uint32, date time.Time, flags []string, body []byte) *Message {
+	// RFC822.SIZE is computed with CRLF line endings
+	body = bytes.Replace(body, []byte("\r\n"), []byte("\n"), -1)
+	body = bytes.Replace(body, []byte("\n"), []byte("\r\n"), -1)
+	return &Message{
+		SeqNum:       seqNum,
+		InternalDate: date,
+		Flags:        flags,
+		Body:         body,
+	}
+}
+
+func (msg *Message) header() (textproto.Header, error) {
+	return textproto.ReadHeader(bufio.NewReader(bytes.NewReader(msg.Body)))
+}
+
+// Envelope returns the message envelope.
+func (msg *Message) Envelope() (*imap.Envelope, error) {
+	h, err := msg.header()
+	if err != nil {
+		return nil, err
+	}
+	env, err := backendutil.FetchEnvelope(h)
+	if err != nil {
+		return nil, err
+	}
+	if env.Date.IsZero() {
+		env.Date, _ = sortthread.ParseDate(h.Get("Date"))
+	}
+	return env, nil
+}
+
+func (msg *Message) fetch() (*imap.Message, error) {
+	env, err := msg.Envelope()
+	if err != nil {
+		return nil, err
+	}
+
+	fetched := imap.NewMessage(msg.SeqNum, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchInternalDate, imap.FetchRFC822Size})
+	fetched.Uid = msg.SeqNum
+	fetched.Envelope = env
+	fetched.InternalDate = msg.InternalDate
+	fetched.Size = uint32(len(msg.Body))
+	return fetched, nil
+}
+
+func (msg *Message) threadMessage() (*sortthread.ThreadMessage, error) {
+	h, err := msg.header()
+	if err != nil {
+		return nil, err
+	}
+
+	return &sortthread.ThreadMessage{
+		Id:           msg.SeqNum,
+		Date:         sortthread.DefaultDatePolicy.SentDate(h.Get("Date"), msg.InternalDate),
+		InternalDate: msg.InternalDate,
+		Subject:      h.Get("Subject"),
+		MessageId:    h.Get("Message-Id"),
+		InReplyTo:    h.Get("In-Reply-To"),
+		References:   h.Get("References"),
+	}, nil
+}
+
+func (msg *Message) match(c *imap.SearchCriteria) (bool, error) {
+	e, err := message.Read(bytes.NewReader(msg.Body))
+	if err != nil && !message.IsUnknownCharset(err) {
+		return false, err
+	}
+	return backendutil.Match(e, msg.SeqNum, msg.SeqNum, msg.InternalDate, msg.Flags, c)
+}
+
+// Archive is a list of messages read from an mbox file or a Maildir
+// directory.
+type Archive struct {
+	Messages []*Message
+}
+
+// Open reads an mbox file or, if path is a directory, a Maildir.
+func Open(path string) (*Archive, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return ReadMaildir(path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadMbox(f)
+}
+
+// Search returns the numbers of the messages matching the search criteria.
+func (a *Archive) Search(c *imap.SearchCriteria) ([]uint32, error) {
+	var ids []uint32
+	for _, msg := range a.Messages {
+		if c != nil {
+			if ok, err := msg.match(c); err != nil {
+				return nil, err
+			} else if !ok {
+				continue
+			}
+		}
+		ids = append(ids, msg.SeqNum)
+	}
+	return ids, nil
+}
+
+func (a *Archive) search(c *imap.SearchCriteria) ([]*Message, error) {
+	ids, err := a.Search(c)
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]*Message, len(ids))
+	for i, id := range ids {
+		messages[i] = a.Messages[id-1]
+	}
+	return messages, nil
+}
+
+// Sort sorts the messages matching the search criteria, like
+// sortthread.SortMailbox.
+func (a *Archive) Sort(sortCrit []sortthread.SortCriterion, searchCrit *imap.SearchCriteria) ([]uint32, error) {
+	messages, err := a.search(searchCrit)
+	if err != nil {
+		return nil, err
+	}
+
+	fetched := make([]*imap.Message, len(messages))
+	for i, msg := range messages {
+		if fetched[i], err = msg.fetch(); err != nil {
+			return nil, err
+		}
+	}
+	return sortthread.SortMessages(fetched, false, sortCrit), nil
+}
+
+// Thread threads the messages matching the search criteria, like
+// sortthread.ThreadMailbox. Only the REFERENCES algorithm and its variants,
+// e.g. X-REFERENCES-NOSUBJECT, are supported.
+func (a *Archive) Thread(algorithm sortthread.ThreadAlgorithm, searchCrit *imap.SearchCriteria) ([]*sortthread.Thread, error) {
+	options, ok := sortthread.ReferencesAlgorithmOptions(algorithm)
+	if !ok {
+		return nil, ErrUnsupportedAlgorithm
+	}
+
+	messages, err := a.search(searchCrit)
+	if err != nil {
+		return nil, err
+	}
+
+	threadMessages := make([]*sortthread.ThreadMessage, len(messages))
+	for i, msg := range messages {
+		if threadMessages[i], err = msg.threadMessage(); err != nil {
+			return nil, err
+		}
+	}
+	return sortthread.ThreadReferencesWithOptions(threadMessages, options), nil
+}
@@ -0,0 +1,226 @@
+package archive
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap-sortthread"
+	"github.com/emersion/go-imap-sortthread/sortthreadtest"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+)
+
+const testMbox = `From alice@example.org Sat Jan  4 08:00:00 2020
+Message-Id: <1@example.org>
+Subject: Hello
+Status: RO
+
+Hi!
+>From the archive
+>>From the archive
+
+From bob@example.org Sun Jan  5 10:00:00 2020
+Message-Id: <2@example.org>
+Subject: Re: Hello
+In-Reply-To: <1@example.org>
+X-Status: AF
+
+Hello!
+`
+
+func TestReadMbox(t *testing.T) {
+	a, err := ReadMbox(strings.NewReader(testMbox))
+	if err != nil {
+		t.Fatal("Expected no error while reading mbox but got:", err)
+	}
+	if len(a.Messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %v", len(a.Messages))
+	}
+
+	msg := a.Messages[0]
+	if msg.SeqNum != 1 {
+		t.Errorf("Invalid sequence number: got %v, expected 1", msg.SeqNum)
+	}
+	if date := time.Date(2020, 1, 4, 8, 0, 0, 0, time.UTC); !msg.InternalDate.Equal(date) {
+		t.Errorf("Invalid internal date: got %v, expected %v", msg.InternalDate, date)
+	}
+	if !reflect.DeepEqual(msg.Flags, []string{imap.SeenFlag}) {
+		t.Errorf("Invalid flags: got %v", msg.Flags)
+	}
+	body := "Message-Id: <1@example.org>\r\nSubject: Hello\r\nStatus: RO\r\n\r\nHi!\r\nFrom the archive\r\n>From the archive\r\n"
+	if string(msg.Body) != body {
+		t.Errorf("Invalid body: got %q, expected %q", msg.Body, body)
+	}
+
+	expectedFlags := []string{imap.AnsweredFlag, imap.FlaggedFlag}
+	if flags := a.Messages[1].Flags; !reflect.DeepEqual(flags, expectedFlags) {
+		t.Errorf("Invalid flags: got %v, expected %v", flags, expectedFlags)
+	}
+
+	threads, err := a.Thread(sortthread.References, nil)
+	if err != nil {
+		t.Fatal("Expected no error while threading but got:", err)
+	}
+	expected := []*sortthread.Thread{{Id: 1, Children: []*sortthread.Thread{{Id: 2}}}}
+	if !reflect.DeepEqual(threads, expected) {
+		t.Errorf("Invalid threads")
+	}
+	threads, err = a.Thread(sortthread.ReferencesNoSubject, nil)
+	if err != nil {
+		t.Fatal("Expected no error while threading with X-REFERENCES-NOSUBJECT but got:", err)
+	}
+	if !reflect.DeepEqual(threads, expected) {
+		t.Errorf("Invalid threads with X-REFERENCES-NOSUBJECT")
+	}
+	if _, err := a.Thread(sortthread.OrderedSubject, nil); err != ErrUnsupportedAlgorithm {
+		t.Errorf("Expected ErrUnsupportedAlgorithm for ORDEREDSUBJECT, got %v", err)
+	}
+
+	c := imap.NewSearchCriteria()
+	c.WithFlags = []string{imap.FlaggedFlag}
+	ids, err := a.Sort([]sortthread.SortCriterion{{Field: sortthread.SortArrival}}, c)
+	if err != nil {
+		t.Fatal("Expected no error while sorting but got:", err)
+	}
+	if !reflect.DeepEqual(ids, []uint32{2}) {
+		t.Errorf("Invalid SORT result: got %v, expected [2]", ids)
+	}
+}
+
+func TestReadMaildir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"cur/1577836802.M2P1.host:2,S":  "Subject: Second\r\n\r\n",
+		"new/1577836803.M3P1.host":      "Subject: Third\r\n\r\n",
+		"cur/1577836801.M1P1.host:2,FR": "Subject: First\r\n\r\n",
+		"tmp/1577836804.M4P1.host":      "Subject: Incomplete\r\n\r\n",
+	}
+	for name, body := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(body), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a, err := Open(dir)
+	if err != nil {
+		t.Fatal("Expected no error while reading Maildir but got:", err)
+	}
+
+	var subjects []string
+	for _, msg := range a.Messages {
+		env, err := msg.Envelope()
+		if err != nil {
+			t.Fatal(err)
+		}
+		subjects = append(subjects, env.Subject)
+	}
+	if expected := []string{"First", "Second", "Third"}; !reflect.DeepEqual(subjects, expected) {
+		t.Errorf("Invalid messages: got %v, expected %v", subjects, expected)
+	}
+
+	expectedFlags := []string{imap.FlaggedFlag, imap.AnsweredFlag}
+	if flags := a.Messages[0].Flags; !reflect.DeepEqual(flags, expectedFlags) {
+		t.Errorf("Invalid flags: got %v, expected %v", flags, expectedFlags)
+	}
+}
+
+// archiveMailbox exposes an archive as a mailbox, to run the conformance
+// suite. The memory mailbox is only used to list UIDs.
+type archiveMailbox struct {
+	*memory.Mailbox
+
+	archive *Archive
+}
+
+func (mbox *archiveMailbox) Sort(uid bool, sortCrit []sortthread.SortCriterion, searchCrit *imap.SearchCriteria) ([]uint32, error) {
+	ids, err := mbox.archive.Sort(sortCrit, searchCrit)
+	if err != nil {
+		return nil, err
+	}
+	if uid {
+		for i, id := range ids {
+			ids[i] = mbox.Messages[id-1].Uid
+		}
+	}
+	return ids, nil
+}
+
+func (mbox *archiveMailbox) Thread(uid bool, algorithm sortthread.ThreadAlgorithm, searchCrit *imap.SearchCriteria) ([]*sortthread.Thread, error) {
+	threads, err := mbox.archive.Thread(algorithm, searchCrit)
+	if err != nil {
+		return nil, err
+	}
+	if uid {
+		var toUid func(threads []*sortthread.Thread)
+		toUid = func(threads []*sortthread.Thread) {
+			for _, t := range threads {
+				if t.Id != 0 {
+					t.Id = mbox.Messages[t.Id-1].Uid
+				}
+				toUid(t.Children)
+			}
+		}
+		toUid(threads)
+	}
+	return threads, nil
+}
+
+func newArchiveMailbox(t *testing.T, messages []*sortthreadtest.Message) backend.Mailbox {
+	var b bytes.Buffer
+	for _, msg := range messages {
+		b.WriteString("From sender@example.org " + msg.Date.Format(time.ANSIC) + "\n")
+		b.Write(msg.Body)
+		b.WriteString("\n")
+	}
+	a, err := ReadMbox(&b)
+	if err != nil {
+		t.Fatal("Expected no error while reading mbox but got:", err)
+	}
+	if len(a.Messages) != len(messages) {
+		t.Fatalf("Expected %v messages, got %v", len(messages), len(a.Messages))
+	}
+
+	be := memory.New()
+	user, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := user.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	memMbox := mbox.(*memory.Mailbox)
+	memMbox.Messages = nil
+	for i, msg := range a.Messages {
+		memMbox.Messages = append(memMbox.Messages, &memory.Message{
+			Uid:  uint32(10 + i),
+			Date: msg.InternalDate,
+			Body: msg.Body,
+		})
+	}
+	return &archiveMailbox{Mailbox: memMbox, archive: a}
+}
+
+func TestArchiveSort(t *testing.T) {
+	sortthreadtest.TestSort(t, newArchiveMailbox)
+}
+
+func TestArchiveThread(t *testing.T) {
+	sortthreadtest.TestThread(t, newArchiveMailbox)
+}
@@ -0,0 +1,88 @@
+package archive
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// maildirFlags returns the flags stored in the info part of a Maildir file
+// name, e.g. "1577836800.M1P2.host:2,FS".
+func maildirFlags(name string) []string {
+	i := strings.LastIndex(name, ":2,")
+	if i < 0 {
+		return nil
+	}
+
+	var flags []string
+	for _, ch := range name[i+len(":2,"):] {
+		switch ch {
+		case 'D':
+			flags = append(flags, imap.DraftFlag)
+		case 'F':
+			flags = append(flags, imap.FlaggedFlag)
+		case 'R':
+			flags = append(flags, imap.AnsweredFlag)
+		case 'S':
+			flags = append(flags, imap.SeenFlag)
+		case 'T':
+			flags = append(flags, imap.DeletedFlag)
+		}
+	}
+	return flags
+}
+
+// maildirKey returns the unique part of a Maildir file name, without the info
+// part.
+func maildirKey(name string) string {
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// ReadMaildir reads the messages in the cur and new sub-directories of a
+// Maildir. Messages are ordered by file name, which starts with the delivery
+// time. The file modification time is used as internal date.
+func ReadMaildir(dir string) (*Archive, error) {
+	type maildirFile struct {
+		path string
+		info os.FileInfo
+	}
+
+	var files []maildirFile
+	for _, sub := range []string{"cur", "new"} {
+		infos, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, fi := range infos {
+			if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+				continue
+			}
+			files = append(files, maildirFile{filepath.Join(dir, sub, fi.Name()), fi})
+		}
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		return maildirKey(files[i].info.Name()) < maildirKey(files[j].info.Name())
+	})
+
+	a := new(Archive)
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f.path)
+		if err != nil {
+			return nil, err
+		}
+		seqNum := uint32(len(a.Messages)) + 1
+		msg := newMessage(seqNum, f.info.ModTime(), maildirFlags(f.info.Name()), b)
+		a.Messages = append(a.Messages, msg)
+	}
+	return a, nil
+}
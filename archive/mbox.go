@@ -0,0 +1,131 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap-sortthread"
+)
+
+// Layouts of the date in mbox "From " lines.
+var mboxDateLayouts = []string{
+	time.ANSIC,
+	"Mon Jan _2 15:04:05 MST 2006",
+	"Mon Jan _2 15:04:05 -0700 2006",
+	"Mon Jan _2 15:04 2006",
+}
+
+func isMboxSeparator(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("From "))
+}
+
+// parseMboxSeparator parses the date of a "From " line, e.g.
+// "From alice@example.org Sat Jan  4 08:00:00 2020".
+func parseMboxSeparator(line string) time.Time {
+	fields := strings.Fields(strings.TrimPrefix(line, "From "))
+	if len(fields) < 2 {
+		return time.Time{}
+	}
+	date := strings.Join(fields[1:], " ")
+	for _, layout := range mboxDateLayouts {
+		if t, err := time.Parse(layout, date); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// unescapeMboxLine removes the quoting of lines starting with "From ", as
+// done by the mboxrd format.
+func unescapeMboxLine(line []byte) []byte {
+	i := 0
+	for i < len(line) && line[i] == '>' {
+		i++
+	}
+	if i > 0 && bytes.HasPrefix(line[i:], []byte("From ")) {
+		return line[1:]
+	}
+	return line
+}
+
+// mboxFlags returns the flags stored in the Status and X-Status header fields
+// by mail user agents.
+func mboxFlags(body []byte) []string {
+	h, err := mail.ReadMessage(bytes.NewReader(body))
+	if err != nil {
+		return nil
+	}
+
+	var flags []string
+	if strings.ContainsRune(h.Header.Get("Status"), 'R') {
+		flags = append(flags, imap.SeenFlag)
+	}
+	for _, ch := range h.Header.Get("X-Status") {
+		switch ch {
+		case 'A':
+			flags = append(flags, imap.AnsweredFlag)
+		case 'F':
+			flags = append(flags, imap.FlaggedFlag)
+		case 'D':
+			flags = append(flags, imap.DeletedFlag)
+		case 'T':
+			flags = append(flags, imap.DraftFlag)
+		}
+	}
+	return flags
+}
+
+// ReadMbox reads an mbox file. Both the mboxo and mboxrd formats are
+// supported. If a message has no date on its "From " line, its Date header
+// field is used as internal date.
+func ReadMbox(r io.Reader) (*Archive, error) {
+	br := bufio.NewReader(r)
+	a := new(Archive)
+
+	var body bytes.Buffer
+	var date time.Time
+	started := false
+	flush := func() {
+		if !started {
+			return
+		}
+		b := append([]byte(nil), body.Bytes()...)
+		// The line break before the next separator belongs to the mbox format
+		b = bytes.TrimSuffix(b, []byte("\n"))
+		b = bytes.TrimSuffix(b, []byte("\r"))
+		if date.IsZero() {
+			if h, err := mail.ReadMessage(bytes.NewReader(b)); err == nil {
+				date, _ = sortthread.ParseDate(h.Header.Get("Date"))
+			}
+		}
+		msg := newMessage(uint32(len(a.Messages))+1, date, mboxFlags(b), b)
+		a.Messages = append(a.Messages, msg)
+		body.Reset()
+	}
+
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			if isMboxSeparator(line) {
+				flush()
+				started = true
+				date = parseMboxSeparator(string(line))
+			} else if started {
+				body.Write(unescapeMboxLine(line))
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	flush()
+
+	return a, nil
+}
@@ -17,7 +17,13 @@ var baseSubjectTests = []struct {
 	{
 		name:       "reply",
 		subject:    "Re: [ocf/puppet] Fix kerberos not booting up correctly [needs testing] (#781)",
-		expected:   "[ocf/puppet] Fix kerberos not booting up correctly [needs testing] (#781)",
+		expected:   "Fix kerberos not booting up correctly [needs testing] (#781)",
+		isReplyFwd: true,
+	},
+	{
+		name:       "encoded",
+		subject:    "Re: =?UTF-8?Q?Caf=C3=A9?= =?UTF-8?B?bWVudQ==?=",
+		expected:   "Cafémenu",
 		isReplyFwd: true,
 	},
 	{
@@ -41,7 +47,43 @@ var baseSubjectTests = []struct {
 	{
 		name:       "foward_header_nested",
 		subject:    "Re: [fwd: Re: [OCF] Service update during PG&E outage]",
-		expected:   "[OCF] Service update during PG&E outage",
+		expected:   "Service update during PG&E outage",
+		isReplyFwd: true,
+	},
+	{
+		name:       "blob_before_reply",
+		subject:    "[list] Re: foo",
+		expected:   "foo",
+		isReplyFwd: true,
+	},
+	{
+		name:       "blob_after_reply",
+		subject:    "Re: [list] foo",
+		expected:   "foo",
+		isReplyFwd: true,
+	},
+	{
+		name:       "blob_in_reply",
+		subject:    "Re[2]: foo",
+		expected:   "foo",
+		isReplyFwd: true,
+	},
+	{
+		name:       "blobs",
+		subject:    "[list] [tag] foo",
+		expected:   "foo",
+		isReplyFwd: false,
+	},
+	{
+		name:       "blob_only",
+		subject:    "[list]",
+		expected:   "[list]",
+		isReplyFwd: false,
+	},
+	{
+		name:       "blob_utf8",
+		subject:    "[liste café] Re: foo",
+		expected:   "foo",
 		isReplyFwd: true,
 	},
 }
@@ -0,0 +1,387 @@
+package sortthread
+
+import (
+	"bytes"
+	"container/list"
+	"sort"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// StatusHighestModSeq is the HIGHESTMODSEQ status item, defined in RFC 7162.
+const StatusHighestModSeq imap.StatusItem = "HIGHESTMODSEQ"
+
+// mailboxState identifies the state of a mailbox. Cached results are only
+// valid for the state they were computed in.
+type mailboxState struct {
+	uidValidity   uint32
+	uidNext       uint32
+	messages      uint32
+	highestModSeq uint64
+}
+
+func getMailboxState(mbox backend.Mailbox) (*mailboxState, error) {
+	items := []imap.StatusItem{imap.StatusUidValidity, imap.StatusUidNext, imap.StatusMessages, StatusHighestModSeq}
+	status, err := mbox.Status(items)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &mailboxState{
+		uidValidity: status.UidValidity,
+		uidNext:     status.UidNext,
+		messages:    status.Messages,
+	}
+	if v, ok := status.Items[StatusHighestModSeq]; ok {
+		state.highestModSeq, _ = parseUint64Item(v)
+	}
+	return state, nil
+}
+
+type cacheKey struct {
+	username string
+	mailbox  string
+	query    string
+}
+
+type cacheEntry struct {
+	key   cacheKey
+	state mailboxState
+	// The UIDs of all messages in the mailbox, in ascending order
+	mailboxUids []uint32
+	uids        []uint32
+	// For THREAD results
+	threads []*Thread
+	// Whether the result stays valid when a message is expunged, once the
+	// message is removed from it
+	expungeable bool
+}
+
+// seqNum returns the sequence number of a message, or zero if it isn't in the
+// mailbox.
+func (entry *cacheEntry) seqNum(uid uint32) uint32 {
+	i := sort.Search(len(entry.mailboxUids), func(i int) bool {
+		return entry.mailboxUids[i] >= uid
+	})
+	if i < len(entry.mailboxUids) && entry.mailboxUids[i] == uid {
+		return uint32(i) + 1
+	}
+	return 0
+}
+
+// expunge returns a copy of the entry without the message with the provided
+// sequence number.
+func (entry *cacheEntry) expunge(seqNum uint32) *cacheEntry {
+	uid := entry.mailboxUids[seqNum-1]
+	expunged := *entry
+	expunged.mailboxUids = make([]uint32, 0, len(entry.mailboxUids)-1)
+	expunged.mailboxUids = append(expunged.mailboxUids, entry.mailboxUids[:seqNum-1]...)
+	expunged.mailboxUids = append(expunged.mailboxUids, entry.mailboxUids[seqNum:]...)
+	expunged.uids = make([]uint32, 0, len(entry.uids))
+	for _, id := range entry.uids {
+		if id != uid {
+			expunged.uids = append(expunged.uids, id)
+		}
+	}
+	expunged.state.messages--
+	return &expunged
+}
+
+// ResultCache caches SORT and THREAD results.
+//
+// Results are cached per user, mailbox, command arguments and mailbox state.
+// The mailbox state is made of UIDVALIDITY, UIDNEXT, the number of messages
+// and HIGHESTMODSEQ if the backend reports it in Mailbox.Status. Results are
+// always computed with UIDs, and converted to sequence numbers when needed.
+//
+// Without HIGHESTMODSEQ, flag and annotation changes can't be detected, so
+// results depending on flags, MODSEQ or annotations aren't cached. A nil
+// search criteria matches all messages. Backends should also pass their updates to
+// HandleUpdate, or call Invalidate.
+//
+// A ResultCache is safe for concurrent use.
+type ResultCache struct {
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+}
+
+// NewResultCache creates a new cache holding at most maxEntries results.
+func NewResultCache(maxEntries int) *ResultCache {
+	return &ResultCache{
+		maxEntries: maxEntries,
+		entries:    make(map[cacheKey]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+func (c *ResultCache) get(key cacheKey, state *mailboxState) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if entry.state != *state {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return entry
+}
+
+func (c *ResultCache) put(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[entry.key]; ok {
+		c.lru.Remove(elem)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.maxEntries {
+		elem := c.lru.Back()
+		c.lru.Remove(elem)
+		delete(c.entries, elem.Value.(*cacheEntry).key)
+	}
+}
+
+// Invalidate removes all cached results for a mailbox. If mailbox is empty,
+// all results for the user are removed. If username is empty, all results are
+// removed.
+func (c *ResultCache) Invalidate(username, mailbox string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, elem := range c.entries {
+		if username != "" && key.username != username {
+			continue
+		}
+		if mailbox != "" && key.mailbox != mailbox {
+			continue
+		}
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+// expunge removes a message from the cached SORT results of a mailbox. Other
+// results are removed.
+func (c *ResultCache) expunge(username, mailbox string, seqNum uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, elem := range c.entries {
+		if key.username != username || key.mailbox != mailbox {
+			continue
+		}
+		entry := elem.Value.(*cacheEntry)
+		if !entry.expungeable || seqNum == 0 || int(seqNum) > len(entry.mailboxUids) {
+			c.lru.Remove(elem)
+			delete(c.entries, key)
+			continue
+		}
+		// Cached entries may be in use, replace them instead
+		elem.Value = entry.expunge(seqNum)
+	}
+}
+
+// HandleUpdate updates cached results affected by a backend update.
+//
+// Expunged messages are removed from SORT results, unless the search criteria
+// use sequence numbers. Other results of the mailbox are invalidated, because
+// removing a message can change the shape of threads.
+func (c *ResultCache) HandleUpdate(update backend.Update) {
+	switch update := update.(type) {
+	case *backend.MailboxUpdate, *backend.MessageUpdate:
+		c.Invalidate(update.Username(), update.Mailbox())
+	case *backend.ExpungeUpdate:
+		c.expunge(update.Username(), update.Mailbox(), update.SeqNum)
+	}
+}
+
+// searchCriteriaAny returns true if f returns true for the search criteria or
+// any of its NOT and OR search keys.
+func searchCriteriaAny(c *imap.SearchCriteria, f func(c *imap.SearchCriteria) bool) bool {
+	if c == nil {
+		return false
+	}
+	if f(c) {
+		return true
+	}
+	for _, not := range c.Not {
+		if searchCriteriaAny(not, f) {
+			return true
+		}
+	}
+	for _, or := range c.Or {
+		if searchCriteriaAny(or[0], f) || searchCriteriaAny(or[1], f) {
+			return true
+		}
+	}
+	return false
+}
+
+func searchCriteriaUsesFlags(c *imap.SearchCriteria) bool {
+	return searchCriteriaAny(c, func(c *imap.SearchCriteria) bool {
+		return len(c.WithFlags) > 0 || len(c.WithoutFlags) > 0
+	})
+}
+
+func searchCriteriaUsesSeqNums(c *imap.SearchCriteria) bool {
+	return searchCriteriaAny(c, func(c *imap.SearchCriteria) bool {
+		return c.SeqNum != nil
+	})
+}
+
+func formatCacheQuery(fields ...interface{}) string {
+	var b bytes.Buffer
+	w := imap.NewWriter(&b)
+	imap.NewUntaggedResp(fields).WriteTo(w)
+	w.Flush()
+	return b.String()
+}
+
+// listMailboxUids returns the UIDs of all messages in a mailbox, in ascending
+// order.
+func listMailboxUids(mbox backend.Mailbox) ([]uint32, error) {
+	uids, err := mbox.SearchMessages(true, imap.NewSearchCriteria())
+	if err != nil {
+		return nil, err
+	}
+	uids = append([]uint32(nil), uids...)
+	sort.Slice(uids, func(i, j int) bool {
+		return uids[i] < uids[j]
+	})
+	return uids, nil
+}
+
+// mapThreads returns a copy of threads with IDs converted by f. Messages for
+// which f returns zero are removed, and their children are promoted.
+func mapThreads(threads []*Thread, f func(uint32) uint32) []*Thread {
+	var mapped []*Thread
+	for _, t := range threads {
+		children := mapThreads(t.Children, f)
+		if t.Id == 0 {
+			mapped = append(mapped, &Thread{Children: children})
+			continue
+		}
+		id := f(t.Id)
+		if id == 0 {
+			mapped = append(mapped, children...)
+			continue
+		}
+		mapped = append(mapped, &Thread{Id: id, Children: children})
+	}
+	return mapped
+}
+
+// Sort returns the result of SortMailbox.Sort, using the cache if possible.
+func (c *ResultCache) Sort(username string, mbox SortMailbox, uid bool, sortCrit []SortCriterion, searchCrit *imap.SearchCriteria) ([]uint32, error) {
+	state, err := getMailboxState(mbox)
+	if err != nil {
+		return nil, err
+	}
+
+	if searchCrit == nil {
+		searchCrit = imap.NewSearchCriteria()
+	}
+
+	// Flags and annotations can change without affecting the other items of
+	// the mailbox state
+	usesFlags := searchCriteriaUsesFlags(searchCrit)
+	for _, c := range sortCrit {
+		usesFlags = usesFlags || c.Field == SortModSeq || c.Field == SortAnnotation
+	}
+	if usesFlags && state.highestModSeq == 0 {
+		return mbox.Sort(uid, sortCrit, searchCrit)
+	}
+
+	key := cacheKey{
+		username: username,
+		mailbox:  mbox.Name(),
+		query:    formatCacheQuery(imap.RawString("SORT"), formatSortCriteria(sortCrit), searchCrit.Format()),
+	}
+	entry := c.get(key, state)
+	if entry == nil {
+		mailboxUids, err := listMailboxUids(mbox)
+		if err != nil {
+			return nil, err
+		}
+		uids, err := mbox.Sort(true, sortCrit, searchCrit)
+		if err != nil {
+			return nil, err
+		}
+		entry = &cacheEntry{
+			key:         key,
+			state:       *state,
+			mailboxUids: mailboxUids,
+			uids:        uids,
+			expungeable: !searchCriteriaUsesSeqNums(searchCrit),
+		}
+		c.put(entry)
+	}
+
+	if uid {
+		return append([]uint32(nil), entry.uids...), nil
+	}
+
+	seqNums := make([]uint32, 0, len(entry.uids))
+	for _, uid := range entry.uids {
+		if seqNum := entry.seqNum(uid); seqNum != 0 {
+			seqNums = append(seqNums, seqNum)
+		}
+	}
+	return seqNums, nil
+}
+
+// Thread returns the result of ThreadMailbox.Thread, using the cache if
+// possible.
+func (c *ResultCache) Thread(username string, mbox ThreadMailbox, uid bool, algorithm ThreadAlgorithm, searchCrit *imap.SearchCriteria) ([]*Thread, error) {
+	state, err := getMailboxState(mbox)
+	if err != nil {
+		return nil, err
+	}
+
+	if searchCrit == nil {
+		searchCrit = imap.NewSearchCriteria()
+	}
+
+	if searchCriteriaUsesFlags(searchCrit) && state.highestModSeq == 0 {
+		return mbox.Thread(uid, algorithm, searchCrit)
+	}
+
+	key := cacheKey{
+		username: username,
+		mailbox:  mbox.Name(),
+		query:    formatCacheQuery(imap.RawString("THREAD"), formatThreadAlgorithm(algorithm), searchCrit.Format()),
+	}
+	entry := c.get(key, state)
+	if entry == nil {
+		mailboxUids, err := listMailboxUids(mbox)
+		if err != nil {
+			return nil, err
+		}
+		threads, err := mbox.Thread(true, algorithm, searchCrit)
+		if err != nil {
+			return nil, err
+		}
+		entry = &cacheEntry{key: key, state: *state, mailboxUids: mailboxUids, threads: threads}
+		c.put(entry)
+	}
+
+	if uid {
+		return mapThreads(entry.threads, func(uid uint32) uint32 {
+			return uid
+		}), nil
+	}
+
+	return mapThreads(entry.threads, entry.seqNum), nil
+}
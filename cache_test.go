@@ -0,0 +1,199 @@
+package sortthread
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+type testCacheMailbox struct {
+	backend.Mailbox
+
+	uids          []uint32
+	uidNext       uint32
+	highestModSeq uint64
+	sorts         int
+	threads       int
+}
+
+func (mbox *testCacheMailbox) Name() string {
+	return "INBOX"
+}
+
+func (mbox *testCacheMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	status := imap.NewMailboxStatus("INBOX", items)
+	status.UidValidity = 1
+	status.UidNext = mbox.uidNext
+	status.Messages = uint32(len(mbox.uids))
+	if mbox.highestModSeq != 0 {
+		status.Items[StatusHighestModSeq] = mbox.highestModSeq
+	}
+	return status, nil
+}
+
+func (mbox *testCacheMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	return mbox.uids, nil
+}
+
+func (mbox *testCacheMailbox) Sort(uid bool, sortCrit []SortCriterion, searchCrit *imap.SearchCriteria) ([]uint32, error) {
+	mbox.sorts++
+	// Reverse UID order
+	var uids []uint32
+	for i := len(mbox.uids) - 1; i >= 0; i-- {
+		uids = append(uids, mbox.uids[i])
+	}
+	return uids, nil
+}
+
+func (mbox *testCacheMailbox) Thread(uid bool, algorithm ThreadAlgorithm, searchCrit *imap.SearchCriteria) ([]*Thread, error) {
+	mbox.threads++
+	return []*Thread{{Id: mbox.uids[0], Children: []*Thread{{Id: mbox.uids[len(mbox.uids)-1]}}}}, nil
+}
+
+func TestResultCache(t *testing.T) {
+	cache := NewResultCache(10)
+	mbox := &testCacheMailbox{uids: []uint32{10, 20, 30}, uidNext: 31}
+	sortCrit := []SortCriterion{{Field: SortDate, Reverse: true}}
+	searchCrit := imap.NewSearchCriteria()
+
+	ids, err := cache.Sort("user", mbox, true, sortCrit, searchCrit)
+	if err != nil {
+		t.Fatal("Expected no error while sorting but got:", err)
+	}
+	if !reflect.DeepEqual(ids, []uint32{30, 20, 10}) {
+		t.Errorf("Got UIDs %v", ids)
+	}
+
+	ids, err = cache.Sort("user", mbox, false, sortCrit, searchCrit)
+	if err != nil {
+		t.Fatal("Expected no error while sorting but got:", err)
+	}
+	if !reflect.DeepEqual(ids, []uint32{3, 2, 1}) {
+		t.Errorf("Got sequence numbers %v", ids)
+	}
+	if mbox.sorts != 1 {
+		t.Errorf("Expected a single call to Sort, got %v", mbox.sorts)
+	}
+
+	threads, err := cache.Thread("user", mbox, false, References, searchCrit)
+	if err != nil {
+		t.Fatal("Expected no error while threading but got:", err)
+	}
+	if !reflect.DeepEqual(threads, []*Thread{{Id: 1, Children: []*Thread{{Id: 3}}}}) {
+		t.Errorf("Got threads %v", formatTestThreads(threads))
+	}
+
+	// Expunge a message and append another one
+	mbox.uids = []uint32{20, 30, 31}
+	mbox.uidNext = 32
+	ids, err = cache.Sort("user", mbox, false, sortCrit, searchCrit)
+	if err != nil {
+		t.Fatal("Expected no error while sorting but got:", err)
+	}
+	if !reflect.DeepEqual(ids, []uint32{3, 2, 1}) || mbox.sorts != 2 {
+		t.Errorf("Got sequence numbers %v after %v calls to Sort", ids, mbox.sorts)
+	}
+
+	cache.Invalidate("user", "INBOX")
+	cache.Sort("user", mbox, true, sortCrit, searchCrit)
+	cache.Thread("user", mbox, true, References, searchCrit)
+	if mbox.sorts != 3 || mbox.threads != 2 {
+		t.Errorf("Invalidate should remove cached results")
+	}
+}
+
+func TestResultCacheFlags(t *testing.T) {
+	cache := NewResultCache(10)
+	mbox := &testCacheMailbox{uids: []uint32{10, 20, 30}, uidNext: 31}
+	sortCrit := []SortCriterion{{Field: SortDate}}
+	searchCrit := imap.NewSearchCriteria()
+	searchCrit.Or = [][2]*imap.SearchCriteria{{imap.NewSearchCriteria(), imap.NewSearchCriteria()}}
+	searchCrit.Or[0][1].WithoutFlags = []string{imap.SeenFlag}
+
+	// Flag changes can't be detected without HIGHESTMODSEQ
+	cache.Sort("user", mbox, true, sortCrit, searchCrit)
+	cache.Sort("user", mbox, true, sortCrit, searchCrit)
+	cache.Sort("user", mbox, true, []SortCriterion{{Field: SortModSeq}}, imap.NewSearchCriteria())
+	cache.Sort("user", mbox, true, []SortCriterion{{Field: SortModSeq}}, imap.NewSearchCriteria())
+	annotationCrit := []SortCriterion{{Field: SortAnnotation, Annotation: &AnnotationSortKey{Entry: "/comment", Attribute: "value.priv"}}}
+	cache.Sort("user", mbox, true, annotationCrit, imap.NewSearchCriteria())
+	cache.Sort("user", mbox, true, annotationCrit, imap.NewSearchCriteria())
+	cache.Thread("user", mbox, true, References, searchCrit)
+	cache.Thread("user", mbox, true, References, searchCrit)
+	if mbox.sorts != 6 || mbox.threads != 2 {
+		t.Errorf("Results depending on flags shouldn't be cached without HIGHESTMODSEQ, got %v calls to Sort and %v to Thread", mbox.sorts, mbox.threads)
+	}
+
+	mbox.highestModSeq = 42
+	mbox.sorts, mbox.threads = 0, 0
+	cache.Sort("user", mbox, true, sortCrit, searchCrit)
+	cache.Sort("user", mbox, true, sortCrit, searchCrit)
+	cache.Thread("user", mbox, true, References, searchCrit)
+	cache.Thread("user", mbox, true, References, searchCrit)
+	if mbox.sorts != 1 || mbox.threads != 1 {
+		t.Errorf("Results should be cached with HIGHESTMODSEQ, got %v calls to Sort and %v to Thread", mbox.sorts, mbox.threads)
+	}
+}
+
+func TestResultCacheNilSearchCriteria(t *testing.T) {
+	cache := NewResultCache(10)
+	mbox := &testCacheMailbox{uids: []uint32{10, 20, 30}, uidNext: 31}
+	sortCrit := []SortCriterion{{Field: SortDate}}
+
+	// Nil search criteria are the same query as empty ones
+	for _, searchCrit := range []*imap.SearchCriteria{nil, imap.NewSearchCriteria()} {
+		if _, err := cache.Sort("user", mbox, true, sortCrit, searchCrit); err != nil {
+			t.Fatal("Expected no error while sorting but got:", err)
+		}
+		if _, err := cache.Thread("user", mbox, true, References, searchCrit); err != nil {
+			t.Fatal("Expected no error while threading but got:", err)
+		}
+	}
+	if mbox.sorts != 1 || mbox.threads != 1 {
+		t.Errorf("Expected a single call to Sort and Thread, got %v and %v", mbox.sorts, mbox.threads)
+	}
+}
+
+func TestResultCacheExpunge(t *testing.T) {
+	cache := NewResultCache(10)
+	mbox := &testCacheMailbox{uids: []uint32{10, 20, 30}, uidNext: 31}
+	sortCrit := []SortCriterion{{Field: SortDate, Reverse: true}}
+	searchCrit := imap.NewSearchCriteria()
+	seqNumCrit := imap.NewSearchCriteria()
+	seqNumCrit.SeqNum = new(imap.SeqSet)
+	seqNumCrit.SeqNum.AddRange(1, 3)
+
+	cache.Sort("user", mbox, false, sortCrit, searchCrit)
+	cache.Sort("user", mbox, false, sortCrit, seqNumCrit)
+	cache.Thread("user", mbox, false, References, searchCrit)
+
+	mbox.uids = []uint32{10, 30}
+	cache.HandleUpdate(&backend.ExpungeUpdate{Update: backend.NewUpdate("user", "INBOX"), SeqNum: 2})
+
+	ids, err := cache.Sort("user", mbox, false, sortCrit, searchCrit)
+	if err != nil {
+		t.Fatal("Expected no error while sorting but got:", err)
+	}
+	if !reflect.DeepEqual(ids, []uint32{2, 1}) {
+		t.Errorf("Got sequence numbers %v, expected [2 1]", ids)
+	}
+	ids, err = cache.Sort("user", mbox, true, sortCrit, searchCrit)
+	if err != nil {
+		t.Fatal("Expected no error while sorting but got:", err)
+	}
+	if !reflect.DeepEqual(ids, []uint32{30, 10}) {
+		t.Errorf("Got UIDs %v, expected [30 10]", ids)
+	}
+	if mbox.sorts != 2 {
+		t.Errorf("Expunged message should be removed from cached results, got %v calls to Sort", mbox.sorts)
+	}
+
+	// Results depending on sequence numbers and threads are recomputed
+	cache.Sort("user", mbox, false, sortCrit, seqNumCrit)
+	cache.Thread("user", mbox, false, References, searchCrit)
+	if mbox.sorts != 3 || mbox.threads != 2 {
+		t.Errorf("Expunge should invalidate other results, got %v calls to Sort and %v to Thread", mbox.sorts, mbox.threads)
+	}
+}
@@ -1,35 +1,134 @@
 package sortthread
 
 import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
 	"github.com/emersion/go-imap/commands"
 )
 
+// Conn is a connection shared by SortClients and ThreadClients. Their
+// commands are serialized: the go-imap client doesn't support concurrent
+// commands, and would hand the untagged SORT and THREAD responses of
+// concurrent commands to the wrong one.
+//
+// There is a single Conn per go-imap client, so clients created with
+// NewSortClient, NewThreadClient and NewConn for the same go-imap client all
+// share it. Other commands must not be sent concurrently on the connection,
+// see the go-imap client package.
+type Conn struct {
+	c  *client.Client
+	mu sync.Mutex
+}
+
+var (
+	connsMu sync.Mutex
+	conns   = make(map[*client.Client]*Conn)
+)
+
+// NewConn returns the shared connection of a go-imap client, creating it if
+// necessary. It's released when the connection is closed.
+func NewConn(c *client.Client) *Conn {
+	connsMu.Lock()
+	defer connsMu.Unlock()
+
+	if conn, ok := conns[c]; ok {
+		return conn
+	}
+	conn := &Conn{c: c}
+	conns[c] = conn
+	go func() {
+		<-c.LoggedOut()
+		connsMu.Lock()
+		delete(conns, c)
+		connsMu.Unlock()
+	}()
+	return conn
+}
+
+// lock locks the connection and returns a function unlocking it.
+func (conn *Conn) lock() (unlock func()) {
+	conn.mu.Lock()
+	return conn.mu.Unlock
+}
+
+// SortClient creates a new SORT client using the connection.
+func (conn *Conn) SortClient() *SortClient {
+	return &SortClient{c: conn.c, conn: conn}
+}
+
+// ThreadClient creates a new THREAD client using the connection.
+func (conn *Conn) ThreadClient() *ThreadClient {
+	return &ThreadClient{c: conn.c, conn: conn}
+}
+
 // SortClient is a SORT client.
+//
+// It's safe to use a SortClient from multiple goroutines: its commands are
+// serialized with the ones of the other SortClients and ThreadClients of the
+// same connection, see Conn.
 type SortClient struct {
-	c *client.Client
+	c    *client.Client
+	conn *Conn
+
+	// If set, notified when a SORT command completes.
+	Instrumentation Instrumentation
 }
 
-// ThreadClient is a THREAD client.
+// ThreadClient is a THREAD client. Like SortClient, it's safe to use from
+// multiple goroutines.
 type ThreadClient struct {
-	c *client.Client
+	c    *client.Client
+	conn *Conn
+
+	// If set, notified when a THREAD or SORT command completes.
+	Instrumentation Instrumentation
 }
 
-// NewClient creates a new SORT client.
+// NewSortClient creates a new SORT client. It's the same as
+// NewConn(c).SortClient().
 func NewSortClient(c *client.Client) *SortClient {
-	return &SortClient{c: c}
+	return NewConn(c).SortClient()
 }
 
 // SupportSort returns true if the remote server supports the extension.
 func (c *SortClient) SupportSort() (bool, error) {
+	defer c.conn.lock()()
 	return c.c.Support(SortCapability)
 }
 
+// checkSortCriteria checks that the server supports the extensions required
+// by the sort criteria.
+func (c *SortClient) checkSortCriteria(sortCriteria []SortCriterion) error {
+	for _, crit := range sortCriteria {
+		if crit.Field == SortAnnotation && crit.Annotation == nil {
+			return errors.New("sortthread: missing annotation for ANNOTATION sort key")
+		}
+
+		capability, ok := sortFieldCapabilities[crit.Field]
+		if !ok {
+			continue
+		}
+		if ok, err := c.c.Support(capability); err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("sortthread: server doesn't support %v sort key", crit.Field)
+		}
+	}
+	return nil
+}
+
 func (c *SortClient) sort(uid bool, sortCriteria []SortCriterion, searchCriteria *imap.SearchCriteria) ([]uint32, error) {
 	if c.c.State() != imap.SelectedState {
 		return nil, client.ErrNoMailboxSelected
 	}
+	if err := c.checkSortCriteria(sortCriteria); err != nil {
+		return nil, err
+	}
 
 	var cmd imap.Commander
 	cmd = &SortCommand{
@@ -43,29 +142,91 @@ func (c *SortClient) sort(uid bool, sortCriteria []SortCriterion, searchCriteria
 
 	res := new(SortResponse)
 
+	start := time.Now()
 	status, err := c.c.Execute(cmd, res)
+	if err == nil {
+		err = parseStatusError(status, "UTF-8", sortCriteria)
+	}
+	reportCommand(c.Instrumentation, &CommandInfo{
+		Name:         "SORT",
+		Uid:          uid,
+		SortCriteria: sortCriteria,
+		Search:       summarizeSearchCriteria(searchCriteria),
+		Results:      len(res.Ids),
+		Err:          err,
+	}, start)
 	if err != nil {
 		return nil, err
 	}
 
-	return res.Ids, status.Err()
+	return res.Ids, nil
 }
 
 func (c *SortClient) Sort(sortCriteria []SortCriterion, searchCriteria *imap.SearchCriteria) ([]uint32, error) {
+	defer c.conn.lock()()
 	return c.sort(false, sortCriteria, searchCriteria)
 }
 
 func (c *SortClient) UidSort(sortCriteria []SortCriterion, searchCriteria *imap.SearchCriteria) ([]uint32, error) {
+	defer c.conn.lock()()
 	return c.sort(true, sortCriteria, searchCriteria)
 }
 
-// NewClient creates a new THREAD client
+// SupportMultiSort returns true if the remote server supports multi-mailbox
+// SORT.
+func (c *SortClient) SupportMultiSort() (bool, error) {
+	defer c.conn.lock()()
+	return c.c.Support(MultiSortCapability)
+}
+
+// MultiSort sorts messages across several mailboxes. The results are returned
+// in global order.
+func (c *SortClient) MultiSort(mailboxes []string, sortCriteria []SortCriterion, searchCriteria *imap.SearchCriteria) ([]MailboxUid, error) {
+	defer c.conn.lock()()
+	if c.c.State()&imap.AuthenticatedState == 0 {
+		return nil, client.ErrNotLoggedIn
+	}
+
+	if err := c.checkSortCriteria(sortCriteria); err != nil {
+		return nil, err
+	}
+
+	cmd := &MultiSortCommand{
+		Mailboxes:      mailboxes,
+		SortCriteria:   sortCriteria,
+		Charset:        "UTF-8",
+		SearchCriteria: searchCriteria,
+	}
+	res := new(MultiSortResponse)
+
+	start := time.Now()
+	status, err := c.c.Execute(cmd, res)
+	if err == nil {
+		err = parseStatusError(status, "UTF-8", sortCriteria)
+	}
+	reportCommand(c.Instrumentation, &CommandInfo{
+		Name:         MultiSortCapability,
+		SortCriteria: sortCriteria,
+		Search:       summarizeSearchCriteria(searchCriteria),
+		Results:      len(res.Results),
+		Err:          err,
+	}, start)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Results, nil
+}
+
+// NewThreadClient creates a new THREAD client. It's the same as
+// NewConn(c).ThreadClient().
 func NewThreadClient(c *client.Client) *ThreadClient {
-	return &ThreadClient{c: c}
+	return NewConn(c).ThreadClient()
 }
 
 // SupportThread returns true if the remote server supports the extension.
 func (c *ThreadClient) SupportThread() (bool, error) {
+	defer c.conn.lock()()
 	for _, capability := range ThreadCapabilities {
 		ok, err := c.c.Support(capability)
 		if err != nil {
@@ -95,18 +256,178 @@ func (c *ThreadClient) thread(uid bool, algorithm ThreadAlgorithm, searchCriteri
 
 	res := new(ThreadResponse)
 
+	start := time.Now()
 	status, err := c.c.Execute(cmd, res)
+	if err == nil {
+		err = parseStatusError(status, "UTF-8", nil)
+	}
+	if err != nil && status != nil && status.Type == imap.StatusRespBad {
+		// Servers reply BAD to unknown algorithms
+		if ok, capErr := c.c.Support("THREAD=" + string(algorithm)); capErr == nil && !ok {
+			err = &UnsupportedAlgorithmError{Algorithm: algorithm}
+		}
+	}
+	reportCommand(c.Instrumentation, &CommandInfo{
+		Name:      "THREAD",
+		Uid:       uid,
+		Algorithm: algorithm,
+		Search:    summarizeSearchCriteria(searchCriteria),
+		Results:   countThreads(res.Threads),
+		Err:       err,
+	}, start)
 	if err != nil {
 		return nil, err
 	}
 
-	return res.Threads, status.Err()
+	return res.Threads, nil
 }
 
 func (c *ThreadClient) Thread(algorithm ThreadAlgorithm, searchCriteria *imap.SearchCriteria) ([]*Thread, error) {
+	defer c.conn.lock()()
 	return c.thread(false, algorithm, searchCriteria)
 }
 
 func (c *ThreadClient) UidThread(algorithm ThreadAlgorithm, searchCriteria *imap.SearchCriteria) ([]*Thread, error) {
+	defer c.conn.lock()()
 	return c.thread(true, algorithm, searchCriteria)
 }
+
+func (c *ThreadClient) sortThread(uid bool, algorithm ThreadAlgorithm, sortCriteria []SortCriterion, searchCriteria *imap.SearchCriteria, options *ThreadOrderOptions) ([]*Thread, error) {
+	defer c.conn.lock()()
+	threads, err := c.thread(uid, algorithm, searchCriteria)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &SortClient{c: c.c, conn: c.conn, Instrumentation: c.Instrumentation}
+	ids, err := sc.sort(uid, sortCriteria, searchCriteria)
+	if err != nil {
+		return nil, err
+	}
+
+	SortThreads(threads, ids, options)
+	return threads, nil
+}
+
+// SortThread issues a THREAD and a SORT command with the same search criteria,
+// and orders the resulting threads according to the SORT result. See
+// SortThreads.
+func (c *ThreadClient) SortThread(algorithm ThreadAlgorithm, sortCriteria []SortCriterion, searchCriteria *imap.SearchCriteria, options *ThreadOrderOptions) ([]*Thread, error) {
+	return c.sortThread(false, algorithm, sortCriteria, searchCriteria, options)
+}
+
+// UidSortThread is like SortThread, but uses UIDs instead of sequence numbers.
+func (c *ThreadClient) UidSortThread(algorithm ThreadAlgorithm, sortCriteria []SortCriterion, searchCriteria *imap.SearchCriteria, options *ThreadOrderOptions) ([]*Thread, error) {
+	return c.sortThread(true, algorithm, sortCriteria, searchCriteria, options)
+}
+
+// fetchThreads fetches the messages in the threads with a single FETCH
+// command. The messages are indexed by thread ID.
+func (c *ThreadClient) fetchThreads(uid bool, threads []*Thread, items []imap.FetchItem) (map[uint32]*imap.Message, error) {
+	ids := threadsIds(threads)
+	messages := make(map[uint32]*imap.Message, len(ids))
+	if len(ids) == 0 {
+		return messages, nil
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(ids...)
+
+	if uid {
+		items = append(items, imap.FetchUid)
+	}
+
+	ch := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		if uid {
+			done <- c.c.UidFetch(seqset, items, ch)
+		} else {
+			done <- c.c.Fetch(seqset, items, ch)
+		}
+	}()
+	for msg := range ch {
+		if uid {
+			messages[msg.Uid] = msg
+		} else {
+			messages[msg.SeqNum] = msg
+		}
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func (c *ThreadClient) conversations(uid bool, threads []*Thread) ([]*Conversation, error) {
+	defer c.conn.lock()()
+	items := []imap.FetchItem{imap.FetchFlags, imap.FetchEnvelope, imap.FetchRFC822Size}
+	messages, err := c.fetchThreads(uid, threads, items)
+	if err != nil {
+		return nil, err
+	}
+
+	convs := make([]*Conversation, len(threads))
+	for i, t := range threads {
+		convs[i] = NewConversation(t, messages)
+	}
+	return convs, nil
+}
+
+// Conversations fetches the messages in the threads returned by Thread with a
+// single FETCH command and builds a conversation summary for each thread.
+func (c *ThreadClient) Conversations(threads []*Thread) ([]*Conversation, error) {
+	return c.conversations(false, threads)
+}
+
+// UidConversations is like Conversations, but for threads returned by
+// UidThread.
+func (c *ThreadClient) UidConversations(threads []*Thread) ([]*Conversation, error) {
+	return c.conversations(true, threads)
+}
+
+func (c *ThreadClient) sortSiblings(uid bool, threads []*Thread, sortCriteria []SortCriterion) error {
+	defer c.conn.lock()()
+	items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchInternalDate, imap.FetchRFC822Size}
+	for _, crit := range sortCriteria {
+		switch crit.Field {
+		case SortDate:
+			items = append(items, DateHeaderSection.FetchItem())
+		case SortModSeq:
+			items = append(items, fetchModSeq)
+		case SortSaveDate:
+			items = append(items, fetchSaveDate)
+		case SortAnnotation, SortRelevancy:
+			return ErrUnsupportedSortField
+		}
+	}
+
+	messages, err := c.fetchThreads(uid, threads, items)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[uint32]*SortKeys, len(messages))
+	for id, msg := range messages {
+		k := ExtractSortKeys(msg)
+		k.Id = id
+		keys[id] = k
+	}
+	SortThreadSiblings(threads, keys, sortCriteria)
+	return nil
+}
+
+// SortSiblings fetches the messages in the threads returned by Thread with a
+// single FETCH command, and reorders the children of each message according
+// to the sort criteria. See SortThreadSiblings.
+//
+// The ANNOTATION and RELEVANCY sort keys aren't supported.
+func (c *ThreadClient) SortSiblings(threads []*Thread, sortCriteria []SortCriterion) error {
+	return c.sortSiblings(false, threads, sortCriteria)
+}
+
+// UidSortSiblings is like SortSiblings, but for threads returned by
+// UidThread.
+func (c *ThreadClient) UidSortSiblings(threads []*Thread, sortCriteria []SortCriterion) error {
+	return c.sortSiblings(true, threads, sortCriteria)
+}
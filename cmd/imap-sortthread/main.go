@@ -0,0 +1,424 @@
+// Command imap-sortthread runs SORT and THREAD commands against an IMAP
+// server.
+//
+// Usage:
+//
+//	imap-sortthread [options] caps
+//	imap-sortthread [options] sort <criteria> [search criteria...]
+//	imap-sortthread [options] thread <algorithm> [search criteria...]
+//
+// Sort and search criteria are written in IMAP syntax, for instance:
+//
+//	imap-sortthread -addr mail.example.org:993 -username alice \
+//		sort "(REVERSE DATE)" SINCE 1-Jan-2020 FROM bob
+//
+// The password is read from the IMAP_PASSWORD environment variable, unless
+// the -password flag is set.
+//
+// With -archive, messages are read from an mbox file or a Maildir directory
+// instead of a server, and numbered in file order:
+//
+//	imap-sortthread -archive old.mbox -format tree thread REFERENCES
+//
+// Threads can also be written as a Graphviz graph with -format dot.
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap-sortthread"
+	"github.com/emersion/go-imap-sortthread/archive"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-sasl"
+)
+
+var (
+	addr        = flag.String("addr", "", "IMAP server address, host:port")
+	archivePath = flag.String("archive", "", "mbox file or Maildir directory to use instead of a server")
+	useTLS      = flag.Bool("tls", true, "use implicit TLS")
+	startTLS    = flag.Bool("starttls", false, "use STARTTLS, implies -tls=false")
+	insecure    = flag.Bool("insecure", false, "don't verify the server certificate")
+	username    = flag.String("username", "", "username")
+	password    = flag.String("password", "", "password, defaults to $IMAP_PASSWORD")
+	auth        = flag.String("auth", "login", "authentication method: login or plain")
+	mailbox     = flag.String("mailbox", "INBOX", "mailbox to select")
+	uid         = flag.Bool("uid", false, "return UIDs instead of sequence numbers")
+	format      = flag.String("format", "ids", "output format: ids, tree, dot or json")
+	debug       = flag.Bool("debug", false, "print the IMAP exchange to stderr")
+	printHelp   = flag.Bool("help", false, "show usage")
+)
+
+// capabilities is the list of capabilities shown by the caps subcommand.
+var capabilities = []string{
+	sortthread.SortCapability,
+	"ESORT",
+	"CONTEXT=SORT",
+	sortthread.MultiSortCapability,
+	sortthread.ObjectIdCapability,
+	sortthread.ThreadIdCapability,
+	"CONDSTORE",
+	"SAVEDATE",
+	"ANNOTATE-EXPERIMENT-1",
+	"SEARCH=FUZZY",
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage:
+  imap-sortthread [options] caps
+  imap-sortthread [options] sort <criteria> [search criteria...]
+  imap-sortthread [options] thread <algorithm> [search criteria...]
+
+Options:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if *printHelp {
+		usage()
+		return
+	}
+
+	args := flag.Args()
+	if len(args) == 0 || (*addr == "" && *archivePath == "") {
+		usage()
+		os.Exit(2)
+	}
+
+	switch *format {
+	case "ids", "tree", "dot", "json":
+	default:
+		log.Fatalf("unknown output format %q", *format)
+	}
+
+	var src source
+	if *archivePath != "" {
+		if args[0] == "caps" {
+			log.Fatal("the caps subcommand requires a server")
+		}
+		a, err := archive.Open(*archivePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		src = &archiveSource{a}
+	} else {
+		c, err := connect()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer c.Logout()
+		if args[0] == "caps" {
+			if err := showCapabilities(c, os.Stdout); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		src = &imapSource{c}
+	}
+
+	var err error
+	switch args[0] {
+	case "sort":
+		if len(args) < 2 {
+			usage()
+			os.Exit(2)
+		}
+		err = runSort(src, os.Stdout, args[1], args[2:])
+	case "thread":
+		if len(args) < 2 {
+			usage()
+			os.Exit(2)
+		}
+		err = runThread(src, os.Stdout, sortthread.ThreadAlgorithm(strings.ToUpper(args[1])), args[2:])
+	default:
+		log.Fatalf("unknown subcommand %q", args[0])
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func connect() (*client.Client, error) {
+	host, _, _ := net.SplitHostPort(*addr)
+	tlsConfig := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: *insecure,
+	}
+
+	var c *client.Client
+	var err error
+	if *useTLS && !*startTLS {
+		c, err = client.DialTLS(*addr, tlsConfig)
+	} else {
+		c, err = client.Dial(*addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if *debug {
+		c.SetDebug(os.Stderr)
+	}
+
+	if *startTLS {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Logout()
+			return nil, err
+		}
+	}
+
+	if *username != "" {
+		pass := *password
+		if pass == "" {
+			pass = os.Getenv("IMAP_PASSWORD")
+		}
+
+		switch strings.ToLower(*auth) {
+		case "login":
+			err = c.Login(*username, pass)
+		case "plain":
+			err = c.Authenticate(sasl.NewPlainClient("", *username, pass))
+		default:
+			err = fmt.Errorf("unknown authentication method %q", *auth)
+		}
+		if err != nil {
+			c.Logout()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func showCapabilities(c *client.Client, w io.Writer) error {
+	caps, err := c.Capability()
+	if err != nil {
+		return err
+	}
+
+	names := append([]string(nil), capabilities...)
+	for name := range caps {
+		if strings.HasPrefix(name, "THREAD=") || strings.HasPrefix(name, "SORT=") {
+			names = append(names, name)
+		}
+	}
+	for _, name := range sortthread.ThreadCapabilities {
+		if !caps[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names[len(capabilities):])
+
+	for _, name := range names {
+		supported := "no"
+		if caps[name] {
+			supported = "yes"
+		}
+		fmt.Fprintf(w, "%-24s %s\n", name, supported)
+	}
+	return nil
+}
+
+// parseFields parses arguments written in IMAP syntax.
+func parseFields(args string) ([]interface{}, error) {
+	r := imap.NewReader(bufio.NewReader(strings.NewReader(args + "\r\n")))
+	return r.ReadLine()
+}
+
+func parseSortArgs(criteria string, search []string) (*sortthread.SortCommand, error) {
+	if len(search) == 0 {
+		search = []string{"ALL"}
+	}
+	fields, err := parseFields(criteria + " UTF-8 " + strings.Join(search, " "))
+	if err != nil {
+		return nil, err
+	}
+	cmd := new(sortthread.SortCommand)
+	if err := cmd.Parse(fields); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+func parseThreadArgs(algorithm sortthread.ThreadAlgorithm, search []string) (*sortthread.ThreadCommand, error) {
+	if len(search) == 0 {
+		search = []string{"ALL"}
+	}
+	fields, err := parseFields(string(algorithm) + " UTF-8 " + strings.Join(search, " "))
+	if err != nil {
+		return nil, err
+	}
+	cmd := new(sortthread.ThreadCommand)
+	if err := cmd.Parse(fields); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+func runSort(src source, w io.Writer, criteria string, search []string) error {
+	cmd, err := parseSortArgs(criteria, search)
+	if err != nil {
+		return fmt.Errorf("invalid arguments: %v", err)
+	}
+
+	ids, err := src.sort(cmd.SortCriteria, cmd.SearchCriteria)
+	if err != nil {
+		return err
+	}
+
+	switch *format {
+	case "tree", "dot":
+		// Render the result as threads of a single message
+		threads := make([]*sortthread.Thread, len(ids))
+		for i, id := range ids {
+			threads[i] = &sortthread.Thread{Id: id}
+		}
+		return renderThreads(src, w, threads)
+	case "json":
+		if ids == nil {
+			ids = []uint32{}
+		}
+		return writeJSON(w, ids)
+	default:
+		fmt.Fprintln(w, formatIds(ids))
+		return nil
+	}
+}
+
+func runThread(src source, w io.Writer, algorithm sortthread.ThreadAlgorithm, search []string) error {
+	cmd, err := parseThreadArgs(algorithm, search)
+	if err != nil {
+		return fmt.Errorf("invalid arguments: %v", err)
+	}
+
+	threads, err := src.thread(cmd.Algorithm, cmd.SearchCriteria)
+	if err != nil {
+		return err
+	}
+
+	switch *format {
+	case "tree", "dot":
+		return renderThreads(src, w, threads)
+	case "json":
+		return writeJSON(w, newJSONThreads(threads))
+	default:
+		fmt.Fprintln(w, formatThreads(threads))
+		return nil
+	}
+}
+
+// renderThreads writes threads in the tree or dot format, with messages
+// labelled by their envelope.
+func renderThreads(src source, w io.Writer, threads []*sortthread.Thread) error {
+	envelopes, err := src.envelopes(threadIds(threads))
+	if err != nil {
+		return err
+	}
+	label := func(id uint32) string {
+		return messageLabel(id, envelopes[id])
+	}
+	if *format == "dot" {
+		return sortthread.WriteThreadsDOT(w, threads, label)
+	}
+	return sortthread.WriteThreadsTree(w, threads, &sortthread.TreeOptions{Label: label})
+}
+
+func messageLabel(id uint32, env *imap.Envelope) string {
+	label := strconv.FormatUint(uint64(id), 10)
+	if env == nil {
+		return label
+	}
+
+	var from string
+	if len(env.From) > 0 {
+		from = env.From[0].Address()
+		if env.From[0].PersonalName != "" {
+			from = env.From[0].PersonalName
+		}
+	}
+	date := "-"
+	if !env.Date.IsZero() {
+		date = env.Date.Format("2006-01-02 15:04")
+	}
+	return fmt.Sprintf("%s  %s  %s  %s", label, date, from, env.Subject)
+}
+
+func formatIds(ids []uint32) string {
+	l := make([]string, len(ids))
+	for i, id := range ids {
+		l[i] = strconv.FormatUint(uint64(id), 10)
+	}
+	return strings.Join(l, " ")
+}
+
+func threadIds(threads []*sortthread.Thread) []uint32 {
+	var ids []uint32
+	for _, t := range threads {
+		if t.Id != 0 {
+			ids = append(ids, t.Id)
+		}
+		ids = append(ids, threadIds(t.Children)...)
+	}
+	return ids
+}
+
+// formatThreads formats threads like a THREAD response.
+func formatThreads(threads []*sortthread.Thread) string {
+	var s string
+	for _, t := range threads {
+		s += formatThread(t)
+	}
+	return s
+}
+
+func formatThread(t *sortthread.Thread) string {
+	var l []string
+	if t.Id != 0 {
+		l = append(l, strconv.FormatUint(uint64(t.Id), 10))
+	}
+	for len(t.Children) == 1 && t.Id != 0 {
+		t = t.Children[0]
+		l = append(l, strconv.FormatUint(uint64(t.Id), 10))
+	}
+	s := strings.Join(l, " ")
+	if len(t.Children) > 0 && s != "" {
+		s += " "
+	}
+	for _, c := range t.Children {
+		s += formatThread(c)
+	}
+	return "(" + s + ")"
+}
+
+type jsonThread struct {
+	// Zero for dummy thread roots
+	Id       uint32        `json:"id"`
+	Children []*jsonThread `json:"children,omitempty"`
+}
+
+func newJSONThreads(threads []*sortthread.Thread) []*jsonThread {
+	l := make([]*jsonThread, len(threads))
+	for i, t := range threads {
+		l[i] = &jsonThread{Id: t.Id, Children: newJSONThreads(t.Children)}
+	}
+	return l
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
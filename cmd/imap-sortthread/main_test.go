@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap-sortthread"
+)
+
+func TestParseSortArgs(t *testing.T) {
+	cmd, err := parseSortArgs("(REVERSE DATE subject)", []string{"FROM", `"Bob Smith"`, "UNSEEN"})
+	if err != nil {
+		t.Fatal("Expected no error while parsing arguments but got:", err)
+	}
+
+	expected := []sortthread.SortCriterion{
+		{Field: sortthread.SortDate, Reverse: true},
+		{Field: sortthread.SortSubject},
+	}
+	if !reflect.DeepEqual(cmd.SortCriteria, expected) {
+		t.Errorf("Invalid sort criteria: got %v, expected %v", cmd.SortCriteria, expected)
+	}
+	if from := cmd.SearchCriteria.Header.Get("From"); from != "Bob Smith" {
+		t.Errorf("Invalid From search key: got %q, expected %q", from, "Bob Smith")
+	}
+
+	if _, err := parseSortArgs("(REVERSE)", nil); err == nil {
+		t.Error("Expected an error for REVERSE without a sort key")
+	}
+}
+
+func TestFormatThreads(t *testing.T) {
+	threads := []*sortthread.Thread{
+		{Id: 1, Children: []*sortthread.Thread{
+			{Id: 2, Children: []*sortthread.Thread{{Id: 3}}},
+			{Id: 4},
+		}},
+		{Children: []*sortthread.Thread{{Id: 5}, {Id: 6}}},
+	}
+
+	expected := "(1 (2 3)(4))((5)(6))"
+	if s := formatThreads(threads); s != expected {
+		t.Errorf("Invalid threads: got %q, expected %q", s, expected)
+	}
+}
+
+type testSource struct {
+	threads []*sortthread.Thread
+}
+
+func (src *testSource) sort(sortCrit []sortthread.SortCriterion, searchCrit *imap.SearchCriteria) ([]uint32, error) {
+	return []uint32{2, 1}, nil
+}
+
+func (src *testSource) thread(algorithm sortthread.ThreadAlgorithm, searchCrit *imap.SearchCriteria) ([]*sortthread.Thread, error) {
+	return src.threads, nil
+}
+
+func (src *testSource) envelopes(ids []uint32) (map[uint32]*imap.Envelope, error) {
+	envelopes := make(map[uint32]*imap.Envelope)
+	for _, id := range ids {
+		envelopes[id] = &imap.Envelope{Subject: "Message " + formatIds([]uint32{id})}
+	}
+	return envelopes, nil
+}
+
+func TestRenderThreads(t *testing.T) {
+	src := &testSource{threads: []*sortthread.Thread{
+		{Id: 1, Children: []*sortthread.Thread{{Id: 2}}},
+		{Children: []*sortthread.Thread{{Id: 3}, {Id: 4}}},
+	}}
+	defer func(f string) {
+		*format = f
+	}(*format)
+
+	tests := []struct {
+		format   string
+		run      func(w *bytes.Buffer) error
+		expected string
+	}{
+		{
+			format: "tree",
+			run: func(w *bytes.Buffer) error {
+				return runThread(src, w, sortthread.References, nil)
+			},
+			expected: "1  -    Message 1\n" +
+				"└─>2  -    Message 2\n" +
+				"(missing)\n" +
+				"├─>3  -    Message 3\n" +
+				"└─>4  -    Message 4\n",
+		},
+		{
+			format: "dot",
+			run: func(w *bytes.Buffer) error {
+				return runThread(src, w, sortthread.References, nil)
+			},
+			expected: "digraph threads {\n" +
+				"\tn1 [label=\"1  -    Message 1\"];\n" +
+				"\tn1 -> n2;\n" +
+				"\tn2 [label=\"2  -    Message 2\"];\n" +
+				"\tn3 [label=\"(missing)\", style=dashed];\n" +
+				"\tn3 -> n4;\n" +
+				"\tn3 -> n5;\n" +
+				"\tn4 [label=\"3  -    Message 3\"];\n" +
+				"\tn5 [label=\"4  -    Message 4\"];\n" +
+				"}\n",
+		},
+		{
+			format: "tree",
+			run: func(w *bytes.Buffer) error {
+				return runSort(src, w, "(DATE)", nil)
+			},
+			expected: "2  -    Message 2\n1  -    Message 1\n",
+		},
+	}
+	for _, test := range tests {
+		*format = test.format
+		var b bytes.Buffer
+		if err := test.run(&b); err != nil {
+			t.Fatalf("Expected no error while rendering as %v but got: %v", test.format, err)
+		}
+		if s := b.String(); s != test.expected {
+			t.Errorf("Invalid %v output: got %q, expected %q", test.format, s, test.expected)
+		}
+	}
+}
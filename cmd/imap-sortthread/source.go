@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap-sortthread"
+	"github.com/emersion/go-imap-sortthread/archive"
+	"github.com/emersion/go-imap/client"
+)
+
+// source is a set of messages which can be sorted and threaded: a mailbox on
+// an IMAP server, or an archive.
+type source interface {
+	sort(sortCrit []sortthread.SortCriterion, searchCrit *imap.SearchCriteria) ([]uint32, error)
+	thread(algorithm sortthread.ThreadAlgorithm, searchCrit *imap.SearchCriteria) ([]*sortthread.Thread, error)
+	envelopes(ids []uint32) (map[uint32]*imap.Envelope, error)
+}
+
+type imapSource struct {
+	c *client.Client
+}
+
+func (src *imapSource) selectMailbox() error {
+	if src.c.State() == imap.SelectedState {
+		return nil
+	}
+	if src.c.State()&imap.AuthenticatedState == 0 {
+		return errors.New("not logged in, use -username")
+	}
+	_, err := src.c.Select(*mailbox, true)
+	return err
+}
+
+func (src *imapSource) sort(sortCrit []sortthread.SortCriterion, searchCrit *imap.SearchCriteria) ([]uint32, error) {
+	if err := src.selectMailbox(); err != nil {
+		return nil, err
+	}
+
+	sc := sortthread.NewSortClient(src.c)
+	if *uid {
+		return sc.UidSort(sortCrit, searchCrit)
+	}
+	return sc.Sort(sortCrit, searchCrit)
+}
+
+func (src *imapSource) thread(algorithm sortthread.ThreadAlgorithm, searchCrit *imap.SearchCriteria) ([]*sortthread.Thread, error) {
+	if err := src.selectMailbox(); err != nil {
+		return nil, err
+	}
+
+	tc := sortthread.NewThreadClient(src.c)
+	if *uid {
+		return tc.UidThread(algorithm, searchCrit)
+	}
+	return tc.Thread(algorithm, searchCrit)
+}
+
+func (src *imapSource) envelopes(ids []uint32) (map[uint32]*imap.Envelope, error) {
+	envelopes := make(map[uint32]*imap.Envelope, len(ids))
+	if len(ids) == 0 {
+		return envelopes, nil
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(ids...)
+	items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid}
+
+	ch := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		if *uid {
+			done <- src.c.UidFetch(seqSet, items, ch)
+		} else {
+			done <- src.c.Fetch(seqSet, items, ch)
+		}
+	}()
+	for msg := range ch {
+		if *uid {
+			envelopes[msg.Uid] = msg.Envelope
+		} else {
+			envelopes[msg.SeqNum] = msg.Envelope
+		}
+	}
+	return envelopes, <-done
+}
+
+// archiveSource is an mbox file or a Maildir directory. Messages are numbered
+// in file order, and these numbers are used both as sequence numbers and as
+// UIDs.
+type archiveSource struct {
+	a *archive.Archive
+}
+
+func (src *archiveSource) sort(sortCrit []sortthread.SortCriterion, searchCrit *imap.SearchCriteria) ([]uint32, error) {
+	return src.a.Sort(sortCrit, searchCrit)
+}
+
+func (src *archiveSource) thread(algorithm sortthread.ThreadAlgorithm, searchCrit *imap.SearchCriteria) ([]*sortthread.Thread, error) {
+	return src.a.Thread(algorithm, searchCrit)
+}
+
+func (src *archiveSource) envelopes(ids []uint32) (map[uint32]*imap.Envelope, error) {
+	envelopes := make(map[uint32]*imap.Envelope, len(ids))
+	for _, id := range ids {
+		if id == 0 || int(id) > len(src.a.Messages) {
+			continue
+		}
+		env, err := src.a.Messages[id-1].Envelope()
+		if err != nil {
+			return nil, err
+		}
+		envelopes[id] = env
+	}
+	return envelopes, nil
+}
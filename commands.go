@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/utf7"
 )
 
 // SortCommand is a SORT command.
@@ -36,8 +37,8 @@ func parseSortCriteria(fields interface{}) ([]SortCriterion, error) {
 
 	result := make([]SortCriterion, 0, len(list))
 	reverse := false
-	for _, crit := range list {
-		crit, ok := crit.(string)
+	for i := 0; i < len(list); i++ {
+		crit, ok := list[i].(string)
 		if !ok {
 			return nil, errors.New("String is required as a sort key")
 		}
@@ -47,26 +48,75 @@ func parseSortCriteria(fields interface{}) ([]SortCriterion, error) {
 			continue
 		}
 		crit = strings.ToUpper(crit)
-		switch crit {
+		criterion := SortCriterion{
+			Field:   SortField(crit),
+			Reverse: reverse,
+		}
+		switch SortField(crit) {
 		// TODO: Fix types for constants.
-		case string(SortArrival), SortCc, SortDate, SortFrom, SortSize, SortSubject, SortTo:
+		case SortArrival, SortCc, SortDate, SortFrom, SortSize, SortSubject, SortTo:
+		case SortModSeq, SortSaveDate, SortRelevancy:
+		case SortAnnotation:
+			if i+2 >= len(list) {
+				return nil, errors.New("Missing entry and attribute after ANNOTATION")
+			}
+			entry, err := imap.ParseString(list[i+1])
+			if err != nil {
+				return nil, err
+			}
+			attr, err := imap.ParseString(list[i+2])
+			if err != nil {
+				return nil, err
+			}
+			criterion.Annotation = &AnnotationSortKey{Entry: entry, Attribute: attr}
+			i += 2
 		default:
-			return nil, errors.New("Unknown sort criteria: " + crit)
+			return nil, &UnknownSortKeyError{Key: crit}
 		}
-		result = append(result, SortCriterion{
-			Field:   SortField(crit),
-			Reverse: reverse,
-		})
+		result = append(result, criterion)
 		reverse = false
 	}
 
 	if reverse {
-		return nil, errors.New("Missing sort key after REVERSE")
+		return nil, &MissingSortKeyError{}
 	}
 
 	return result, nil
 }
 
+// newCharsetReader returns a function decoding search strings from charset, or
+// nil if no decoding is needed or possible.
+func newCharsetReader(charset string) func(io.Reader) io.Reader {
+	charset = strings.ToLower(charset)
+	if charset == "utf-8" || charset == "us-ascii" || charset == "" {
+		return nil
+	}
+	return func(r io.Reader) io.Reader {
+		// imap.CharsetReader is nil unless the application sets it
+		if imap.CharsetReader == nil {
+			return nil
+		}
+		r, err := imap.CharsetReader(charset, r)
+		if err != nil {
+			return nil
+		}
+		return r
+	}
+}
+
+// supportedCharset checks whether search strings in charset can be decoded.
+func supportedCharset(charset string) bool {
+	switch strings.ToLower(charset) {
+	case "utf-8", "us-ascii", "":
+		return true
+	}
+	if imap.CharsetReader == nil {
+		return false
+	}
+	_, err := imap.CharsetReader(charset, strings.NewReader(""))
+	return err == nil
+}
+
 func (cmd *SortCommand) Parse(fields []interface{}) error {
 	if len(fields) < 3 {
 		return errors.New("Not enough SORT arguments")
@@ -84,17 +134,10 @@ func (cmd *SortCommand) Parse(fields []interface{}) error {
 	if !ok {
 		return errors.New("String is required as a charset")
 	}
-	charset = strings.ToLower(charset)
-	var charsetReader func(io.Reader) io.Reader
-	if charset != "utf-8" && charset != "us-ascii" && charset != "" {
-		charsetReader = func(r io.Reader) io.Reader {
-			r, _ = imap.CharsetReader(charset, r)
-			return r
-		}
-	}
+	cmd.Charset = charset
 
 	cmd.SearchCriteria = &imap.SearchCriteria{}
-	return cmd.SearchCriteria.ParseWithCharset(fields[2:], charsetReader)
+	return cmd.SearchCriteria.ParseWithCharset(fields[2:], newCharsetReader(charset))
 }
 
 // ThreadCommand is a THREAD command.
@@ -129,16 +172,110 @@ func (cmd *ThreadCommand) Parse(fields []interface{}) error {
 	if !ok {
 		return errors.New("Second argument should be a string")
 	}
-	charset = strings.ToLower(charset)
-	var charsetReader func(io.Reader) io.Reader
-	if charset != "utf-8" && charset != "us-ascii" && charset != "" {
-		charsetReader = func(r io.Reader) io.Reader {
-			r, _ = imap.CharsetReader(charset, r)
-			return r
+	cmd.Algorithm = ThreadAlgorithm(algo)
+	cmd.Charset = charset
+	cmd.SearchCriteria = &imap.SearchCriteria{}
+	return cmd.SearchCriteria.ParseWithCharset(fields[2:], newCharsetReader(charset))
+}
+
+// MultiSortCommand is a X-MULTISORT command. It's like UID SORT, but runs on
+// several mailboxes, specified with the "mailboxes" filter from RFC 7377.
+type MultiSortCommand struct {
+	Mailboxes      []string
+	SortCriteria   []SortCriterion
+	Charset        string
+	SearchCriteria *imap.SearchCriteria
+}
+
+func (cmd *MultiSortCommand) Command() *imap.Command {
+	mailboxes := make([]interface{}, len(cmd.Mailboxes))
+	for i, name := range cmd.Mailboxes {
+		name, _ = utf7.Encoding.NewEncoder().String(name)
+		mailboxes[i] = imap.FormatMailboxName(name)
+	}
+
+	sortCmd := SortCommand{
+		SortCriteria:   cmd.SortCriteria,
+		Charset:        cmd.Charset,
+		SearchCriteria: cmd.SearchCriteria,
+	}
+	args := []interface{}{
+		imap.RawString("IN"),
+		[]interface{}{imap.RawString("mailboxes"), mailboxes},
+	}
+	args = append(args, sortCmd.Command().Arguments...)
+
+	return &imap.Command{
+		Name:      MultiSortCapability,
+		Arguments: args,
+	}
+}
+
+func parseMailboxName(f interface{}) (string, error) {
+	name, err := imap.ParseString(f)
+	if err != nil {
+		return "", err
+	}
+	name, err = utf7.Encoding.NewDecoder().String(name)
+	if err != nil {
+		return "", err
+	}
+	return imap.CanonicalMailboxName(name), nil
+}
+
+func parseSourceMailboxes(fields interface{}) ([]string, error) {
+	list, ok := fields.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, errors.New("List is required as source options")
+	}
+
+	var mailboxes []string
+	for i := 0; i < len(list); i++ {
+		filter, ok := list[i].(string)
+		if !ok || !strings.EqualFold(filter, "mailboxes") {
+			return nil, errors.New("Unsupported mailbox filter")
+		}
+		i++
+		if i >= len(list) {
+			return nil, errors.New("Missing mailboxes after filter")
+		}
+
+		names, ok := list[i].([]interface{})
+		if !ok {
+			names = []interface{}{list[i]}
+		}
+		for _, f := range names {
+			name, err := parseMailboxName(f)
+			if err != nil {
+				return nil, err
+			}
+			mailboxes = append(mailboxes, name)
 		}
 	}
+	return mailboxes, nil
+}
 
-	cmd.Algorithm = ThreadAlgorithm(algo)
-	cmd.SearchCriteria = &imap.SearchCriteria{}
-	return cmd.SearchCriteria.ParseWithCharset(fields[2:], charsetReader)
+func (cmd *MultiSortCommand) Parse(fields []interface{}) error {
+	if len(fields) < 2 {
+		return errors.New("Not enough X-MULTISORT arguments")
+	}
+
+	if in, ok := fields[0].(string); !ok || !strings.EqualFold(in, "IN") {
+		return errors.New("Source options are required")
+	}
+
+	var err error
+	cmd.Mailboxes, err = parseSourceMailboxes(fields[1])
+	if err != nil {
+		return err
+	}
+
+	var sortCmd SortCommand
+	if err := sortCmd.Parse(fields[2:]); err != nil {
+		return err
+	}
+	cmd.SortCriteria = sortCmd.SortCriteria
+	cmd.Charset = sortCmd.Charset
+	cmd.SearchCriteria = sortCmd.SearchCriteria
+	return nil
 }
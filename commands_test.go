@@ -0,0 +1,93 @@
+package sortthread
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+var sortCriteriaTests = []struct {
+	name     string
+	fields   []interface{}
+	expected []SortCriterion
+}{
+	{
+		name:   "simple",
+		fields: []interface{}{"REVERSE", "date", "SUBJECT"},
+		expected: []SortCriterion{
+			{Field: SortDate, Reverse: true},
+			{Field: SortSubject},
+		},
+	},
+	{
+		name:   "extensions",
+		fields: []interface{}{"MODSEQ", "REVERSE", "SAVEDATE", "RELEVANCY"},
+		expected: []SortCriterion{
+			{Field: SortModSeq},
+			{Field: SortSaveDate, Reverse: true},
+			{Field: SortRelevancy},
+		},
+	},
+	{
+		name:   "annotation",
+		fields: []interface{}{"REVERSE", "ANNOTATION", "/comment", "value.priv", "SIZE"},
+		expected: []SortCriterion{
+			{
+				Field:      SortAnnotation,
+				Reverse:    true,
+				Annotation: &AnnotationSortKey{Entry: "/comment", Attribute: "value.priv"},
+			},
+			{Field: SortSize},
+		},
+	},
+}
+
+func TestParseSortCriteria(t *testing.T) {
+	for _, test := range sortCriteriaTests {
+		t.Run(test.name, func(t *testing.T) {
+			criteria, err := parseSortCriteria(test.fields)
+			if err != nil {
+				t.Fatal("Expected no error while parsing sort criteria but got:", err)
+			}
+			if !reflect.DeepEqual(criteria, test.expected) {
+				t.Errorf("Got %+v, expected %+v", criteria, test.expected)
+			}
+
+			formatted := formatSortCriteria(criteria).([]interface{})
+			criteria, err = parseSortCriteria(formatFieldsAsStrings(formatted))
+			if err != nil {
+				t.Fatal("Expected no error while parsing formatted sort criteria but got:", err)
+			}
+			if !reflect.DeepEqual(criteria, test.expected) {
+				t.Errorf("Formatted criteria: got %+v, expected %+v", criteria, test.expected)
+			}
+		})
+	}
+}
+
+func TestParseSortCriteriaInvalid(t *testing.T) {
+	invalid := [][]interface{}{
+		{"FOO"},
+		{"DATE", "REVERSE"},
+		{"ANNOTATION", "/comment"},
+	}
+	for _, fields := range invalid {
+		if _, err := parseSortCriteria(fields); err == nil {
+			t.Errorf("Expected an error while parsing %v", fields)
+		}
+	}
+}
+
+// formatFieldsAsStrings converts formatted fields to the types returned by the
+// IMAP reader.
+func formatFieldsAsStrings(fields []interface{}) []interface{} {
+	l := make([]interface{}, len(fields))
+	for i, f := range fields {
+		if s, ok := f.(imap.RawString); ok {
+			f = string(s)
+		}
+		l[i] = f
+	}
+	return l
+}
@@ -0,0 +1,107 @@
+package sortthread
+
+import (
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// Conversation is a summary of a thread.
+type Conversation struct {
+	// The thread this conversation has been built from.
+	Thread *Thread
+	// The message IDs in the thread, in pre-order.
+	Ids []uint32
+	// The base subject of the thread root, see GetBaseSubject.
+	Subject string
+	// The unique senders of the messages, in thread order.
+	Participants []*imap.Address
+	// The sent date of the most recent message, in UTC, as used by
+	// SortDate.
+	Latest time.Time
+	// The number of messages without the \Seen flag.
+	Unread int
+	// The number of messages with the \Flagged flag.
+	Flagged int
+	// The total size of the messages, in bytes.
+	Size uint64
+}
+
+func walkThread(t *Thread, f func(t *Thread)) {
+	f(t)
+	for _, c := range t.Children {
+		walkThread(c, f)
+	}
+}
+
+func threadsIds(threads []*Thread) []uint32 {
+	var ids []uint32
+	for _, t := range threads {
+		walkThread(t, func(t *Thread) {
+			if t.Id != 0 {
+				ids = append(ids, t.Id)
+			}
+		})
+	}
+	return ids
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if imap.CanonicalFlag(f) == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// NewConversation builds a conversation from a thread. messages contains the
+// messages in the thread, indexed by the thread IDs. Messages should have the
+// FLAGS, ENVELOPE, INTERNALDATE and RFC822.SIZE items populated, and may
+// contain DateHeaderSection. Message dates are computed as in
+// ExtractSortKeys. Missing messages are skipped.
+func NewConversation(t *Thread, messages map[uint32]*imap.Message) *Conversation {
+	conv := &Conversation{Thread: t}
+	participants := make(map[string]bool)
+	subjectSet := false
+	walkThread(t, func(t *Thread) {
+		if t.Id == 0 {
+			return
+		}
+		conv.Ids = append(conv.Ids, t.Id)
+
+		msg, ok := messages[t.Id]
+		if !ok || msg == nil {
+			return
+		}
+
+		if !hasFlag(msg.Flags, imap.SeenFlag) {
+			conv.Unread++
+		}
+		if hasFlag(msg.Flags, imap.FlaggedFlag) {
+			conv.Flagged++
+		}
+		conv.Size += uint64(msg.Size)
+		if date := sentDate(msg); date.After(conv.Latest) {
+			conv.Latest = date
+		}
+
+		if msg.Envelope == nil {
+			return
+		}
+		if !subjectSet {
+			conv.Subject, _ = GetBaseSubject(msg.Envelope.Subject)
+			subjectSet = true
+		}
+		for _, addr := range msg.Envelope.From {
+			k := strings.ToLower(addr.Address())
+			if participants[k] {
+				continue
+			}
+			participants[k] = true
+			conv.Participants = append(conv.Participants, addr)
+		}
+	})
+	return conv
+}
@@ -0,0 +1,102 @@
+package sortthread
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestNewConversation(t *testing.T) {
+	alice := &imap.Address{MailboxName: "alice", HostName: "example.org"}
+	bob := &imap.Address{MailboxName: "bob", HostName: "example.org"}
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	thread := &Thread{Id: 1, Children: []*Thread{{Id: 2}, {Id: 3}}}
+	messages := map[uint32]*imap.Message{
+		1: {
+			Flags: []string{imap.SeenFlag},
+			Size:  100,
+			Envelope: &imap.Envelope{
+				Subject: "Hello",
+				Date:    date,
+				From:    []*imap.Address{alice},
+			},
+		},
+		2: {
+			Flags: []string{imap.FlaggedFlag},
+			Size:  200,
+			Envelope: &imap.Envelope{
+				Subject: "Re: Hello",
+				Date:    date.Add(2 * time.Hour),
+				From:    []*imap.Address{bob},
+			},
+		},
+		3: {
+			Size: 300,
+			Envelope: &imap.Envelope{
+				Subject: "Re: Hello",
+				Date:    date.Add(time.Hour),
+				From:    []*imap.Address{alice},
+			},
+		},
+	}
+
+	conv := NewConversation(thread, messages)
+	expected := &Conversation{
+		Thread:       thread,
+		Ids:          []uint32{1, 2, 3},
+		Subject:      "Hello",
+		Participants: []*imap.Address{alice, bob},
+		Latest:       date.Add(2 * time.Hour),
+		Unread:       2,
+		Flagged:      1,
+		Size:         600,
+	}
+	if !reflect.DeepEqual(conv, expected) {
+		t.Errorf("Invalid conversation")
+		t.Logf("Want: %+v", expected)
+		t.Logf("Got:  %+v", conv)
+	}
+}
+
+func TestNewConversationDate(t *testing.T) {
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	header := "Date: Wed, 1 Jan 2020 02:00:00 +0000\r\n\r\n"
+	section := *DateHeaderSection
+	section.Peek = false
+
+	thread := &Thread{Id: 1, Children: []*Thread{{Id: 2}, {Id: 3}}}
+	messages := map[uint32]*imap.Message{
+		// The raw Date header field is preferred over the envelope
+		1: {
+			InternalDate: date,
+			Envelope:     &imap.Envelope{Date: date},
+			Body: map[*imap.BodySectionName]imap.Literal{
+				&section: bytes.NewReader([]byte(header)),
+			},
+		},
+		// Implausible, the internal date is used
+		2: {
+			InternalDate: date.Add(time.Hour),
+			Envelope:     &imap.Envelope{Date: date.Add(30 * 24 * time.Hour)},
+		},
+		3: {
+			InternalDate: date.Add(3 * time.Hour),
+			Envelope:     &imap.Envelope{Date: time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)},
+		},
+	}
+
+	conv := NewConversation(thread, messages)
+	if expected := date.Add(3 * time.Hour); !conv.Latest.Equal(expected) {
+		t.Errorf("Invalid latest date: got %v, expected %v", conv.Latest, expected)
+	}
+
+	delete(messages, 3)
+	conv = NewConversation(thread, messages)
+	if expected := date.Add(2 * time.Hour); !conv.Latest.Equal(expected) {
+		t.Errorf("Invalid latest date: got %v, expected %v", conv.Latest, expected)
+	}
+}
@@ -0,0 +1,312 @@
+package sortthread
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errInvalidDate = errors.New("sortthread: invalid date")
+
+// DatePolicy defines which sent dates are plausible. Implausible dates are
+// replaced with the internal date, as if the Date header field was missing.
+type DatePolicy struct {
+	// Dates before Earliest are implausible. Ignored if zero.
+	Earliest time.Time
+	// Dates later than the internal date plus MaxFuture are implausible.
+	// Ignored if zero or if the internal date is unknown.
+	MaxFuture time.Duration
+}
+
+// DefaultDatePolicy is the policy used by ExtractSortKeys and the THREAD
+// engines. It rejects dates before 1970 and more than a week after the
+// internal date.
+//
+// It's read without synchronization: it may only be replaced or modified
+// during initialization, before any message is sorted or threaded.
+var DefaultDatePolicy = &DatePolicy{
+	Earliest:  time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC),
+	MaxFuture: 7 * 24 * time.Hour,
+}
+
+// Plausible checks whether a sent date is plausible. internalDate may be zero
+// if unknown.
+func (policy *DatePolicy) Plausible(date, internalDate time.Time) bool {
+	if date.IsZero() {
+		return false
+	}
+	if policy == nil {
+		return true
+	}
+	if !policy.Earliest.IsZero() && date.Before(policy.Earliest) {
+		return false
+	}
+	if policy.MaxFuture > 0 && !internalDate.IsZero() && date.After(internalDate.Add(policy.MaxFuture)) {
+		return false
+	}
+	return true
+}
+
+// SentDate returns the sent date of a message, as defined in RFC 5256 section
+// 2.2: the Date header field parsed with ParseDate or, if it's missing,
+// invalid or implausible, the internal date. The result is in UTC.
+func (policy *DatePolicy) SentDate(header string, internalDate time.Time) time.Time {
+	if date, err := ParseDate(header); err == nil && policy.Plausible(date, internalDate) {
+		return date
+	}
+	return internalDate.UTC()
+}
+
+var months = map[string]time.Month{
+	"jan": time.January,
+	"feb": time.February,
+	"mar": time.March,
+	"apr": time.April,
+	"may": time.May,
+	"jun": time.June,
+	"jul": time.July,
+	"aug": time.August,
+	"sep": time.September,
+	"oct": time.October,
+	"nov": time.November,
+	"dec": time.December,
+}
+
+var weekdays = map[string]bool{
+	"mon": true, "tue": true, "wed": true, "thu": true, "fri": true, "sat": true, "sun": true,
+}
+
+// Zone names, in hours from UTC. The first group is defined in RFC 5322
+// section 4.3, the others are common in the wild.
+var zoneOffsets = map[string]int{
+	"ut": 0, "utc": 0, "gmt": 0, "z": 0,
+	"est": -5, "edt": -4, "cst": -6, "cdt": -5, "mst": -7, "mdt": -6, "pst": -8, "pdt": -7,
+
+	"wet": 0, "west": 1, "bst": 1, "cet": 1, "cest": 2, "met": 1, "mest": 2,
+	"eet": 2, "eest": 3, "msk": 3, "hkt": 8, "jst": 9, "kst": 9,
+	"aest": 10, "aedt": 11, "nzst": 12, "nzdt": 13,
+}
+
+// removeComments replaces comments, possibly nested, with spaces.
+func removeComments(s string) string {
+	var sb strings.Builder
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && depth > 0:
+			i++
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+			if depth == 0 {
+				sb.WriteByte(' ')
+			}
+		case depth == 0:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseZoneOffset parses a numeric zone, e.g. "+0200", "+02:00" or "+2".
+func parseZoneOffset(s string) (int, bool) {
+	if len(s) < 2 || (s[0] != '+' && s[0] != '-') {
+		return 0, false
+	}
+	sign := 1
+	if s[0] == '-' {
+		sign = -1
+	}
+	digits := strings.Replace(s[1:], ":", "", 1)
+	if !isDigits(digits) {
+		return 0, false
+	}
+
+	var hours, minutes int
+	switch len(digits) {
+	case 1, 2:
+		hours, _ = strconv.Atoi(digits)
+	case 3, 4:
+		hours, _ = strconv.Atoi(digits[:len(digits)-2])
+		minutes, _ = strconv.Atoi(digits[len(digits)-2:])
+	default:
+		return 0, false
+	}
+	if hours > 23 || minutes > 59 {
+		return 0, false
+	}
+	return sign * (hours*60 + minutes) * 60, true
+}
+
+// parseZone parses a numeric or named zone, e.g. "EST" or "GMT+2".
+func parseZone(s string) (int, bool) {
+	if offset, ok := parseZoneOffset(s); ok {
+		return offset, true
+	}
+
+	lower := strings.ToLower(s)
+	if hours, ok := zoneOffsets[lower]; ok {
+		return hours * 60 * 60, true
+	}
+	for _, prefix := range []string{"gmt", "utc", "ut"} {
+		if strings.HasPrefix(lower, prefix) {
+			return parseZoneOffset(lower[len(prefix):])
+		}
+	}
+	// RFC 5322 section 4.3: military and other unknown alphabetic zones
+	// should be considered equivalent to "-0000"
+	return 0, isAlpha(lower) && len(lower) <= 5
+}
+
+func isAlpha(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 'a' || s[i] > 'z' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// isTimeOfDay checks whether a field is a time. Times with dots are only
+// accepted once the date is complete, to avoid confusion with other fields.
+func isTimeOfDay(s string, hasDate bool) bool {
+	return strings.Contains(s, ":") || hasDate && strings.Contains(s, ".")
+}
+
+// parseTimeOfDay parses "15:04", "15:04:05" or, with dots, "15.04.05".
+func parseTimeOfDay(s string) (hour, min, sec int, ok bool) {
+	sep := ":"
+	if !strings.Contains(s, ":") {
+		sep = "."
+	}
+	parts := strings.Split(s, sep)
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, 0, 0, false
+	}
+	values := make([]int, 3)
+	for i, part := range parts {
+		if !isDigits(part) || len(part) > 2 {
+			return 0, 0, 0, false
+		}
+		values[i], _ = strconv.Atoi(part)
+	}
+	hour, min, sec = values[0], values[1], values[2]
+	// Leap seconds are allowed by RFC 5322
+	if sec == 60 {
+		sec = 59
+	}
+	return hour, min, sec, hour < 24 && min < 60 && sec < 60
+}
+
+// Layouts tried before the RFC 5322 parser, for dates which aren't in the RFC
+// 5322 format at all.
+var isoDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05 MST",
+	"2006-01-02 15:04:05",
+}
+
+// ParseDate parses a Date header field leniently, and returns the date in UTC.
+//
+// The RFC 5322 syntax is supported, including the obsolete syntax: comments,
+// optional day of week and seconds, two- and three-digit years, and
+// alphabetic zones. Unknown alphabetic zones and missing zones are treated as
+// UTC. Common deviations are accepted as well: full month and day names, zones
+// like "GMT+2", times with dots, the asctime format and ISO 8601 dates.
+//
+// An error is returned if the date is missing or invalid, e.g. with an
+// unknown month or an out-of-range day.
+func ParseDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(removeComments(s))
+	if s == "" {
+		return time.Time{}, errInvalidDate
+	}
+	for _, layout := range isoDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\r' || r == '\n' || r == ','
+	})
+
+	day, year, yearDigits := -1, -1, 0
+	var month time.Month
+	var hour, min, sec, offset int
+	var hasTime, hasZone bool
+	for _, f := range fields {
+		lower := strings.ToLower(f)
+		switch {
+		case hasZone:
+			// Trailing garbage after the zone, e.g. a duplicate zone
+		case !hasTime && isAlpha(lower) && len(lower) >= 3 && weekdays[lower[:3]]:
+			// Day of week, ignored
+		case !hasTime && isAlpha(lower) && len(lower) >= 3 && months[lower[:3]] != 0 && month == 0:
+			month = months[lower[:3]]
+		case !hasTime && isTimeOfDay(f, day >= 0 && month != 0 && year >= 0):
+			// The zone can be attached to the time, e.g. "10:00:00+0200"
+			timeOfDay := f
+			if i := strings.IndexAny(f, "+-"); i > 0 {
+				timeOfDay = f[:i]
+				if offset, hasZone = parseZoneOffset(f[i:]); !hasZone {
+					return time.Time{}, errInvalidDate
+				}
+			}
+			var ok bool
+			if hour, min, sec, ok = parseTimeOfDay(timeOfDay); !ok {
+				return time.Time{}, errInvalidDate
+			}
+			hasTime = true
+		case isDigits(f) && day < 0 && !hasTime && len(f) <= 2:
+			day, _ = strconv.Atoi(f)
+		case isDigits(f) && year < 0:
+			// The year follows the time in the asctime format
+			year, _ = strconv.Atoi(f)
+			yearDigits = len(f)
+		case hasTime:
+			var ok bool
+			if offset, ok = parseZone(f); !ok {
+				return time.Time{}, errInvalidDate
+			}
+			hasZone = true
+		default:
+			return time.Time{}, errInvalidDate
+		}
+	}
+
+	if day < 1 || month == 0 || year < 0 || !hasTime {
+		return time.Time{}, errInvalidDate
+	}
+	// RFC 5322 section 4.3: two-digit years below 50 are in the 21st
+	// century, other two- and three-digit years are relative to 1900
+	switch {
+	case yearDigits <= 2 && year < 50:
+		year += 2000
+	case yearDigits <= 3:
+		year += 1900
+	}
+
+	t := time.Date(year, month, day, hour, min, sec, 0, time.FixedZone("", offset))
+	if t.Day() != day {
+		// e.g. February 30
+		return time.Time{}, errInvalidDate
+	}
+	return t.UTC(), nil
+}
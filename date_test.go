@@ -0,0 +1,242 @@
+package sortthread
+
+import (
+	"testing"
+	"time"
+)
+
+var parseDateTests = []struct {
+	name     string
+	date     string
+	expected time.Time // zero if invalid
+}{
+	{
+		name:     "rfc5322",
+		date:     "Fri, 21 Nov 1997 09:55:06 -0600",
+		expected: time.Date(1997, 11, 21, 15, 55, 6, 0, time.UTC),
+	},
+	{
+		name:     "no_day_of_week",
+		date:     "21 Nov 1997 09:55:06 +0000",
+		expected: time.Date(1997, 11, 21, 9, 55, 6, 0, time.UTC),
+	},
+	{
+		name:     "no_seconds",
+		date:     "Fri, 21 Nov 1997 09:55 +0100",
+		expected: time.Date(1997, 11, 21, 8, 55, 0, 0, time.UTC),
+	},
+	{
+		name:     "comment",
+		date:     "Thu, 13 Feb 1969 23:32:54 -0330 (Newfoundland Time)",
+		expected: time.Date(1969, 2, 14, 3, 2, 54, 0, time.UTC),
+	},
+	{
+		name:     "comments_everywhere",
+		date:     "Thu,\r\n\t13\r\n\t  Feb\r\n  1969\r\n  23:32\r\n   -0330 (Newfoundland (nested) Time)",
+		expected: time.Date(1969, 2, 14, 3, 2, 0, 0, time.UTC),
+	},
+	{
+		name:     "two_digit_year_21st_century",
+		date:     "Mon, 6 Jan 20 10:00:00 +0000",
+		expected: time.Date(2020, 1, 6, 10, 0, 0, 0, time.UTC),
+	},
+	{
+		name:     "two_digit_year_20th_century",
+		date:     "Wed, 1 Jan 97 10:00:00 +0000",
+		expected: time.Date(1997, 1, 1, 10, 0, 0, 0, time.UTC),
+	},
+	{
+		name:     "three_digit_year",
+		date:     "Thu, 1 Jan 103 10:00:00 +0000",
+		expected: time.Date(2003, 1, 1, 10, 0, 0, 0, time.UTC),
+	},
+	{
+		name:     "obsolete_zone",
+		date:     "Mon, 6 Jan 2020 10:00:00 EST",
+		expected: time.Date(2020, 1, 6, 15, 0, 0, 0, time.UTC),
+	},
+	{
+		name:     "obsolete_zone_lowercase",
+		date:     "Mon, 6 Jan 2020 10:00:00 pdt",
+		expected: time.Date(2020, 1, 6, 17, 0, 0, 0, time.UTC),
+	},
+	{
+		name:     "gmt",
+		date:     "Mon, 6 Jan 2020 10:00:00 GMT",
+		expected: time.Date(2020, 1, 6, 10, 0, 0, 0, time.UTC),
+	},
+	{
+		name:     "utc",
+		date:     "Mon, 6 Jan 2020 10:00:00 UTC",
+		expected: time.Date(2020, 1, 6, 10, 0, 0, 0, time.UTC),
+	},
+	{
+		name:     "gmt_offset",
+		date:     "Mon, 6 Jan 2020 10:00:00 GMT+2",
+		expected: time.Date(2020, 1, 6, 8, 0, 0, 0, time.UTC),
+	},
+	{
+		name:     "gmt_offset_minutes",
+		date:     "Mon, 6 Jan 2020 10:00:00 GMT-05:30",
+		expected: time.Date(2020, 1, 6, 15, 30, 0, 0, time.UTC),
+	},
+	{
+		name:     "military_zone",
+		date:     "Mon, 6 Jan 2020 10:00:00 Z",
+		expected: time.Date(2020, 1, 6, 10, 0, 0, 0, time.UTC),
+	},
+	{
+		name:     "unknown_zone",
+		date:     "Mon, 6 Jan 2020 10:00:00 XYZT",
+		expected: time.Date(2020, 1, 6, 10, 0, 0, 0, time.UTC),
+	},
+	{
+		name:     "missing_zone",
+		date:     "Mon, 6 Jan 2020 10:00:00",
+		expected: time.Date(2020, 1, 6, 10, 0, 0, 0, time.UTC),
+	},
+	{
+		name:     "zone_and_name",
+		date:     "Mon, 6 Jan 2020 10:00:00 +0100 CET",
+		expected: time.Date(2020, 1, 6, 9, 0, 0, 0, time.UTC),
+	},
+	{
+		name:     "common_zone",
+		date:     "Mon, 6 Jul 2020 10:00:00 CEST",
+		expected: time.Date(2020, 7, 6, 8, 0, 0, 0, time.UTC),
+	},
+	{
+		name:     "attached_zone",
+		date:     "Mon, 6 Jan 2020 10:00:00+0200",
+		expected: time.Date(2020, 1, 6, 8, 0, 0, 0, time.UTC),
+	},
+	{
+		name:     "colon_zone",
+		date:     "Mon, 6 Jan 2020 10:00:00 +02:00",
+		expected: time.Date(2020, 1, 6, 8, 0, 0, 0, time.UTC),
+	},
+	{
+		name:     "full_names",
+		date:     "Monday, 6 January 2020 10:00:00 +0000",
+		expected: time.Date(2020, 1, 6, 10, 0, 0, 0, time.UTC),
+	},
+	{
+		name:     "no_comma",
+		date:     "Mon 6 Jan 2020 10:00:00 +0000",
+		expected: time.Date(2020, 1, 6, 10, 0, 0, 0, time.UTC),
+	},
+	{
+		name:     "dotted_time",
+		date:     "Mon, 6 Jan 2020 10.30.00 +0000",
+		expected: time.Date(2020, 1, 6, 10, 30, 0, 0, time.UTC),
+	},
+	{
+		name:     "leap_second",
+		date:     "Wed, 31 Dec 2008 23:59:60 +0000",
+		expected: time.Date(2008, 12, 31, 23, 59, 59, 0, time.UTC),
+	},
+	{
+		name:     "asctime",
+		date:     "Mon Jan  6 10:00:00 2020",
+		expected: time.Date(2020, 1, 6, 10, 0, 0, 0, time.UTC),
+	},
+	{
+		name:     "iso8601",
+		date:     "2020-01-06T10:00:00+01:00",
+		expected: time.Date(2020, 1, 6, 9, 0, 0, 0, time.UTC),
+	},
+	{
+		name:     "iso8601_space",
+		date:     "2020-01-06 10:00:00",
+		expected: time.Date(2020, 1, 6, 10, 0, 0, 0, time.UTC),
+	},
+	{
+		name: "empty",
+		date: "",
+	},
+	{
+		name: "comment_only",
+		date: "(no date)",
+	},
+	{
+		name: "garbage",
+		date: "not a date",
+	},
+	{
+		name: "unknown_month",
+		date: "Mon, 32 Foo 2019 10:00:00 +0000",
+	},
+	{
+		name: "day_out_of_range",
+		date: "Mon, 32 Jan 2019 10:00:00 +0000",
+	},
+	{
+		name: "february_30",
+		date: "Sun, 30 Feb 2020 10:00:00 +0000",
+	},
+	{
+		name: "hour_out_of_range",
+		date: "Mon, 6 Jan 2020 25:00:00 +0000",
+	},
+	{
+		name: "zone_out_of_range",
+		date: "Mon, 6 Jan 2020 10:00:00 +9900",
+	},
+	{
+		name: "missing_time",
+		date: "Mon, 6 Jan 2020",
+	},
+	{
+		name: "missing_year",
+		date: "Mon, 6 Jan 10:00:00 +0000",
+	},
+}
+
+func TestParseDate(t *testing.T) {
+	for _, test := range parseDateTests {
+		t.Run(test.name, func(t *testing.T) {
+			date, err := ParseDate(test.date)
+			if test.expected.IsZero() {
+				if err == nil {
+					t.Errorf("Expected an error, got %v", date)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if !date.Equal(test.expected) || date.Location() != time.UTC {
+				t.Errorf("Invalid date: got %v, expected %v", date, test.expected)
+			}
+		})
+	}
+}
+
+func TestDatePolicySentDate(t *testing.T) {
+	internalDate := time.Date(2020, 1, 6, 12, 0, 0, 0, time.FixedZone("", 3600))
+
+	tests := []struct {
+		header   string
+		expected time.Time
+	}{
+		{"Mon, 6 Jan 2020 10:00:00 +0000", time.Date(2020, 1, 6, 10, 0, 0, 0, time.UTC)},
+		{"", internalDate},
+		{"Mon, 32 Foo 2019", internalDate},
+		// Implausible dates
+		{"Thu, 1 Jan 1920 10:00:00 +0000", internalDate},
+		{"Fri, 1 Jan 2038 10:00:00 +0000", internalDate},
+	}
+	for _, test := range tests {
+		date := DefaultDatePolicy.SentDate(test.header, internalDate)
+		if !date.Equal(test.expected) || date.Location() != time.UTC {
+			t.Errorf("SentDate(%q) = %v, expected %v", test.header, date, test.expected)
+		}
+	}
+
+	// A nil policy accepts all valid dates
+	var policy *DatePolicy
+	expected := time.Date(2038, 1, 1, 10, 0, 0, 0, time.UTC)
+	if date := policy.SentDate("Fri, 1 Jan 2038 10:00:00 +0000", internalDate); !date.Equal(expected) {
+		t.Errorf("Invalid date with nil policy: got %v, expected %v", date, expected)
+	}
+}
@@ -0,0 +1,204 @@
+package sortthread
+
+// ThreadEditKind is the kind of a ThreadEdit.
+type ThreadEditKind int
+
+const (
+	// ThreadEditAdd indicates that a message has been added under Parent.
+	ThreadEditAdd ThreadEditKind = iota
+	// ThreadEditRemove indicates that a message has been removed from under
+	// OldParent.
+	ThreadEditRemove
+	// ThreadEditMove indicates that a message has been re-parented from
+	// OldParent to Parent.
+	ThreadEditMove
+	// ThreadEditMerge indicates that the threads rooted at Roots in the old
+	// result have been merged into the thread rooted at Id.
+	ThreadEditMerge
+	// ThreadEditSplit indicates that the thread rooted at Id in the old result
+	// has been split into the threads rooted at Roots.
+	ThreadEditSplit
+)
+
+func (k ThreadEditKind) String() string {
+	switch k {
+	case ThreadEditAdd:
+		return "add"
+	case ThreadEditRemove:
+		return "remove"
+	case ThreadEditMove:
+		return "move"
+	case ThreadEditMerge:
+		return "merge"
+	case ThreadEditSplit:
+		return "split"
+	}
+	return "unknown"
+}
+
+// ThreadEdit is a single change between two THREAD results.
+//
+// Parent and OldParent are zero when the message is (or was) a thread root.
+// A thread rooted at a dummy message is identified by the ID of its first
+// message, and the children of the dummy are thread roots.
+type ThreadEdit struct {
+	Kind      ThreadEditKind
+	Id        uint32
+	Parent    uint32
+	OldParent uint32
+	Roots     []uint32
+}
+
+type threadIndex struct {
+	order  []uint32
+	parent map[uint32]uint32
+	root   map[uint32]uint32
+	roots  []uint32
+}
+
+func newThreadIndex(threads []*Thread) *threadIndex {
+	idx := &threadIndex{
+		parent: make(map[uint32]uint32),
+		root:   make(map[uint32]uint32),
+	}
+	var walk func(t *Thread, parent, root uint32)
+	walk = func(t *Thread, parent, root uint32) {
+		if t.Id == 0 {
+			// Dummy message, its children take its place
+			for _, c := range t.Children {
+				walk(c, parent, root)
+			}
+			return
+		}
+		if _, ok := idx.parent[t.Id]; ok {
+			// Duplicate ID, keep the first occurrence
+			return
+		}
+		idx.order = append(idx.order, t.Id)
+		idx.parent[t.Id] = parent
+		idx.root[t.Id] = root
+		for _, c := range t.Children {
+			walk(c, t.Id, root)
+		}
+	}
+	for _, t := range threads {
+		// A thread rooted at a dummy message is keyed by its first message
+		root := firstThreadId(t)
+		if root == 0 {
+			continue
+		}
+		if _, ok := idx.parent[root]; ok {
+			continue
+		}
+		idx.roots = append(idx.roots, root)
+		walk(t, 0, root)
+	}
+	return idx
+}
+
+// firstThreadId returns the ID of the first non-dummy message of t in
+// pre-order, or zero if there is none.
+func firstThreadId(t *Thread) uint32 {
+	if t.Id != 0 {
+		return t.Id
+	}
+	for _, c := range t.Children {
+		if id := firstThreadId(c); id != 0 {
+			return id
+		}
+	}
+	return 0
+}
+
+// crossRoots maps each root of a to the roots of b containing the messages of
+// its thread, in pre-order of a.
+func crossRoots(a, b *threadIndex) map[uint32][]uint32 {
+	type rootPair struct {
+		a, b uint32
+	}
+
+	crossed := make(map[uint32][]uint32)
+	seen := make(map[rootPair]bool)
+	for _, id := range a.order {
+		bRoot, ok := b.root[id]
+		if !ok {
+			continue
+		}
+		pair := rootPair{a.root[id], bRoot}
+		if seen[pair] {
+			continue
+		}
+		seen[pair] = true
+		crossed[pair.a] = append(crossed[pair.a], bRoot)
+	}
+	return crossed
+}
+
+// DiffThreads computes the edits needed to turn the old THREAD result into the
+// new one. Messages are identified by their ID, so both results must use the
+// same kind of IDs (sequence numbers or UIDs).
+//
+// Edits are returned in this order: merges, splits, removals, additions and
+// moves. Additions and moves are listed in pre-order of the new result, so a
+// parent is always added before its children.
+func DiffThreads(old, new []*Thread) []ThreadEdit {
+	oldIdx := newThreadIndex(old)
+	newIdx := newThreadIndex(new)
+
+	var edits []ThreadEdit
+
+	// Merges: a new thread which contains messages from several old threads
+	oldRoots := crossRoots(newIdx, oldIdx)
+	for _, root := range newIdx.roots {
+		if len(oldRoots[root]) > 1 {
+			edits = append(edits, ThreadEdit{
+				Kind:  ThreadEditMerge,
+				Id:    root,
+				Roots: oldRoots[root],
+			})
+		}
+	}
+
+	// Splits: an old thread whose messages are now in several new threads
+	newRoots := crossRoots(oldIdx, newIdx)
+	for _, root := range oldIdx.roots {
+		if len(newRoots[root]) > 1 {
+			edits = append(edits, ThreadEdit{
+				Kind:  ThreadEditSplit,
+				Id:    root,
+				Roots: newRoots[root],
+			})
+		}
+	}
+
+	for _, id := range oldIdx.order {
+		if _, ok := newIdx.parent[id]; !ok {
+			edits = append(edits, ThreadEdit{
+				Kind:      ThreadEditRemove,
+				Id:        id,
+				OldParent: oldIdx.parent[id],
+			})
+		}
+	}
+
+	for _, id := range newIdx.order {
+		parent := newIdx.parent[id]
+		oldParent, ok := oldIdx.parent[id]
+		if !ok {
+			edits = append(edits, ThreadEdit{
+				Kind:   ThreadEditAdd,
+				Id:     id,
+				Parent: parent,
+			})
+		} else if oldParent != parent {
+			edits = append(edits, ThreadEdit{
+				Kind:      ThreadEditMove,
+				Id:        id,
+				Parent:    parent,
+				OldParent: oldParent,
+			})
+		}
+	}
+
+	return edits
+}
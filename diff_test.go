@@ -0,0 +1,136 @@
+package sortthread
+
+import (
+	"reflect"
+	"testing"
+)
+
+var diffTests = []struct {
+	name     string
+	old      []*Thread
+	new      []*Thread
+	expected []ThreadEdit
+}{
+	{
+		name:     "same",
+		old:      []*Thread{{Id: 1, Children: []*Thread{{Id: 2}}}},
+		new:      []*Thread{{Id: 1, Children: []*Thread{{Id: 2}}}},
+		expected: nil,
+	},
+	{
+		name: "add",
+		old:  []*Thread{{Id: 1}},
+		new:  []*Thread{{Id: 1, Children: []*Thread{{Id: 2}}}, {Id: 3}},
+		expected: []ThreadEdit{
+			{Kind: ThreadEditAdd, Id: 2, Parent: 1},
+			{Kind: ThreadEditAdd, Id: 3},
+		},
+	},
+	{
+		name: "remove",
+		old:  []*Thread{{Id: 1, Children: []*Thread{{Id: 2}}}},
+		new:  []*Thread{{Id: 1}},
+		expected: []ThreadEdit{
+			{Kind: ThreadEditRemove, Id: 2, OldParent: 1},
+		},
+	},
+	{
+		name: "move",
+		old:  []*Thread{{Id: 1, Children: []*Thread{{Id: 2}, {Id: 3}}}},
+		new:  []*Thread{{Id: 1, Children: []*Thread{{Id: 2, Children: []*Thread{{Id: 3}}}}}},
+		expected: []ThreadEdit{
+			{Kind: ThreadEditMove, Id: 3, Parent: 2, OldParent: 1},
+		},
+	},
+	{
+		name: "merge",
+		old:  []*Thread{{Id: 1}, {Id: 2}},
+		new:  []*Thread{{Id: 4, Children: []*Thread{{Id: 1}, {Id: 2}}}},
+		expected: []ThreadEdit{
+			{Kind: ThreadEditMerge, Id: 4, Roots: []uint32{1, 2}},
+			{Kind: ThreadEditAdd, Id: 4},
+			{Kind: ThreadEditMove, Id: 1, Parent: 4},
+			{Kind: ThreadEditMove, Id: 2, Parent: 4},
+		},
+	},
+	{
+		name: "split",
+		old:  []*Thread{{Id: 1, Children: []*Thread{{Id: 2}, {Id: 3}}}},
+		new:  []*Thread{{Id: 2}, {Id: 3}},
+		expected: []ThreadEdit{
+			{Kind: ThreadEditSplit, Id: 1, Roots: []uint32{2, 3}},
+			{Kind: ThreadEditRemove, Id: 1},
+			{Kind: ThreadEditMove, Id: 2, OldParent: 1},
+			{Kind: ThreadEditMove, Id: 3, OldParent: 1},
+		},
+	},
+	{
+		name: "merge dummy",
+		old:  []*Thread{{Id: 3}, {Id: 5}},
+		new:  []*Thread{{Children: []*Thread{{Id: 3}, {Id: 5}}}},
+		expected: []ThreadEdit{
+			{Kind: ThreadEditMerge, Id: 3, Roots: []uint32{3, 5}},
+		},
+	},
+	{
+		name: "split dummy",
+		old:  []*Thread{{Children: []*Thread{{Id: 3}, {Id: 5, Children: []*Thread{{Id: 6}}}}}},
+		new:  []*Thread{{Id: 3}, {Id: 5, Children: []*Thread{{Id: 6}}}},
+		expected: []ThreadEdit{
+			{Kind: ThreadEditSplit, Id: 3, Roots: []uint32{3, 5}},
+		},
+	},
+	{
+		name:     "dummy same",
+		old:      []*Thread{{Children: []*Thread{{Id: 3}, {Id: 5}}}},
+		new:      []*Thread{{Children: []*Thread{{Id: 3}, {Id: 5}}}},
+		expected: nil,
+	},
+	{
+		name: "dummy to root",
+		old:  []*Thread{{Children: []*Thread{{Id: 3}, {Id: 5}}}},
+		new:  []*Thread{{Id: 3, Children: []*Thread{{Id: 5}}}},
+		expected: []ThreadEdit{
+			{Kind: ThreadEditMove, Id: 5, Parent: 3},
+		},
+	},
+}
+
+func TestDiffThreads(t *testing.T) {
+	for _, test := range diffTests {
+		t.Run(test.name, func(t *testing.T) {
+			edits := DiffThreads(test.old, test.new)
+			if !reflect.DeepEqual(edits, test.expected) {
+				t.Errorf("Invalid diff")
+				t.Logf("Want: %+v", test.expected)
+				t.Logf("Got:  %+v", edits)
+			}
+		})
+	}
+}
+
+// newBenchmarkThreads returns n threads of 4 messages.
+func newBenchmarkThreads(n int) []*Thread {
+	threads := make([]*Thread, n)
+	for i := range threads {
+		id := uint32(i*4 + 1)
+		threads[i] = &Thread{Id: id, Children: []*Thread{
+			{Id: id + 1, Children: []*Thread{{Id: id + 2}}},
+			{Id: id + 3},
+		}}
+	}
+	return threads
+}
+
+func BenchmarkDiffThreads(b *testing.B) {
+	old := newBenchmarkThreads(32000)
+	new := newBenchmarkThreads(32000)
+	// A new message merging two threads
+	new[0] = &Thread{Id: 200000, Children: []*Thread{new[0], new[1]}}
+	new = append(new[:1], new[2:]...)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		DiffThreads(old, new)
+	}
+}
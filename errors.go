@@ -0,0 +1,212 @@
+package sortthread
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// CodeServerBug is the SERVERBUG response code, defined in RFC 5530.
+const CodeServerBug imap.StatusRespCode = "SERVERBUG"
+
+// supportedCharsets is the list of charsets always supported for search
+// strings.
+var supportedCharsets = []string{"UTF-8", "US-ASCII"}
+
+// UnknownSortKeyError is returned when parsing an unknown sort key. Servers
+// reply with BAD.
+//
+// Clients return it when the server rejects a sort key, and it matches
+// ErrUnsupportedSortField with errors.Is. Detection is best-effort for servers
+// other than this package's, see parseSortKeyError.
+type UnknownSortKeyError struct {
+	Key string
+}
+
+const unknownSortKeyPrefix = "Unknown sort criteria: "
+
+func (err *UnknownSortKeyError) Error() string {
+	return unknownSortKeyPrefix + err.Key
+}
+
+func (err *UnknownSortKeyError) Is(target error) bool {
+	return target == ErrUnsupportedSortField
+}
+
+// MissingSortKeyError is returned when parsing sort criteria ending with
+// REVERSE. Servers reply with BAD.
+type MissingSortKeyError struct{}
+
+func (err *MissingSortKeyError) Error() string {
+	return "Missing sort key after REVERSE"
+}
+
+// UnsupportedAlgorithmError is returned when a threading algorithm isn't
+// advertised by the server. Servers reply with BAD.
+type UnsupportedAlgorithmError struct {
+	Algorithm ThreadAlgorithm
+}
+
+func (err *UnsupportedAlgorithmError) Error() string {
+	return "Unsupported threading algorithm " + string(err.Algorithm)
+}
+
+// BadCharsetError is returned when the search charset isn't supported. Servers
+// reply with NO [BADCHARSET].
+type BadCharsetError struct {
+	Charset string
+	// The charsets supported by the server, if known.
+	Supported []string
+}
+
+func (err *BadCharsetError) Error() string {
+	return "Unsupported charset " + err.Charset
+}
+
+// LimitError is returned when a limit set in ExtensionOptions is exceeded.
+// Servers reply with NO [LIMIT].
+type LimitError struct {
+	Info string
+}
+
+func (err *LimitError) Error() string {
+	return err.Info
+}
+
+// BackendError is returned when the backend fails to sort or thread messages.
+// Servers reply with NO [SERVERBUG], unless the backend error is an
+// imap.ErrStatusResp.
+type BackendError struct {
+	Err error
+}
+
+func (err *BackendError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *BackendError) Unwrap() error {
+	return err.Err
+}
+
+func rawStrings(l []string) []interface{} {
+	fields := make([]interface{}, len(l))
+	for i, s := range l {
+		fields[i] = imap.RawString(s)
+	}
+	return fields
+}
+
+// statusError converts an error returned by a SORT or THREAD handler to the
+// matching status response.
+func statusError(err error) error {
+	var (
+		statusErr     *imap.ErrStatusResp
+		unknownKeyErr *UnknownSortKeyError
+		missingKeyErr *MissingSortKeyError
+		algorithmErr  *UnsupportedAlgorithmError
+		charsetErr    *BadCharsetError
+		limitErr      *LimitError
+		backendErr    *BackendError
+		resp          *imap.StatusResp
+	)
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &statusErr):
+		return statusErr
+	case errors.As(err, &unknownKeyErr), errors.As(err, &missingKeyErr), errors.As(err, &algorithmErr):
+		resp = &imap.StatusResp{Type: imap.StatusRespBad}
+	case errors.As(err, &charsetErr):
+		supported := charsetErr.Supported
+		if supported == nil {
+			supported = supportedCharsets
+		}
+		resp = &imap.StatusResp{
+			Type:      imap.StatusRespNo,
+			Code:      imap.CodeBadCharset,
+			Arguments: []interface{}{rawStrings(supported)},
+		}
+	case errors.As(err, &limitErr):
+		resp = &imap.StatusResp{Type: imap.StatusRespNo, Code: CodeLimit}
+	case errors.As(err, &backendErr):
+		resp = &imap.StatusResp{Type: imap.StatusRespNo, Code: CodeServerBug}
+	default:
+		return err
+	}
+	resp.Info = err.Error()
+	return &imap.ErrStatusResp{Resp: resp}
+}
+
+// parseSortKeyError returns an UnknownSortKeyError if a BAD response rejects
+// one of the sort keys of a command, or nil.
+//
+// Servers don't use a response code for this. The text sent by this package
+// is recognized exactly. For other servers, this is a best-effort guess: the
+// key is looked for in the human-readable text, which isn't standardized and
+// may mention a key for another reason. Only keys not defined in RFC 5256 are
+// considered, since servers supporting SORT know the other ones.
+func parseSortKeyError(status *imap.StatusResp, sortCriteria []SortCriterion) error {
+	// Sent by this package
+	if strings.HasPrefix(status.Info, unknownSortKeyPrefix) {
+		return &UnknownSortKeyError{Key: strings.TrimPrefix(status.Info, unknownSortKeyPrefix)}
+	}
+
+	words := strings.FieldsFunc(strings.ToUpper(status.Info), func(r rune) bool {
+		return !('A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-' || r == '_')
+	})
+	for _, c := range sortCriteria {
+		switch c.Field {
+		case SortArrival, SortCc, SortDate, SortFrom, SortSize, SortSubject, SortTo:
+			continue
+		}
+		for _, w := range words {
+			if w == strings.ToUpper(string(c.Field)) {
+				return &UnknownSortKeyError{Key: string(c.Field)}
+			}
+		}
+	}
+	return nil
+}
+
+// parseStatusError converts a status response received by a client to an
+// error. NO responses with the BADCHARSET and LIMIT codes are converted to
+// BadCharsetError and LimitError, other NO responses to BackendError. BAD
+// responses rejecting one of the sort keys, if any, are converted to
+// UnknownSortKeyError. Other errors are returned as imap.ErrStatusResp.
+func parseStatusError(status *imap.StatusResp, charset string, sortCriteria []SortCriterion) error {
+	if status == nil {
+		return nil
+	}
+	if err := status.Err(); err == nil {
+		return nil
+	}
+
+	if status.Type == imap.StatusRespBad {
+		if err := parseSortKeyError(status, sortCriteria); err != nil {
+			return err
+		}
+	}
+
+	if status.Type == imap.StatusRespNo {
+		switch status.Code {
+		case imap.CodeBadCharset:
+			charsetErr := &BadCharsetError{Charset: charset}
+			if len(status.Arguments) > 0 {
+				if list, ok := status.Arguments[0].([]interface{}); ok {
+					for _, f := range list {
+						if s, err := imap.ParseString(f); err == nil {
+							charsetErr.Supported = append(charsetErr.Supported, strings.ToUpper(s))
+						}
+					}
+				}
+			}
+			return charsetErr
+		case CodeLimit:
+			return &LimitError{Info: status.Info}
+		default:
+			return &BackendError{Err: &imap.ErrStatusResp{Resp: status}}
+		}
+	}
+	return &imap.ErrStatusResp{Resp: status}
+}
@@ -0,0 +1,156 @@
+package sortthread
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+var statusErrorTests = []struct {
+	name string
+	err  error
+	typ  imap.StatusRespType
+	code imap.StatusRespCode
+}{
+	{
+		name: "unknown_sort_key",
+		err:  &UnknownSortKeyError{Key: "COLOR"},
+		typ:  imap.StatusRespBad,
+	},
+	{
+		name: "missing_sort_key",
+		err:  &MissingSortKeyError{},
+		typ:  imap.StatusRespBad,
+	},
+	{
+		name: "unsupported_algorithm",
+		err:  &UnsupportedAlgorithmError{Algorithm: "REFS"},
+		typ:  imap.StatusRespBad,
+	},
+	{
+		name: "bad_charset",
+		err:  &BadCharsetError{Charset: "X-UNKNOWN"},
+		typ:  imap.StatusRespNo,
+		code: imap.CodeBadCharset,
+	},
+	{
+		name: "limit",
+		err:  &LimitError{Info: "Too many results"},
+		typ:  imap.StatusRespNo,
+		code: CodeLimit,
+	},
+	{
+		name: "backend",
+		err:  &BackendError{Err: errors.New("disk on fire")},
+		typ:  imap.StatusRespNo,
+		code: CodeServerBug,
+	},
+	{
+		name: "backend_status",
+		err: &BackendError{Err: &imap.ErrStatusResp{Resp: &imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: imap.CodeTryCreate,
+			Info: "No such mailbox",
+		}}},
+		typ:  imap.StatusRespNo,
+		code: imap.CodeTryCreate,
+	},
+}
+
+func TestStatusError(t *testing.T) {
+	for _, test := range statusErrorTests {
+		t.Run(test.name, func(t *testing.T) {
+			err := statusError(test.err)
+			statusErr, ok := err.(*imap.ErrStatusResp)
+			if !ok {
+				t.Fatalf("Expected a status response error, got %#v", err)
+			}
+			if resp := statusErr.Resp; resp.Type != test.typ || resp.Code != test.code {
+				t.Errorf("Invalid status response: got %v [%v], expected %v [%v]", resp.Type, resp.Code, test.typ, test.code)
+			}
+			if statusErr.Error() != test.err.Error() {
+				t.Errorf("Invalid status text: got %q, expected %q", statusErr.Error(), test.err.Error())
+			}
+		})
+	}
+}
+
+func TestParseStatusError(t *testing.T) {
+	if err := parseStatusError(&imap.StatusResp{Type: imap.StatusRespOk}, "UTF-8", nil); err != nil {
+		t.Errorf("Expected no error for OK, got %v", err)
+	}
+
+	err := parseStatusError(&imap.StatusResp{
+		Type:      imap.StatusRespNo,
+		Code:      imap.CodeBadCharset,
+		Arguments: []interface{}{[]interface{}{"utf-8", "ISO-8859-1"}},
+	}, "X-UNKNOWN", nil)
+	var charsetErr *BadCharsetError
+	if !errors.As(err, &charsetErr) {
+		t.Fatalf("Expected BadCharsetError, got %#v", err)
+	}
+	expected := &BadCharsetError{Charset: "X-UNKNOWN", Supported: []string{"UTF-8", "ISO-8859-1"}}
+	if !reflect.DeepEqual(charsetErr, expected) {
+		t.Errorf("Invalid error: got %#v, expected %#v", charsetErr, expected)
+	}
+
+	err = parseStatusError(&imap.StatusResp{Type: imap.StatusRespNo, Code: CodeLimit, Info: "Too many results"}, "UTF-8", nil)
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Info != "Too many results" {
+		t.Errorf("Expected LimitError, got %#v", err)
+	}
+
+	err = parseStatusError(&imap.StatusResp{Type: imap.StatusRespBad, Info: "Syntax error"}, "UTF-8", nil)
+	var statusErr *imap.ErrStatusResp
+	if !errors.As(err, &statusErr) || err.Error() != "Syntax error" {
+		t.Errorf("Expected status response error, got %#v", err)
+	}
+
+	if err := parseStatusError(nil, "UTF-8", nil); err != nil {
+		t.Errorf("Expected no error without a status response, got %v", err)
+	}
+
+	sortCrit := []SortCriterion{{Field: SortDate}, {Field: SortSaveDate}}
+	tests := []struct {
+		info string
+		key  string
+	}{
+		{"Unknown sort criteria: COLOR", "COLOR"},
+		{"Error in IMAP command UID SORT: Unknown sort argument: savedate", "SAVEDATE"},
+		// Base sort keys are always supported
+		{"Invalid DATE", ""},
+		{"Syntax error", ""},
+	}
+	for _, test := range tests {
+		err := parseStatusError(&imap.StatusResp{Type: imap.StatusRespBad, Info: test.info}, "UTF-8", sortCrit)
+		var unknownKeyErr *UnknownSortKeyError
+		if test.key == "" {
+			if errors.As(err, &unknownKeyErr) {
+				t.Errorf("Expected no UnknownSortKeyError for %q, got %#v", test.info, err)
+			}
+			continue
+		}
+		if !errors.As(err, &unknownKeyErr) || unknownKeyErr.Key != test.key {
+			t.Errorf("Expected UnknownSortKeyError for %v with %q, got %#v", test.key, test.info, err)
+		}
+		if !errors.Is(err, ErrUnsupportedSortField) {
+			t.Errorf("Expected ErrUnsupportedSortField with %q, got %#v", test.info, err)
+		}
+	}
+}
+
+func TestParseSortCriteriaErrors(t *testing.T) {
+	_, err := parseSortCriteria([]interface{}{"DATE", "COLOR"})
+	var unknownKeyErr *UnknownSortKeyError
+	if !errors.As(err, &unknownKeyErr) || unknownKeyErr.Key != "COLOR" {
+		t.Errorf("Expected UnknownSortKeyError, got %#v", err)
+	}
+
+	_, err = parseSortCriteria([]interface{}{"DATE", "REVERSE"})
+	var missingKeyErr *MissingSortKeyError
+	if !errors.As(err, &missingKeyErr) {
+		t.Errorf("Expected MissingSortKeyError, got %#v", err)
+	}
+}
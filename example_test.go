@@ -67,3 +67,33 @@ func ExampleThreadClient() {
 
 	log.Println(threads)
 }
+
+func ExampleConn() {
+	// Assuming c is an IMAP client with a selected mailbox
+	var c *client.Client
+
+	// Clients of the same connection can be used concurrently
+	conn := sortthread.NewConn(c)
+	sc := conn.SortClient()
+	tc := conn.ThreadClient()
+
+	unread := imap.NewSearchCriteria()
+	unread.WithoutFlags = []string{imap.SeenFlag}
+	done := make(chan error, 1)
+	var ids []uint32
+	go func() {
+		var err error
+		ids, err = sc.UidSort([]sortthread.SortCriterion{{Field: sortthread.SortArrival}}, unread)
+		done <- err
+	}()
+
+	threads, err := tc.UidThread(sortthread.References, imap.NewSearchCriteria())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println(ids, threads)
+}
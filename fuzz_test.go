@@ -0,0 +1,158 @@
+//go:build go1.18
+// +build go1.18
+
+package sortthread
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func newFuzzReader(s string) *imap.Reader {
+	r := imap.NewReader(bufio.NewReader(strings.NewReader(s + "\r\n")))
+	r.MaxLiteralSize = 4096
+	return r
+}
+
+func readFuzzFields(s string) ([]interface{}, bool) {
+	fields, err := newFuzzReader(s).ReadLine()
+	return fields, err == nil
+}
+
+func readFuzzResp(s string) (imap.Resp, bool) {
+	resp, err := imap.ReadResp(newFuzzReader(s))
+	return resp, err == nil
+}
+
+func FuzzParseSortCriteria(f *testing.F) {
+	f.Add("(DATE)")
+	f.Add("(REVERSE SIZE subject)")
+	f.Add("(REVERSE)")
+	f.Add("(ANNOTATION /comment value.priv REVERSE MODSEQ)")
+	f.Add("(ANNOTATION /comment)")
+	f.Add("((DATE) {4}\r\nSIZE)")
+	f.Fuzz(func(t *testing.T, s string) {
+		fields, ok := readFuzzFields(s)
+		if !ok || len(fields) == 0 {
+			return
+		}
+		parseSortCriteria(fields[0])
+	})
+}
+
+func FuzzSortCommandParse(f *testing.F) {
+	f.Add("(DATE) UTF-8 ALL")
+	f.Add("(REVERSE ARRIVAL) US-ASCII OR SUBJECT foo NOT FROM bar")
+	f.Add("(SUBJECT) UTF-8 1:* UNSEEN")
+	// Unknown charsets used to crash when imap.CharsetReader is nil
+	f.Add("(SUBJECT) ISO-8859-1 SUBJECT caf\xe9")
+	f.Add("(DATE) KOI8-R BODY {3}\r\nabc")
+	f.Fuzz(func(t *testing.T, s string) {
+		fields, ok := readFuzzFields(s)
+		if !ok {
+			return
+		}
+		var cmd SortCommand
+		cmd.Parse(fields)
+	})
+}
+
+func FuzzThreadCommandParse(f *testing.F) {
+	f.Add("REFERENCES UTF-8 ALL")
+	f.Add("ORDEREDSUBJECT US-ASCII SINCE 1-Feb-1994")
+	f.Add("REFERENCES ISO-8859-1 TEXT caf\xe9")
+	f.Add("(REFERENCES) UTF-8 ALL")
+	f.Fuzz(func(t *testing.T, s string) {
+		fields, ok := readFuzzFields(s)
+		if !ok {
+			return
+		}
+		var cmd ThreadCommand
+		cmd.Parse(fields)
+	})
+}
+
+func FuzzParseThreadResp(f *testing.F) {
+	for _, test := range threadTests {
+		f.Add(test.str)
+	}
+	f.Add("(1 (2)(3) 4)")
+	f.Add("((((1))))")
+	f.Add("(0 (0))")
+	f.Add("(1 NIL)")
+	f.Fuzz(func(t *testing.T, s string) {
+		fields, ok := readFuzzFields(s)
+		if !ok {
+			return
+		}
+		threads, err := parseThreadResp(fields)
+		if err != nil {
+			return
+		}
+
+		// Formatting the result must not crash either
+		var b bytes.Buffer
+		w := imap.NewWriter(&b)
+		(&ThreadResponse{Threads: threads}).WriteTo(w)
+		w.Flush()
+	})
+}
+
+func FuzzSortResponseHandle(f *testing.F) {
+	f.Add("* SORT 2 3 6")
+	f.Add("* SORT")
+	f.Add("* SORT 4294967296")
+	f.Add("* SORT (1)")
+	f.Add("* THREAD (1)")
+	f.Fuzz(func(t *testing.T, s string) {
+		resp, ok := readFuzzResp(s)
+		if !ok {
+			return
+		}
+		var res SortResponse
+		if err := res.Handle(resp); err != nil {
+			return
+		}
+
+		var b bytes.Buffer
+		w := imap.NewWriter(&b)
+		if err := res.WriteTo(w); err != nil {
+			t.Fatal("Expected no error while writing response but got:", err)
+		}
+		w.Flush()
+
+		resp, ok = readFuzzResp(strings.TrimSuffix(b.String(), "\r\n"))
+		if !ok {
+			t.Fatalf("Cannot read formatted response %q", b.String())
+		}
+		var parsed SortResponse
+		if err := parsed.Handle(resp); err != nil {
+			t.Fatalf("Cannot parse formatted response %q: %v", b.String(), err)
+		}
+		if len(parsed.Ids) != 0 || len(res.Ids) != 0 {
+			if !reflect.DeepEqual(parsed.Ids, res.Ids) {
+				t.Errorf("Invalid round-trip: got %v, expected %v", parsed.Ids, res.Ids)
+			}
+		}
+	})
+}
+
+func FuzzGetBaseSubject(f *testing.F) {
+	for _, test := range baseSubjectTests {
+		f.Add(test.subject)
+	}
+	f.Add("[fwd: [fwd: Re: [blob] (fwd)]]")
+	f.Add("Re: [\x00] \t\\ (fwd) (fwd)")
+	f.Add("=?UTF-8?B?W2Z3ZDogaGVsbG9d?=")
+	f.Add("=?UNKNOWN?Q?foo?=")
+	f.Add("[fwd:]")
+	f.Add("\xff\xfe")
+	f.Fuzz(func(t *testing.T, s string) {
+		GetBaseSubject(s)
+	})
+}
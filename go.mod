@@ -1,9 +1,10 @@
 module github.com/emersion/go-imap-sortthread
 
-go 1.12
+go 1.13
 
 require (
 	github.com/emersion/go-imap v1.0.5
-	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21 // indirect
+	github.com/emersion/go-message v0.11.1
+	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21
 	golang.org/x/text v0.3.3 // indirect
 )
@@ -0,0 +1,138 @@
+package sortthread
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// CommandInfo describes a completed SORT, THREAD or X-MULTISORT command.
+type CommandInfo struct {
+	// The command name.
+	Name string
+	// Whether the command used UIDs.
+	Uid bool
+	// The sort criteria, for SORT and X-MULTISORT.
+	SortCriteria []SortCriterion
+	// The threading algorithm, for THREAD.
+	Algorithm ThreadAlgorithm
+	// A summary of the search criteria. It contains the search keys, but not
+	// their values, which may contain personal data.
+	Search string
+	// The user who issued the command. Empty on the client side.
+	Username string
+
+	Duration time.Duration
+	// The number of messages in the result.
+	Results int
+	Err     error
+}
+
+// Instrumentation is notified when SORT and THREAD commands complete. It can
+// be set in ExtensionOptions on the server side, and on SortClient and
+// ThreadClient on the client side.
+//
+// CommandDone may be called concurrently.
+type Instrumentation interface {
+	CommandDone(info *CommandInfo)
+}
+
+func collectSearchKeys(fields []interface{}, keys map[string]bool) {
+	for _, f := range fields {
+		switch f := f.(type) {
+		case imap.RawString:
+			s := string(f)
+			if s != "" && strings.ToUpper(s) == s && !strings.ContainsAny(s, "\\0123456789") {
+				keys[s] = true
+			}
+		case *imap.SeqSet:
+			keys["SEQSET"] = true
+		case []interface{}:
+			collectSearchKeys(f, keys)
+		}
+	}
+}
+
+// summarizeSearchCriteria returns the sorted list of search keys used by the
+// search criteria.
+func summarizeSearchCriteria(c *imap.SearchCriteria) string {
+	if c == nil {
+		return "ALL"
+	}
+
+	keys := make(map[string]bool)
+	collectSearchKeys(c.Format(), keys)
+	if len(keys) == 0 {
+		return "ALL"
+	}
+
+	l := make([]string, 0, len(keys))
+	for k := range keys {
+		l = append(l, k)
+	}
+	sort.Strings(l)
+	return strings.Join(l, " ")
+}
+
+// formatSortCriteriaString formats sort criteria, e.g. "REVERSE DATE SUBJECT".
+func formatSortCriteriaString(criteria []SortCriterion) string {
+	var l []string
+	for _, c := range criteria {
+		if c.Reverse {
+			l = append(l, "REVERSE")
+		}
+		l = append(l, string(c.Field))
+	}
+	return strings.Join(l, " ")
+}
+
+func reportCommand(instr Instrumentation, info *CommandInfo, start time.Time) {
+	if instr == nil {
+		return
+	}
+	info.Duration = time.Since(start)
+	instr.CommandDone(info)
+}
+
+// MetricsLabelNames contains the names of the labels passed to
+// MetricsInstrumentation callbacks, in order.
+var MetricsLabelNames = []string{"command", "uid", "status"}
+
+// MetricsInstrumentation reports commands as Prometheus-style metrics, without
+// depending on a metrics library. For instance, with Prometheus:
+//
+//	durations := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+//		Name: "imap_sortthread_duration_seconds",
+//	}, sortthread.MetricsLabelNames)
+//	instr := &sortthread.MetricsInstrumentation{
+//		ObserveDuration: func(labels []string, seconds float64) {
+//			durations.WithLabelValues(labels...).Observe(seconds)
+//		},
+//	}
+type MetricsInstrumentation struct {
+	// Called with the command duration, in seconds.
+	ObserveDuration func(labels []string, seconds float64)
+	// Called with the number of messages in the result.
+	ObserveResults func(labels []string, results float64)
+}
+
+func (instr *MetricsInstrumentation) CommandDone(info *CommandInfo) {
+	status := "ok"
+	if info.Err != nil {
+		status = "error"
+	}
+	uid := "false"
+	if info.Uid {
+		uid = "true"
+	}
+	labels := []string{info.Name, uid, status}
+
+	if instr.ObserveDuration != nil {
+		instr.ObserveDuration(labels, info.Duration.Seconds())
+	}
+	if instr.ObserveResults != nil && info.Err == nil {
+		instr.ObserveResults(labels, float64(info.Results))
+	}
+}
@@ -0,0 +1,48 @@
+//go:build go1.21
+// +build go1.21
+
+package sortthread
+
+import (
+	"context"
+	"log/slog"
+)
+
+type slogInstrumentation struct {
+	logger *slog.Logger
+}
+
+// NewSlogInstrumentation creates an instrumentation logging each command with
+// logger. Successful commands are logged at the debug level, failed commands
+// at the warning level.
+func NewSlogInstrumentation(logger *slog.Logger) Instrumentation {
+	return &slogInstrumentation{logger: logger}
+}
+
+func (instr *slogInstrumentation) CommandDone(info *CommandInfo) {
+	attrs := []slog.Attr{
+		slog.String("command", info.Name),
+		slog.Bool("uid", info.Uid),
+		slog.String("search", info.Search),
+		slog.Duration("duration", info.Duration),
+		slog.Int("results", info.Results),
+	}
+	if info.SortCriteria != nil {
+		attrs = append(attrs, slog.String("criteria", formatSortCriteriaString(info.SortCriteria)))
+	}
+	if info.Algorithm != "" {
+		attrs = append(attrs, slog.String("algorithm", string(info.Algorithm)))
+	}
+	if info.Username != "" {
+		attrs = append(attrs, slog.String("username", info.Username))
+	}
+
+	level := slog.LevelDebug
+	msg := "IMAP command completed"
+	if info.Err != nil {
+		level = slog.LevelWarn
+		msg = "IMAP command failed"
+		attrs = append(attrs, slog.String("error", info.Err.Error()))
+	}
+	instr.logger.LogAttrs(context.Background(), level, msg, attrs...)
+}
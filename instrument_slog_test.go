@@ -0,0 +1,49 @@
+//go:build go1.21
+// +build go1.21
+
+package sortthread
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestSlogInstrumentation(t *testing.T) {
+	var b bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&b, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+	instr := NewSlogInstrumentation(logger)
+
+	instr.CommandDone(&CommandInfo{
+		Name:         "SORT",
+		Uid:          true,
+		SortCriteria: []SortCriterion{{Field: SortDate, Reverse: true}, {Field: SortSubject}},
+		Search:       "UNSEEN",
+		Username:     "username",
+		Duration:     2 * time.Millisecond,
+		Results:      3,
+	})
+	instr.CommandDone(&CommandInfo{
+		Name:      "THREAD",
+		Algorithm: References,
+		Search:    "ALL",
+		Err:       errors.New("disk on fire"),
+	})
+
+	expected := `level=DEBUG msg="IMAP command completed" command=SORT uid=true search=UNSEEN duration=2ms results=3 criteria="REVERSE DATE SUBJECT" username=username
+level=WARN msg="IMAP command failed" command=THREAD uid=false search=ALL duration=0s results=0 algorithm=REFERENCES error="disk on fire"
+`
+	if s := b.String(); s != expected {
+		t.Errorf("Invalid log output: got %v, expected %v", s, expected)
+	}
+}
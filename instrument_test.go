@@ -0,0 +1,136 @@
+package sortthread
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+)
+
+func TestSummarizeSearchCriteria(t *testing.T) {
+	if s := summarizeSearchCriteria(nil); s != "ALL" {
+		t.Errorf("Invalid summary of nil search criteria: got %v, expected ALL", s)
+	}
+
+	c := imap.NewSearchCriteria()
+	c.Header.Add("Subject", "secret plans")
+	c.Body = []string{"password"}
+	c.WithoutFlags = []string{imap.SeenFlag}
+	c.Since = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.Or = [][2]*imap.SearchCriteria{{
+		{Larger: 1024},
+		{Text: []string{"hunter2"}},
+	}}
+
+	expected := "BODY LARGER OR SINCE SUBJECT TEXT UNSEEN"
+	if s := summarizeSearchCriteria(c); s != expected {
+		t.Errorf("Invalid search criteria summary: got %v, expected %v", s, expected)
+	}
+}
+
+func TestMetricsInstrumentation(t *testing.T) {
+	var durations, results [][]string
+	instr := &MetricsInstrumentation{
+		ObserveDuration: func(labels []string, seconds float64) {
+			durations = append(durations, labels)
+		},
+		ObserveResults: func(labels []string, n float64) {
+			if n != 3 {
+				t.Errorf("Invalid number of results: got %v, expected 3", n)
+			}
+			results = append(results, labels)
+		},
+	}
+
+	instr.CommandDone(&CommandInfo{Name: "SORT", Uid: true, Results: 3})
+	instr.CommandDone(&CommandInfo{Name: "THREAD", Err: errors.New("NO")})
+
+	expectedDurations := [][]string{{"SORT", "true", "ok"}, {"THREAD", "false", "error"}}
+	if !reflect.DeepEqual(durations, expectedDurations) {
+		t.Errorf("Invalid duration labels: got %v, expected %v", durations, expectedDurations)
+	}
+	expectedResults := [][]string{{"SORT", "true", "ok"}}
+	if !reflect.DeepEqual(results, expectedResults) {
+		t.Errorf("Invalid results labels: got %v, expected %v", results, expectedResults)
+	}
+}
+
+type testInstrumentation struct {
+	mu    sync.Mutex
+	infos []*CommandInfo
+}
+
+func (instr *testInstrumentation) CommandDone(info *CommandInfo) {
+	instr.mu.Lock()
+	defer instr.mu.Unlock()
+	instr.infos = append(instr.infos, info)
+}
+
+func (instr *testInstrumentation) reset() []*CommandInfo {
+	instr.mu.Lock()
+	defer instr.mu.Unlock()
+	infos := instr.infos
+	instr.infos = nil
+	return infos
+}
+
+func TestInstrumentation(t *testing.T) {
+	serverInstr := new(testInstrumentation)
+	options := &ExtensionOptions{Instrumentation: serverInstr}
+	be := &testBackend{Backend: memory.New(), sort: true}
+	c, close := newTestServer(t, be, NewSortExtensionWithOptions(options), NewThreadExtensionWithOptions(options))
+	defer close()
+
+	clientInstr := new(testInstrumentation)
+	sc := NewSortClient(c)
+	sc.Instrumentation = clientInstr
+	tc := NewThreadClient(c)
+
+	searchCrit := imap.NewSearchCriteria()
+	searchCrit.WithoutFlags = []string{imap.SeenFlag}
+	if _, err := sc.UidSort(testSortCriteria(2), searchCrit); err != nil {
+		t.Fatal("Expected no error while sorting but got:", err)
+	}
+	if _, err := tc.Thread(References, imap.NewSearchCriteria()); err != nil {
+		t.Fatal("Expected no error while threading but got:", err)
+	}
+	be.err = errors.New("disk on fire")
+	if _, err := sc.Sort(testSortCriteria(1), imap.NewSearchCriteria()); err == nil {
+		t.Fatal("Expected an error while sorting")
+	}
+
+	expected := []*CommandInfo{
+		{Name: "SORT", Uid: true, SortCriteria: testSortCriteria(2), Search: "UNSEEN", Username: "username", Results: 1},
+		{Name: "THREAD", Algorithm: References, Search: "ALL", Username: "username", Results: 1},
+		{Name: "SORT", SortCriteria: testSortCriteria(1), Search: "ALL", Username: "username"},
+	}
+	checkInstrumentation(t, "server", serverInstr.reset(), expected)
+
+	for _, info := range expected {
+		info.Username = ""
+	}
+	checkInstrumentation(t, "client", clientInstr.reset(), []*CommandInfo{expected[0], expected[2]})
+}
+
+func checkInstrumentation(t *testing.T, side string, infos, expected []*CommandInfo) {
+	if len(infos) != len(expected) {
+		t.Fatalf("Invalid number of %v commands: got %v, expected %v", side, len(infos), len(expected))
+	}
+	for i, info := range infos {
+		if (info.Err != nil) != (i == len(expected)-1) {
+			t.Errorf("Invalid error for %v command #%v: got %v", side, i, info.Err)
+		}
+		if info.Duration <= 0 {
+			t.Errorf("Invalid duration for %v command #%v: got %v", side, i, info.Duration)
+		}
+		got := *info
+		got.Err, got.Duration = nil, 0
+		if !reflect.DeepEqual(&got, expected[i]) {
+			t.Errorf("Invalid %v command #%v: got %+v, expected %+v", side, i, got, expected[i])
+		}
+	}
+}
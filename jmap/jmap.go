@@ -0,0 +1,207 @@
+// Package jmap converts SORT criteria and THREAD results to their JMAP
+// equivalents, defined in RFC 8621, so that IMAP and JMAP front-ends can share
+// the same sorting and threading.
+package jmap
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-imap-sortthread"
+)
+
+// Comparator is a JMAP Email/query sort comparator.
+type Comparator struct {
+	Property    string `json:"property"`
+	IsAscending bool   `json:"isAscending"`
+	Collation   string `json:"collation,omitempty"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler. IsAscending defaults to true, as
+// required by RFC 8620 section 5.5.
+func (c *Comparator) UnmarshalJSON(b []byte) error {
+	type comparator Comparator
+	raw := comparator{IsAscending: true}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	*c = Comparator(raw)
+	return nil
+}
+
+// Email properties which can be used to sort, with their IMAP equivalent.
+var sortProperties = map[sortthread.SortField]string{
+	sortthread.SortArrival: "receivedAt",
+	sortthread.SortDate:    "sentAt",
+	sortthread.SortFrom:    "from",
+	sortthread.SortTo:      "to",
+	sortthread.SortSubject: "subject",
+	sortthread.SortSize:    "size",
+}
+
+// ComparatorsFromSortCriteria converts SORT criteria to JMAP comparators.
+// Criteria without a JMAP equivalent, e.g. CC, are skipped and returned in
+// unsupported.
+func ComparatorsFromSortCriteria(criteria []sortthread.SortCriterion) (comparators []Comparator, unsupported []sortthread.SortCriterion) {
+	for _, c := range criteria {
+		prop, ok := sortProperties[c.Field]
+		if !ok {
+			unsupported = append(unsupported, c)
+			continue
+		}
+		comparators = append(comparators, Comparator{
+			Property:    prop,
+			IsAscending: !c.Reverse,
+		})
+	}
+	return comparators, unsupported
+}
+
+// SortCriteriaFromComparators converts JMAP comparators to SORT criteria.
+// Comparators without an IMAP equivalent, e.g. hasKeyword, are skipped and
+// returned in unsupported.
+func SortCriteriaFromComparators(comparators []Comparator) (criteria []sortthread.SortCriterion, unsupported []Comparator) {
+	for _, c := range comparators {
+		var field sortthread.SortField
+		for f, prop := range sortProperties {
+			if prop == c.Property {
+				field = f
+				break
+			}
+		}
+		if field == "" {
+			unsupported = append(unsupported, c)
+			continue
+		}
+		criteria = append(criteria, sortthread.SortCriterion{
+			Field:   field,
+			Reverse: !c.IsAscending,
+		})
+	}
+	return criteria, unsupported
+}
+
+// Thread is a JMAP Thread object.
+type Thread struct {
+	Id       string   `json:"id"`
+	EmailIds []string `json:"emailIds"`
+}
+
+// ThreadOptions contains options for NewThreads and ThreadIds.
+type ThreadOptions struct {
+	// ThreadId returns the JMAP thread ID of a message. Messages with the
+	// same thread ID belong to the same JMAP thread.
+	//
+	// By default, the thread ID of all messages in a THREAD result thread is
+	// derived from the lowest message ID in the thread. Such IDs aren't stable
+	// when threads are merged. If stable IDs are needed, populate a
+	// sortthread.ThreadIdAssigner with Assign, and use its ThreadId method,
+	// which also reports whether the message has been assigned an ID:
+	//
+	//	ThreadId: func(id uint32) string {
+	//		threadId, _ := assigner.ThreadId(id)
+	//		return threadId
+	//	},
+	ThreadId func(id uint32) string
+	// EmailId returns the JMAP email ID of a message. Defaults to the message
+	// ID prefixed with "M".
+	EmailId func(id uint32) string
+	// ReceivedAt returns the receivedAt date of a message, used to order
+	// emailIds. By default, messages are ordered by ID, which matches arrival
+	// order for UIDs.
+	ReceivedAt func(id uint32) time.Time
+}
+
+func walkThreads(threads []*sortthread.Thread, f func(id uint32)) {
+	for _, t := range threads {
+		if t.Id != 0 {
+			f(t.Id)
+		}
+		walkThreads(t.Children, f)
+	}
+}
+
+func defaultEmailId(id uint32) string {
+	return "M" + strconv.FormatUint(uint64(id), 10)
+}
+
+func (options *ThreadOptions) threadIds(threads []*sortthread.Thread) map[uint32]string {
+	ids := make(map[uint32]string)
+	for _, t := range threads {
+		var min uint32
+		walkThreads([]*sortthread.Thread{t}, func(id uint32) {
+			if min == 0 || id < min {
+				min = id
+			}
+		})
+		defaultId := "T" + strconv.FormatUint(uint64(min), 10)
+
+		walkThreads([]*sortthread.Thread{t}, func(id uint32) {
+			if options.ThreadId != nil {
+				ids[id] = options.ThreadId(id)
+			} else {
+				ids[id] = defaultId
+			}
+		})
+	}
+	return ids
+}
+
+// ThreadIds returns the JMAP thread ID of each message in a THREAD result, as
+// used by the threadId Email property. If options is nil, default options are
+// used.
+func ThreadIds(threads []*sortthread.Thread, options *ThreadOptions) map[uint32]string {
+	if options == nil {
+		options = new(ThreadOptions)
+	}
+	return options.threadIds(threads)
+}
+
+// NewThreads converts a THREAD result to JMAP Thread objects, as returned by
+// Thread/get. Threads are returned in the order of the THREAD result. Email IDs
+// are sorted by receivedAt date, oldest first, as required by RFC 8621
+// section 3. If options is nil, default options are used.
+func NewThreads(threads []*sortthread.Thread, options *ThreadOptions) []*Thread {
+	if options == nil {
+		options = new(ThreadOptions)
+	}
+	threadIds := options.threadIds(threads)
+
+	var result []*Thread
+	byId := make(map[string]*Thread)
+	members := make(map[string][]uint32)
+	walkThreads(threads, func(id uint32) {
+		threadId := threadIds[id]
+		if _, ok := byId[threadId]; !ok {
+			t := &Thread{Id: threadId}
+			byId[threadId] = t
+			result = append(result, t)
+		}
+		members[threadId] = append(members[threadId], id)
+	})
+
+	emailId := options.EmailId
+	if emailId == nil {
+		emailId = defaultEmailId
+	}
+	for _, t := range result {
+		ids := members[t.Id]
+		sort.SliceStable(ids, func(i, j int) bool {
+			if options.ReceivedAt != nil {
+				a, b := options.ReceivedAt(ids[i]), options.ReceivedAt(ids[j])
+				if !a.Equal(b) {
+					return a.Before(b)
+				}
+			}
+			return ids[i] < ids[j]
+		})
+
+		t.EmailIds = make([]string, len(ids))
+		for i, id := range ids {
+			t.EmailIds[i] = emailId(id)
+		}
+	}
+	return result
+}
@@ -0,0 +1,113 @@
+package jmap
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap-sortthread"
+)
+
+func TestComparatorsFromSortCriteria(t *testing.T) {
+	criteria := []sortthread.SortCriterion{
+		{Field: sortthread.SortDate, Reverse: true},
+		{Field: sortthread.SortCc},
+		{Field: sortthread.SortSubject},
+	}
+
+	comparators, unsupported := ComparatorsFromSortCriteria(criteria)
+	expected := []Comparator{
+		{Property: "sentAt", IsAscending: false},
+		{Property: "subject", IsAscending: true},
+	}
+	if !reflect.DeepEqual(comparators, expected) {
+		t.Errorf("Invalid comparators: got %v, expected %v", comparators, expected)
+	}
+	if !reflect.DeepEqual(unsupported, criteria[1:2]) {
+		t.Errorf("Invalid unsupported criteria: got %v, expected %v", unsupported, criteria[1:2])
+	}
+}
+
+func TestSortCriteriaFromComparators(t *testing.T) {
+	var comparators []Comparator
+	s := `[
+		{"property": "receivedAt", "isAscending": false},
+		{"property": "hasKeyword", "keyword": "$flagged"},
+		{"property": "size"}
+	]`
+	if err := json.Unmarshal([]byte(s), &comparators); err != nil {
+		t.Fatal("Expected no error while decoding comparators but got:", err)
+	}
+
+	criteria, unsupported := SortCriteriaFromComparators(comparators)
+	expected := []sortthread.SortCriterion{
+		{Field: sortthread.SortArrival, Reverse: true},
+		{Field: sortthread.SortSize},
+	}
+	if !reflect.DeepEqual(criteria, expected) {
+		t.Errorf("Invalid sort criteria: got %v, expected %v", criteria, expected)
+	}
+	if len(unsupported) != 1 || unsupported[0].Property != "hasKeyword" {
+		t.Errorf("Invalid unsupported comparators: got %v", unsupported)
+	}
+}
+
+// (4 (2 3)(1))((6)(5))
+var testThreads = []*sortthread.Thread{
+	{Id: 4, Children: []*sortthread.Thread{
+		{Id: 2, Children: []*sortthread.Thread{{Id: 3}}},
+		{Id: 1},
+	}},
+	{Children: []*sortthread.Thread{{Id: 6}, {Id: 5}}},
+}
+
+func TestNewThreads(t *testing.T) {
+	threads := NewThreads(testThreads, nil)
+	expected := []*Thread{
+		{Id: "T1", EmailIds: []string{"M1", "M2", "M3", "M4"}},
+		{Id: "T5", EmailIds: []string{"M5", "M6"}},
+	}
+	if !reflect.DeepEqual(threads, expected) {
+		t.Errorf("Invalid threads: got %+v, expected %+v", threads, expected)
+	}
+
+	ids := ThreadIds(testThreads, nil)
+	if ids[3] != "T1" || ids[6] != "T5" {
+		t.Errorf("Invalid thread IDs: got %v", ids)
+	}
+}
+
+func TestNewThreadsOptions(t *testing.T) {
+	// Message 4 was merged into the thread of message 2 after being assigned
+	// its own ID
+	assigner := sortthread.NewThreadIdAssigner(1, map[uint32]string{4: "A", 2: "B"})
+	assigner.Assign(testThreads)
+
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	threads := NewThreads(testThreads, &ThreadOptions{
+		ThreadId: func(id uint32) string {
+			threadId, _ := assigner.ThreadId(id)
+			return threadId
+		},
+		EmailId: func(id uint32) string {
+			return string(rune('a' + id - 1))
+		},
+		ReceivedAt: func(id uint32) time.Time {
+			// Reverse of ID order
+			return base.Add(-time.Duration(id) * time.Hour)
+		},
+	})
+
+	if len(threads) != 3 {
+		t.Fatalf("Expected 3 threads, got %v", len(threads))
+	}
+	expected := []string{"d", "a"}
+	if threads[0].Id != "A" || !reflect.DeepEqual(threads[0].EmailIds, expected) {
+		t.Errorf("Invalid first thread: got %+v, expected emails %v", threads[0], expected)
+	}
+	expected = []string{"c", "b"}
+	if threads[1].Id != "B" || !reflect.DeepEqual(threads[1].EmailIds, expected) {
+		t.Errorf("Invalid second thread: got %+v, expected emails %v", threads[1], expected)
+	}
+}
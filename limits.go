@@ -0,0 +1,133 @@
+package sortthread
+
+import (
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// CodeLimit is the LIMIT response code, defined in RFC 5530.
+const CodeLimit imap.StatusRespCode = "LIMIT"
+
+// searchCriteriaDepth returns the nesting depth of NOT and OR search keys.
+func searchCriteriaDepth(c *imap.SearchCriteria) int {
+	if c == nil {
+		return 0
+	}
+	max := 0
+	for _, not := range c.Not {
+		if d := searchCriteriaDepth(not); d > max {
+			max = d
+		}
+	}
+	for _, or := range c.Or {
+		for _, sub := range or {
+			if d := searchCriteriaDepth(sub); d > max {
+				max = d
+			}
+		}
+	}
+	if len(c.Not) > 0 || len(c.Or) > 0 {
+		max++
+	}
+	return max
+}
+
+func countThreads(threads []*Thread) int {
+	n := 0
+	for _, t := range threads {
+		walkThread(t, func(t *Thread) {
+			if t.Id != 0 {
+				n++
+			}
+		})
+	}
+	return n
+}
+
+func (options *ExtensionOptions) acquire(username string) bool {
+	if options.MaxConcurrent <= 0 {
+		return true
+	}
+
+	options.mu.Lock()
+	defer options.mu.Unlock()
+	if options.running == nil {
+		options.running = make(map[string]int)
+	}
+	if options.running[username] >= options.MaxConcurrent {
+		return false
+	}
+	options.running[username]++
+	return true
+}
+
+func (options *ExtensionOptions) release(username string) {
+	if options.MaxConcurrent <= 0 {
+		return
+	}
+
+	options.mu.Lock()
+	defer options.mu.Unlock()
+	options.running[username]--
+	if options.running[username] <= 0 {
+		delete(options.running, username)
+	}
+}
+
+// limitedResult is the result of a command run with limits.
+type limitedResult struct {
+	v   interface{}
+	n   int
+	err error
+}
+
+// run runs a SORT or THREAD command with the limits in options. f returns the
+// result and the number of messages in it. run returns the result of f.
+//
+// On timeout, f keeps running in the background since backends can't be
+// cancelled, and its result is discarded. f must not share state with the
+// caller besides its return values.
+func (options *ExtensionOptions) run(username string, searchCrit *imap.SearchCriteria, f func() (interface{}, int, error)) (interface{}, int, error) {
+	if options == nil {
+		return f()
+	}
+
+	if options.MaxSearchDepth > 0 && searchCriteriaDepth(searchCrit) > options.MaxSearchDepth {
+		return nil, 0, &LimitError{Info: "Search criteria too complex"}
+	}
+
+	if !options.acquire(username) {
+		return nil, 0, &LimitError{Info: "Too many concurrent commands"}
+	}
+
+	done := make(chan limitedResult, 1)
+	go func() {
+		defer options.release(username)
+		v, n, err := f()
+		done <- limitedResult{v, n, err}
+	}()
+
+	var res limitedResult
+	if options.Timeout > 0 {
+		timer := time.NewTimer(options.Timeout)
+		defer timer.Stop()
+		select {
+		case res = <-done:
+		case <-timer.C:
+			// The backend keeps running in the background, and still counts
+			// towards MaxConcurrent until it returns
+			return nil, 0, &LimitError{Info: "Command took too long"}
+		}
+	} else {
+		res = <-done
+	}
+
+	if res.err != nil {
+		return nil, 0, res.err
+	}
+	if options.MaxResults > 0 && res.n > options.MaxResults {
+		return nil, res.n, &LimitError{Info: "Too many results"}
+	}
+	return res.v, res.n, nil
+}
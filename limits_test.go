@@ -0,0 +1,95 @@
+package sortthread
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+)
+
+func isLimitError(err error) bool {
+	var limitErr *LimitError
+	return errors.As(err, &limitErr)
+}
+
+func TestSearchCriteriaDepth(t *testing.T) {
+	c := imap.NewSearchCriteria()
+	if d := searchCriteriaDepth(c); d != 0 {
+		t.Errorf("Got depth %v, expected 0", d)
+	}
+
+	not := imap.NewSearchCriteria()
+	not.Or = [][2]*imap.SearchCriteria{{imap.NewSearchCriteria(), imap.NewSearchCriteria()}}
+	c.Not = []*imap.SearchCriteria{not}
+	if d := searchCriteriaDepth(c); d != 2 {
+		t.Errorf("Got depth %v, expected 2", d)
+	}
+}
+
+func TestExtensionOptionsRun(t *testing.T) {
+	not := imap.NewSearchCriteria()
+	not.Not = []*imap.SearchCriteria{imap.NewSearchCriteria()}
+	options := &ExtensionOptions{MaxSearchDepth: 1, MaxResults: 2}
+
+	if v, n, err := options.run("user", not, func() (interface{}, int, error) { return "result", 2, nil }); err != nil {
+		t.Errorf("Expected no error but got: %v", err)
+	} else if v != "result" || n != 2 {
+		t.Errorf("Got result %v with %v messages, expected result with 2", v, n)
+	}
+	nested := imap.NewSearchCriteria()
+	nested.Not = []*imap.SearchCriteria{not}
+	if _, _, err := options.run("user", nested, func() (interface{}, int, error) { return nil, 0, nil }); !isLimitError(err) {
+		t.Errorf("Expected a LIMIT error for nested criteria but got: %v", err)
+	}
+	if _, _, err := options.run("user", nil, func() (interface{}, int, error) { return nil, 3, nil }); !isLimitError(err) {
+		t.Errorf("Expected a LIMIT error for too many results but got: %v", err)
+	}
+
+	options = &ExtensionOptions{Timeout: 10 * time.Millisecond, MaxConcurrent: 1}
+	unblock := make(chan struct{})
+	_, _, err := options.run("user", nil, func() (interface{}, int, error) {
+		<-unblock
+		return nil, 0, nil
+	})
+	if !isLimitError(err) {
+		t.Errorf("Expected a LIMIT error for timeout but got: %v", err)
+	}
+	// The timed out command is still running
+	if _, _, err := options.run("user", nil, func() (interface{}, int, error) { return nil, 0, nil }); !isLimitError(err) {
+		t.Errorf("Expected a LIMIT error for concurrent commands but got: %v", err)
+	}
+	if _, _, err := options.run("other", nil, func() (interface{}, int, error) { return nil, 0, nil }); err != nil {
+		t.Errorf("Expected no error for another user but got: %v", err)
+	}
+	close(unblock)
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	be := &testBackend{Backend: memory.New(), sort: true, block: make(chan struct{})}
+	options := &ExtensionOptions{Timeout: 10 * time.Millisecond}
+	c, stop := newTestServer(t, be, NewSortExtensionWithOptions(options), NewThreadExtensionWithOptions(options))
+	defer stop()
+
+	conn := NewConn(c)
+	sortCrit := []SortCriterion{{Field: SortDate}}
+	if _, err := conn.SortClient().UidSort(sortCrit, imap.NewSearchCriteria()); !isLimitError(err) {
+		t.Errorf("Expected a LIMIT error for SORT but got: %v", err)
+	}
+	if _, err := conn.ThreadClient().UidThread(References, imap.NewSearchCriteria()); !isLimitError(err) {
+		t.Errorf("Expected a LIMIT error for THREAD but got: %v", err)
+	}
+
+	// The abandoned commands complete in the background
+	close(be.block)
+
+	uids, err := conn.SortClient().UidSort(sortCrit, imap.NewSearchCriteria())
+	if err != nil {
+		t.Fatal("Expected no error while sorting but got:", err)
+	}
+	if !reflect.DeepEqual(uids, []uint32{1}) {
+		t.Errorf("Got UIDs %v, expected [1]", uids)
+	}
+}
@@ -0,0 +1,216 @@
+// Package msgid parses the Message-ID, In-Reply-To and References header
+// fields, as needed by the REFERENCES and REFS threading algorithms.
+//
+// Real-world header fields often don't follow RFC 5322: IDs lack angle
+// brackets, contain folding whitespace, are surrounded by prose or comments,
+// or are truncated. This package is lenient and extracts as many message IDs
+// as it can.
+//
+// Message IDs are returned without angle brackets, comments and whitespace,
+// with quoted local parts unquoted. They should be compared with a
+// case-sensitive octet comparison, as required by RFC 5256 section 3.
+package msgid
+
+import (
+	"strings"
+)
+
+// scanner splits a header field into message IDs.
+type scanner struct {
+	s string
+	i int
+
+	// IDs enclosed in angle brackets
+	ids []string
+	// Whitespace-separated words outside of angle brackets, used when there
+	// are no IDs in angle brackets
+	words []string
+}
+
+func (sc *scanner) next() byte {
+	b := sc.s[sc.i]
+	sc.i++
+	return b
+}
+
+// skipComment skips a comment, possibly nested. The opening parenthesis has
+// already been consumed.
+func (sc *scanner) skipComment() {
+	depth := 1
+	for sc.i < len(sc.s) && depth > 0 {
+		switch sc.next() {
+		case '\\':
+			if sc.i < len(sc.s) {
+				sc.i++
+			}
+		case '(':
+			depth++
+		case ')':
+			depth--
+		}
+	}
+}
+
+// quoted reads the contents of a quoted string. The opening quote has already
+// been consumed.
+func (sc *scanner) quoted() string {
+	var sb strings.Builder
+	for sc.i < len(sc.s) {
+		switch b := sc.next(); b {
+		case '\\':
+			if sc.i < len(sc.s) {
+				sb.WriteByte(sc.next())
+			}
+		case '"':
+			return sb.String()
+		case '\r', '\n':
+			// Folding whitespace
+		default:
+			sb.WriteByte(b)
+		}
+	}
+	return sb.String()
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r' || b == '\n'
+}
+
+func (sc *scanner) scan() {
+	var word strings.Builder
+	endWord := func() {
+		if word.Len() > 0 {
+			sc.words = append(sc.words, word.String())
+			word.Reset()
+		}
+	}
+
+	var id strings.Builder
+	inId := false
+	for sc.i < len(sc.s) {
+		b := sc.next()
+		switch {
+		case b == '(':
+			if !inId {
+				endWord()
+			}
+			sc.skipComment()
+		case b == '"':
+			if inId {
+				id.WriteString(sc.quoted())
+			} else {
+				// Prose, e.g. `Your message of "Mon, 6 Jan 2020"`
+				endWord()
+				sc.quoted()
+			}
+		case b == '<':
+			// A nested or unterminated ID is discarded
+			endWord()
+			id.Reset()
+			inId = true
+		case b == '>':
+			if inId {
+				if id.Len() > 0 {
+					sc.ids = append(sc.ids, id.String())
+				}
+				id.Reset()
+				inId = false
+			} else {
+				// The end of a truncated ID, e.g. "ple.org> <b@example.org>"
+				word.Reset()
+			}
+		case isSpace(b):
+			if !inId {
+				endWord()
+			}
+		case b == ',' || b == ';':
+			if !inId {
+				endWord()
+			} else {
+				id.WriteByte(b)
+			}
+		default:
+			if inId {
+				id.WriteByte(b)
+			} else {
+				word.WriteByte(b)
+			}
+		}
+	}
+	endWord()
+	// An ID still open at the end of the field has been truncated
+}
+
+// isBareId checks whether a word outside of angle brackets looks like a
+// message ID.
+func isBareId(word string) bool {
+	at := strings.IndexByte(word, '@')
+	return at > 0 && at < len(word)-1 && strings.Count(word, "@") == 1
+}
+
+// ParseList parses a References or In-Reply-To header field. Duplicate IDs
+// are removed, keeping the first occurrence.
+//
+// IDs enclosed in angle brackets are preferred. If there are none, words which
+// look like message IDs (i.e. containing a single "@") are used.
+func ParseList(s string) []string {
+	sc := scanner{s: s}
+	sc.scan()
+
+	ids := sc.ids
+	if len(ids) == 0 {
+		for _, word := range sc.words {
+			word = strings.TrimRight(word, ".:")
+			if isBareId(word) {
+				ids = append(ids, word)
+			}
+		}
+	}
+
+	var unique []string
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+// Parse parses a Message-ID header field. It returns an empty string if the
+// field doesn't contain a message ID.
+func Parse(s string) string {
+	if ids := ParseList(s); len(ids) > 0 {
+		return ids[0]
+	}
+	return ""
+}
+
+// References returns the references of a message, as defined in RFC 5256
+// section 3 step 1: the IDs in the References header field or, if there are
+// none, the first ID in the In-Reply-To header field. References to the
+// message itself are removed.
+func References(messageId, inReplyTo, references string) []string {
+	self := Parse(messageId)
+	removeSelf := func(ids []string) []string {
+		if self == "" {
+			return ids
+		}
+		filtered := ids[:0]
+		for _, id := range ids {
+			if id != self {
+				filtered = append(filtered, id)
+			}
+		}
+		return filtered
+	}
+
+	if refs := removeSelf(ParseList(references)); len(refs) > 0 {
+		return refs
+	}
+	if refs := removeSelf(ParseList(inReplyTo)); len(refs) > 0 {
+		return refs[:1]
+	}
+	return nil
+}
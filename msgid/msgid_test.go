@@ -0,0 +1,266 @@
+package msgid
+
+import (
+	"reflect"
+	"testing"
+)
+
+var parseListTests = []struct {
+	name     string
+	field    string
+	expected []string
+}{
+	{
+		name:     "empty",
+		field:    "",
+		expected: nil,
+	},
+	{
+		name:     "single",
+		field:    "<1234@local.machine.example>",
+		expected: []string{"1234@local.machine.example"},
+	},
+	{
+		name:     "list",
+		field:    "<1234@local.machine.example> <3456@example.net>",
+		expected: []string{"1234@local.machine.example", "3456@example.net"},
+	},
+	{
+		name:     "no_whitespace",
+		field:    "<a@example.org><b@example.org>",
+		expected: []string{"a@example.org", "b@example.org"},
+	},
+	{
+		name:     "comma_separated",
+		field:    "<a@example.org>, <b@example.org>",
+		expected: []string{"a@example.org", "b@example.org"},
+	},
+	{
+		name:     "folded",
+		field:    "<a@example.org>\r\n\t<b@example.org>\r\n <c@example.org>",
+		expected: []string{"a@example.org", "b@example.org", "c@example.org"},
+	},
+	{
+		name:     "folded_inside_id",
+		field:    "<CAHk-=wj1234@mail.\r\n gmail.com>",
+		expected: []string{"CAHk-=wj1234@mail.gmail.com"},
+	},
+	{
+		name:     "whitespace_inside_id",
+		field:    "< a@example.org >",
+		expected: []string{"a@example.org"},
+	},
+	{
+		name:     "whitespace_around_at",
+		field:    "<a @ example.org>",
+		expected: []string{"a@example.org"},
+	},
+	{
+		name:     "comment",
+		field:    "<a@example.org> (Alice's message)",
+		expected: []string{"a@example.org"},
+	},
+	{
+		name:     "comment_with_id",
+		field:    "(was <old@example.org>) <a@example.org>",
+		expected: []string{"a@example.org"},
+	},
+	{
+		name:     "nested_comment",
+		field:    "(outer (inner <x@example.org>) still <y@example.org>) <a@example.org>",
+		expected: []string{"a@example.org"},
+	},
+	{
+		name:     "escaped_comment",
+		field:    `(a \) <x@example.org>) <a@example.org>`,
+		expected: []string{"a@example.org"},
+	},
+	{
+		name:     "comment_inside_id",
+		field:    "<a(comment)@example.org>",
+		expected: []string{"a@example.org"},
+	},
+	{
+		name:     "quoted_local_part",
+		field:    `<"a.b"@example.org>`,
+		expected: []string{"a.b@example.org"},
+	},
+	{
+		name:     "quoted_local_part_escape",
+		field:    `<"a\"b"@example.org>`,
+		expected: []string{`a"b@example.org`},
+	},
+	{
+		name:     "duplicates",
+		field:    "<a@example.org> <b@example.org> <a@example.org> <b@example.org>",
+		expected: []string{"a@example.org", "b@example.org"},
+	},
+	{
+		name:     "empty_id",
+		field:    "<> <a@example.org>",
+		expected: []string{"a@example.org"},
+	},
+	{
+		name:     "no_at",
+		field:    "<12345.67890>",
+		expected: []string{"12345.67890"},
+	},
+	{
+		name:     "truncated_end",
+		field:    "<a@example.org> <b@example.org> <c@exam",
+		expected: []string{"a@example.org", "b@example.org"},
+	},
+	{
+		name:     "truncated_start",
+		field:    "ple.org> <b@example.org>",
+		expected: []string{"b@example.org"},
+	},
+	{
+		name:     "truncated_only",
+		field:    "<c@exam",
+		expected: nil,
+	},
+	{
+		name:     "nested_brackets",
+		field:    "<<a@example.org>>",
+		expected: []string{"a@example.org"},
+	},
+	{
+		name:     "unterminated_then_valid",
+		field:    "<broken <a@example.org>",
+		expected: []string{"a@example.org"},
+	},
+	{
+		name:     "no_brackets",
+		field:    "a@example.org",
+		expected: []string{"a@example.org"},
+	},
+	{
+		name:     "no_brackets_list",
+		field:    "a@example.org b@example.org, c@example.org",
+		expected: []string{"a@example.org", "b@example.org", "c@example.org"},
+	},
+	{
+		name:     "no_brackets_prose",
+		field:    "Message of Mon, 6 Jan 2020 from a@example.org.",
+		expected: []string{"a@example.org"},
+	},
+	{
+		name:     "prose_outlook",
+		field:    `Your message of "Mon, 06 Jan 2020 10:00:00 +0100." <a@example.org>`,
+		expected: []string{"a@example.org"},
+	},
+	{
+		name:     "prose_quoted_brackets",
+		field:    `"<x@example.org>" <a@example.org>`,
+		expected: []string{"a@example.org"},
+	},
+	{
+		name:     "prose_pine",
+		field:    "<Pine.LNX.4.44.0201061000.1234-100000@example.org> from Alice at Jan 6, 2020 10:00 am",
+		expected: []string{"Pine.LNX.4.44.0201061000.1234-100000@example.org"},
+	},
+	{
+		name:     "prose_mutt",
+		field:    "<a@example.org> (alice@example.org's message of \"Mon, 6 Jan 2020\")",
+		expected: []string{"a@example.org"},
+	},
+	{
+		name:     "bracketed_preferred_over_bare",
+		field:    "alice@example.org's message <a@example.org>",
+		expected: []string{"a@example.org"},
+	},
+	{
+		name:     "bare_garbage",
+		field:    "@ a@ @b a@@b foo",
+		expected: nil,
+	},
+	{
+		name:     "semicolon",
+		field:    "<a@example.org>; <b@example.org>",
+		expected: []string{"a@example.org", "b@example.org"},
+	},
+}
+
+func TestParseList(t *testing.T) {
+	for _, test := range parseListTests {
+		t.Run(test.name, func(t *testing.T) {
+			ids := ParseList(test.field)
+			if !reflect.DeepEqual(ids, test.expected) {
+				t.Errorf("ParseList(%q) = %q, expected %q", test.field, ids, test.expected)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	if id := Parse(" <a@example.org> <b@example.org>"); id != "a@example.org" {
+		t.Errorf("Invalid message ID: got %q, expected %q", id, "a@example.org")
+	}
+	if id := Parse("(no id)"); id != "" {
+		t.Errorf("Expected no message ID, got %q", id)
+	}
+}
+
+var referencesTests = []struct {
+	name       string
+	messageId  string
+	inReplyTo  string
+	references string
+	expected   []string
+}{
+	{
+		name:     "none",
+		expected: nil,
+	},
+	{
+		name:       "references",
+		messageId:  "<c@example.org>",
+		inReplyTo:  "<x@example.org>",
+		references: "<a@example.org> <b@example.org>",
+		expected:   []string{"a@example.org", "b@example.org"},
+	},
+	{
+		name:      "in_reply_to",
+		messageId: "<c@example.org>",
+		inReplyTo: "<a@example.org> <b@example.org>",
+		expected:  []string{"a@example.org"},
+	},
+	{
+		name:       "invalid_references",
+		messageId:  "<c@example.org>",
+		inReplyTo:  "<a@example.org>",
+		references: "(lost) <trunc",
+		expected:   []string{"a@example.org"},
+	},
+	{
+		name:       "self_reference",
+		messageId:  "<c@example.org>",
+		references: "<a@example.org> <c@example.org>",
+		expected:   []string{"a@example.org"},
+	},
+	{
+		name:       "only_self_reference",
+		messageId:  "<c@example.org>",
+		inReplyTo:  "<c@example.org> <a@example.org>",
+		references: "<c@example.org>",
+		expected:   []string{"a@example.org"},
+	},
+	{
+		name:      "in_reply_to_prose",
+		messageId: "<c@example.org>",
+		inReplyTo: `Alice's message of "Mon, 6 Jan 2020" <a@example.org>`,
+		expected:  []string{"a@example.org"},
+	},
+}
+
+func TestReferences(t *testing.T) {
+	for _, test := range referencesTests {
+		t.Run(test.name, func(t *testing.T) {
+			refs := References(test.messageId, test.inReplyTo, test.references)
+			if !reflect.DeepEqual(refs, test.expected) {
+				t.Errorf("Invalid references: got %q, expected %q", refs, test.expected)
+			}
+		})
+	}
+}
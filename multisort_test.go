@@ -0,0 +1,290 @@
+package sortthread
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+func TestMultiSortCommand(t *testing.T) {
+	cmd := &MultiSortCommand{
+		Mailboxes:      []string{"INBOX", "Archive/2020"},
+		SortCriteria:   []SortCriterion{{Field: SortDate, Reverse: true}},
+		Charset:        "UTF-8",
+		SearchCriteria: imap.NewSearchCriteria(),
+	}
+	cmd.SearchCriteria.WithoutFlags = []string{imap.SeenFlag}
+
+	var b bytes.Buffer
+	w := imap.NewWriter(&b)
+	c := cmd.Command()
+	c.Tag = "A1"
+	if err := c.WriteTo(w); err != nil {
+		t.Fatal("Expected no error while writing command but got:", err)
+	}
+	w.Flush()
+
+	expected := "A1 X-MULTISORT IN (mailboxes (INBOX \"Archive/2020\")) (REVERSE DATE) \"UTF-8\" UNSEEN\r\n"
+	if s := b.String(); s != expected {
+		t.Errorf("Invalid command: got %q, expected %q", s, expected)
+	}
+
+	fields, err := imap.NewReader(bufio.NewReader(&b)).ReadLine()
+	if err != nil {
+		t.Fatal("Expected no error while reading command but got:", err)
+	}
+
+	parsed := new(MultiSortCommand)
+	if err := parsed.Parse(fields[2:]); err != nil {
+		t.Fatal("Expected no error while parsing command but got:", err)
+	}
+	if !reflect.DeepEqual(parsed.Mailboxes, cmd.Mailboxes) {
+		t.Errorf("Invalid mailboxes: got %v, expected %v", parsed.Mailboxes, cmd.Mailboxes)
+	}
+	if !reflect.DeepEqual(parsed.SortCriteria, cmd.SortCriteria) {
+		t.Errorf("Invalid sort criteria: got %v, expected %v", parsed.SortCriteria, cmd.SortCriteria)
+	}
+}
+
+func TestMultiSortResponse(t *testing.T) {
+	res := &MultiSortResponse{Results: []MailboxUid{
+		{Mailbox: "INBOX", UidValidity: 1, Uid: 4},
+		{Mailbox: "Archive", UidValidity: 7, Uid: 12},
+		{Mailbox: "INBOX", UidValidity: 1, Uid: 2},
+	}}
+
+	var b bytes.Buffer
+	w := imap.NewWriter(&b)
+	if err := res.WriteTo(w); err != nil {
+		t.Fatal("Expected no error while writing response but got:", err)
+	}
+	w.Flush()
+
+	expected := "* X-MULTISORT (INBOX 1 4) (\"Archive\" 7 12) (INBOX 1 2)\r\n"
+	if s := b.String(); s != expected {
+		t.Errorf("Invalid response: got %q, expected %q", s, expected)
+	}
+
+	resp, err := imap.ReadResp(imap.NewReader(bufio.NewReader(&b)))
+	if err != nil {
+		t.Fatal("Expected no error while reading response but got:", err)
+	}
+	parsed := new(MultiSortResponse)
+	if err := parsed.Handle(resp); err != nil {
+		t.Fatal("Expected no error while handling response but got:", err)
+	}
+	if !reflect.DeepEqual(parsed.Results, res.Results) {
+		t.Errorf("Invalid results: got %v, expected %v", parsed.Results, res.Results)
+	}
+}
+
+type multiSortTestBackend struct {
+	user      *multiSortTestUser
+	supported bool
+}
+
+func (be *multiSortTestBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	return be.user, nil
+}
+
+func (be *multiSortTestBackend) SupportMultiSort() bool {
+	return be.supported
+}
+
+type multiSortTestUser struct {
+	backend.User
+
+	mailboxes []*multiSortTestMailbox
+	err       error
+}
+
+func (u *multiSortTestUser) Username() string {
+	return "username"
+}
+
+func (u *multiSortTestUser) Logout() error {
+	return nil
+}
+
+func (u *multiSortTestUser) GetMailbox(name string) (backend.Mailbox, error) {
+	for _, mbox := range u.mailboxes {
+		if mbox.name == name {
+			return mbox, nil
+		}
+	}
+	return nil, backend.ErrNoSuchMailbox
+}
+
+type multiSortTestMailbox struct {
+	backend.Mailbox
+
+	user        *multiSortTestUser
+	name        string
+	uidValidity uint32
+	messages    []*imap.Message
+	// The result of Sort, which doesn't need to match the sort criteria
+	sorted []uint32
+}
+
+func (mbox *multiSortTestMailbox) Name() string {
+	return mbox.name
+}
+
+func (mbox *multiSortTestMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	status := imap.NewMailboxStatus(mbox.name, items)
+	status.UidValidity = mbox.uidValidity
+	return status, nil
+}
+
+func (mbox *multiSortTestMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+	for _, msg := range mbox.messages {
+		if seqSet.Contains(msg.Uid) {
+			ch <- msg
+		}
+	}
+	return nil
+}
+
+func (mbox *multiSortTestMailbox) Sort(uid bool, sortCrit []SortCriterion, searchCrit *imap.SearchCriteria) ([]uint32, error) {
+	if mbox.user.err != nil {
+		return nil, mbox.user.err
+	}
+	return mbox.sorted, nil
+}
+
+func newMultiSortTestUser() *multiSortTestUser {
+	day := func(d int) time.Time {
+		return time.Date(2020, 1, d, 0, 0, 0, 0, time.UTC)
+	}
+	user := &multiSortTestUser{}
+	user.mailboxes = []*multiSortTestMailbox{
+		{
+			user:        user,
+			name:        "INBOX",
+			uidValidity: 1,
+			messages: []*imap.Message{
+				newTestSortMessage(1, day(1), "", "", 0),
+				newTestSortMessage(2, day(3), "", "", 0),
+				newTestSortMessage(3, day(3), "", "", 0),
+				newTestSortMessage(4, day(5), "", "", 0),
+			},
+			// Ties are broken by reverse UID
+			sorted: []uint32{1, 3, 2, 4},
+		},
+		{
+			user:        user,
+			name:        "Archive",
+			uidValidity: 7,
+			messages: []*imap.Message{
+				newTestSortMessage(1, day(2), "", "", 0),
+				newTestSortMessage(2, day(3), "", "", 0),
+				newTestSortMessage(3, day(4), "", "", 0),
+			},
+			sorted: []uint32{1, 2, 3},
+		},
+	}
+	return user
+}
+
+func TestMultiSort(t *testing.T) {
+	user := newMultiSortTestUser()
+	sortCrit := []SortCriterion{{Field: SortDate}}
+
+	results, err := MultiSort(user, []string{"INBOX", "Archive"}, sortCrit, imap.NewSearchCriteria())
+	if err != nil {
+		t.Fatal("Expected no error while sorting but got:", err)
+	}
+	expected := []MailboxUid{
+		{Mailbox: "INBOX", UidValidity: 1, Uid: 1},
+		{Mailbox: "Archive", UidValidity: 7, Uid: 1},
+		{Mailbox: "INBOX", UidValidity: 1, Uid: 3},
+		{Mailbox: "INBOX", UidValidity: 1, Uid: 2},
+		{Mailbox: "Archive", UidValidity: 7, Uid: 2},
+		{Mailbox: "Archive", UidValidity: 7, Uid: 3},
+		{Mailbox: "INBOX", UidValidity: 1, Uid: 4},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Invalid results: got %v, expected %v", results, expected)
+	}
+
+	// Ties between mailboxes are broken by mailbox order
+	results, err = MultiSort(user, []string{"Archive", "INBOX"}, sortCrit, imap.NewSearchCriteria())
+	if err != nil {
+		t.Fatal("Expected no error while sorting but got:", err)
+	}
+	expected[2], expected[3], expected[4] = expected[4], expected[2], expected[3]
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Invalid results with reversed mailboxes: got %v, expected %v", results, expected)
+	}
+}
+
+func TestMultiSortCapability(t *testing.T) {
+	for _, supported := range []bool{false, true} {
+		be := &multiSortTestBackend{user: newMultiSortTestUser(), supported: supported}
+		c, close := newTestServer(t, be, NewMultiSortExtension())
+		ok, err := NewSortClient(c).SupportMultiSort()
+		close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != supported {
+			t.Errorf("Expected X-MULTISORT capability to be %v, got %v", supported, ok)
+		}
+	}
+}
+
+func TestMultiSortHandler(t *testing.T) {
+	var labels [][]string
+	options := &ExtensionOptions{
+		MaxResults: 5,
+		Instrumentation: &MetricsInstrumentation{
+			ObserveDuration: func(l []string, seconds float64) {
+				labels = append(labels, l)
+			},
+		},
+	}
+	be := &multiSortTestBackend{user: newMultiSortTestUser(), supported: true}
+	c, close := newTestServer(t, be, NewMultiSortExtensionWithOptions(options))
+	defer close()
+
+	sc := NewSortClient(c)
+	sortCrit := []SortCriterion{{Field: SortDate}}
+	results, err := sc.MultiSort([]string{"Archive"}, sortCrit, imap.NewSearchCriteria())
+	if err != nil {
+		t.Fatal("Expected no error while sorting but got:", err)
+	}
+	if len(results) != 3 {
+		t.Errorf("Invalid number of results: got %v, expected 3", len(results))
+	}
+
+	_, err = sc.MultiSort([]string{"INBOX", "Archive"}, sortCrit, imap.NewSearchCriteria())
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) {
+		t.Errorf("Expected LimitError, got %#v", err)
+	}
+
+	be.user.err = errors.New("disk on fire")
+	_, err = sc.MultiSort([]string{"INBOX"}, sortCrit, imap.NewSearchCriteria())
+	var statusErr *imap.ErrStatusResp
+	if !errors.As(err, &statusErr) || statusErr.Resp.Code != CodeServerBug {
+		t.Errorf("Expected NO [SERVERBUG], got %v", err)
+	}
+
+	// Commands are reported from the server goroutine, before the response
+	// is sent
+	expected := [][]string{
+		{MultiSortCapability, "true", "ok"},
+		{MultiSortCapability, "true", "error"},
+		{MultiSortCapability, "true", "error"},
+	}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Errorf("Invalid instrumentation labels: got %v, expected %v", labels, expected)
+	}
+}
@@ -0,0 +1,130 @@
+package sortthread
+
+import "sort"
+
+// ThreadOrderOptions contains options for SortThreads.
+type ThreadOrderOptions struct {
+	// By default, a thread is ranked by its best-ranked message, e.g. with a
+	// SORT (REVERSE DATE) result threads are ordered by their newest message.
+	// If RootOnly is set, only the thread root is considered.
+	RootOnly bool
+	// If Siblings is set, the children of each message are reordered too.
+	Siblings bool
+}
+
+// SortThreads reorders threads in place according to the message order
+// returned by a SORT command. Messages missing from ids, e.g. because they
+// didn't match the SORT search criteria, are ranked last. Threads without any
+// ranked message keep their relative order and are moved to the end.
+//
+// The threads and ids must use the same kind of IDs (sequence numbers or UIDs).
+func SortThreads(threads []*Thread, ids []uint32, options *ThreadOrderOptions) {
+	rank := make(map[uint32]int, len(ids))
+	for i, id := range ids {
+		if _, ok := rank[id]; !ok {
+			rank[id] = i
+		}
+	}
+	SortThreadsByRank(threads, rank, options)
+}
+
+// SortThreadsByRank is like SortThreads, but takes an arbitrary rank for each
+// message. Lower ranks come first.
+func SortThreadsByRank(threads []*Thread, rank map[uint32]int, options *ThreadOrderOptions) {
+	if options == nil {
+		options = new(ThreadOrderOptions)
+	}
+	sortThreadsByRank(threads, rank, options)
+}
+
+type threadRank struct {
+	rank int
+	ok   bool
+}
+
+// computeThreadRanks computes the rank of each thread: the rank of its
+// best-ranked message, or of its root if options.RootOnly is set.
+func computeThreadRanks(t *Thread, rank map[uint32]int, options *ThreadOrderOptions, ranks map[*Thread]threadRank) threadRank {
+	r, ok := rank[t.Id]
+	best := threadRank{r, ok}
+	for _, c := range t.Children {
+		cr := computeThreadRanks(c, rank, options, ranks)
+		if !options.RootOnly && cr.ok && (!best.ok || cr.rank < best.rank) {
+			best = cr
+		}
+	}
+	ranks[t] = best
+	return best
+}
+
+func sortThreadsByRank(threads []*Thread, rank map[uint32]int, options *ThreadOrderOptions) {
+	ranks := make(map[*Thread]threadRank)
+	for _, t := range threads {
+		computeThreadRanks(t, rank, options, ranks)
+	}
+	sortThreadsByRanks(threads, ranks, options)
+}
+
+func sortThreadsByRanks(threads []*Thread, ranks map[*Thread]threadRank, options *ThreadOrderOptions) {
+	sort.SliceStable(threads, func(i, j int) bool {
+		ri, rj := ranks[threads[i]], ranks[threads[j]]
+		if ri.ok != rj.ok {
+			return ri.ok
+		}
+		return ri.rank < rj.rank
+	})
+
+	if options.Siblings {
+		for _, t := range threads {
+			sortThreadsByRanks(t.Children, ranks, options)
+		}
+	}
+}
+
+// SortThreadSiblingsFunc reorders the children of each message in place, at
+// every level, so that less(a, b) holds for a before b. The order of the
+// threads themselves is left unchanged.
+//
+// Children are sorted before their parent's siblings, so that less can look at
+// the first child of a dummy thread, e.g. with ThreadSortKeys.
+func SortThreadSiblingsFunc(threads []*Thread, less func(a, b *Thread) bool) {
+	for _, t := range threads {
+		sortThreadChildren(t, less)
+	}
+}
+
+func sortThreadChildren(t *Thread, less func(a, b *Thread) bool) {
+	for _, c := range t.Children {
+		sortThreadChildren(c, less)
+	}
+	sort.SliceStable(t.Children, func(i, j int) bool {
+		return less(t.Children[i], t.Children[j])
+	})
+}
+
+// ThreadSortKeys returns the sort keys of a thread: the keys of its message,
+// or of its first child for a dummy thread, as done by RFC 5256 for sibling
+// ordering. It returns nil if no keys are found.
+func ThreadSortKeys(t *Thread, keys map[uint32]*SortKeys) *SortKeys {
+	for t.Id == 0 {
+		if len(t.Children) == 0 {
+			return nil
+		}
+		t = t.Children[0]
+	}
+	return keys[t.Id]
+}
+
+// SortThreadSiblings reorders the children of each message in place according
+// to the sort criteria, e.g. to show the newest replies first. keys contains
+// the sort keys of the messages, indexed by thread ID, see ExtractSortKeys.
+// Messages without sort keys are moved after their siblings.
+func SortThreadSiblings(threads []*Thread, keys map[uint32]*SortKeys, criteria []SortCriterion) {
+	SortThreadSiblingsFunc(threads, func(a, b *Thread) bool {
+		ka, kb := ThreadSortKeys(a, keys), ThreadSortKeys(b, keys)
+		if ka == nil || kb == nil {
+			return ka != nil
+		}
+		return CompareSortKeys(ka, kb, criteria) < 0
+	})
+}
@@ -0,0 +1,105 @@
+package sortthread
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func rootIds(threads []*Thread) []uint32 {
+	var ids []uint32
+	for _, t := range threads {
+		ids = append(ids, t.Id)
+	}
+	return ids
+}
+
+var sortThreadsTests = []struct {
+	name     string
+	ids      []uint32
+	options  *ThreadOrderOptions
+	expected []uint32
+	children []uint32
+}{
+	{
+		name:     "descendant",
+		ids:      []uint32{5, 1, 3},
+		expected: []uint32{3, 1, 6},
+		children: []uint32{4, 5},
+	},
+	{
+		name:     "root_only",
+		ids:      []uint32{5, 1, 3},
+		options:  &ThreadOrderOptions{RootOnly: true},
+		expected: []uint32{1, 3, 6},
+		children: []uint32{2},
+	},
+	{
+		name:     "siblings",
+		ids:      []uint32{5, 4},
+		options:  &ThreadOrderOptions{Siblings: true},
+		expected: []uint32{3, 1, 6},
+		children: []uint32{5, 4},
+	},
+}
+
+func TestSortThreads(t *testing.T) {
+	for _, test := range sortThreadsTests {
+		t.Run(test.name, func(t *testing.T) {
+			threads := []*Thread{
+				{Id: 1, Children: []*Thread{{Id: 2}}},
+				{Id: 3, Children: []*Thread{{Id: 4}, {Id: 5}}},
+				{Id: 6},
+			}
+			SortThreads(threads, test.ids, test.options)
+			if ids := rootIds(threads); !reflect.DeepEqual(ids, test.expected) {
+				t.Errorf("Got threads %v, expected %v", ids, test.expected)
+			}
+			if ids := rootIds(threads[0].Children); !reflect.DeepEqual(ids, test.children) {
+				t.Errorf("Got children %v, expected %v", ids, test.children)
+			}
+		})
+	}
+}
+
+func TestSortThreadSiblings(t *testing.T) {
+	// (1 (2 3)(4 5)(6))((7)(8))
+	threads := []*Thread{
+		{Id: 1, Children: []*Thread{
+			{Id: 2, Children: []*Thread{{Id: 3}}},
+			{Id: 4, Children: []*Thread{{Id: 5}}},
+			{Id: 6},
+		}},
+		{Children: []*Thread{{Id: 7}, {Id: 8}}},
+	}
+
+	base := threaderDate
+	keys := make(map[uint32]*SortKeys)
+	for id := uint32(1); id <= 8; id++ {
+		keys[id] = &SortKeys{Id: id, Date: base.Add(time.Duration(id) * time.Hour)}
+	}
+	// Message 4 is missing, e.g. because it has been expunged
+	delete(keys, 4)
+
+	SortThreadSiblings(threads, keys, []SortCriterion{{Field: SortDate, Reverse: true}})
+	expected := "(1 (6)(2 3)(4 5))((8)(7))"
+	if s := formatTestThreads(threads); s != expected {
+		t.Errorf("Invalid threads: got %v, expected %v", s, expected)
+	}
+}
+
+func TestSortThreadSiblingsFunc(t *testing.T) {
+	threads := []*Thread{
+		{Id: 1, Children: []*Thread{{Id: 2}, {Id: 3}, {Id: 4}}},
+	}
+	unread := map[uint32]bool{2: false, 3: true, 4: true}
+
+	// Unread messages first
+	SortThreadSiblingsFunc(threads, func(a, b *Thread) bool {
+		return unread[a.Id] && !unread[b.Id]
+	})
+	expected := "(1 (3)(4)(2))"
+	if s := formatTestThreads(threads); s != expected {
+		t.Errorf("Invalid threads: got %v, expected %v", s, expected)
+	}
+}
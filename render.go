@@ -0,0 +1,133 @@
+package sortthread
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ThreadLabelFunc returns a label for a message in a thread, e.g. its subject
+// and sender.
+type ThreadLabelFunc func(id uint32) string
+
+func defaultThreadLabel(id uint32) string {
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+// missingThreadLabel is the label of dummy messages, i.e. missing parents.
+const missingThreadLabel = "(missing)"
+
+var dotLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", "")
+
+// WriteThreadsDOT writes threads as a Graphviz DOT directed graph. If label is
+// nil, messages are labelled with their ID. Dummy messages are drawn dashed.
+func WriteThreadsDOT(w io.Writer, threads []*Thread, label ThreadLabelFunc) error {
+	if label == nil {
+		label = defaultThreadLabel
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph threads {")
+	// Nodes are numbered, since dummy messages all have the ID 0
+	nodes := make(map[*Thread]int)
+	for _, t := range threads {
+		walkThread(t, func(t *Thread) {
+			nodes[t] = len(nodes) + 1
+		})
+	}
+	for _, t := range threads {
+		walkThread(t, func(t *Thread) {
+			if t.Id == 0 {
+				fmt.Fprintf(bw, "\tn%d [label=\"%s\", style=dashed];\n", nodes[t], missingThreadLabel)
+			} else {
+				fmt.Fprintf(bw, "\tn%d [label=\"%s\"];\n", nodes[t], dotLabelReplacer.Replace(label(t.Id)))
+			}
+			for _, c := range t.Children {
+				fmt.Fprintf(bw, "\tn%d -> n%d;\n", nodes[t], nodes[c])
+			}
+		})
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// TreeOptions contains options for WriteThreadsTree.
+type TreeOptions struct {
+	// The label of each message. If nil, messages are labelled with their ID.
+	Label ThreadLabelFunc
+	// The width of each indentation level, at least 2. Defaults to 3.
+	Indent int
+	// Use ASCII characters instead of Unicode box-drawing characters.
+	ASCII bool
+}
+
+type treeGlyphs struct {
+	branch, last, line, arrow, vertical string
+}
+
+var (
+	unicodeTreeGlyphs = treeGlyphs{"├", "└", "─", ">", "│"}
+	asciiTreeGlyphs   = treeGlyphs{"|", "`", "-", ">", "|"}
+)
+
+// WriteThreadsTree writes threads as a text tree, one message per line,
+// similar to mutt's thread view. Dummy messages are written as "(missing)":
+//
+//	1
+//	├─>2
+//	│  └─>3
+//	└─>4
+func WriteThreadsTree(w io.Writer, threads []*Thread, options *TreeOptions) error {
+	if options == nil {
+		options = new(TreeOptions)
+	}
+	label := options.Label
+	if label == nil {
+		label = defaultThreadLabel
+	}
+	indent := options.Indent
+	if indent == 0 {
+		indent = 3
+	} else if indent < 2 {
+		indent = 2
+	}
+	glyphs := unicodeTreeGlyphs
+	if options.ASCII {
+		glyphs = asciiTreeGlyphs
+	}
+
+	var (
+		branch   = glyphs.branch + strings.Repeat(glyphs.line, indent-2) + glyphs.arrow
+		last     = glyphs.last + strings.Repeat(glyphs.line, indent-2) + glyphs.arrow
+		vertical = glyphs.vertical + strings.Repeat(" ", indent-1)
+		blank    = strings.Repeat(" ", indent)
+	)
+
+	labelThread := func(t *Thread) string {
+		if t.Id == 0 {
+			return missingThreadLabel
+		}
+		return label(t.Id)
+	}
+
+	bw := bufio.NewWriter(w)
+	var write func(t *Thread, prefix string)
+	write = func(t *Thread, prefix string) {
+		for i, c := range t.Children {
+			if i == len(t.Children)-1 {
+				fmt.Fprintf(bw, "%s%s%s\n", prefix, last, labelThread(c))
+				write(c, prefix+blank)
+			} else {
+				fmt.Fprintf(bw, "%s%s%s\n", prefix, branch, labelThread(c))
+				write(c, prefix+vertical)
+			}
+		}
+	}
+	for _, t := range threads {
+		fmt.Fprintf(bw, "%s\n", labelThread(t))
+		write(t, "")
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,166 @@
+package sortthread
+
+import (
+	"strings"
+	"testing"
+)
+
+// (2)(3 6 (4 23)(44 7 96))
+var renderThreads = []*Thread{
+	{Id: 2},
+	{Id: 3, Children: []*Thread{
+		{Id: 6, Children: []*Thread{
+			{Id: 4, Children: []*Thread{{Id: 23}}},
+			{Id: 44, Children: []*Thread{
+				{Id: 7, Children: []*Thread{{Id: 96}}},
+			}},
+		}},
+	}},
+}
+
+func TestWriteThreadsDOT(t *testing.T) {
+	expected := `digraph threads {
+	n1 [label="2"];
+	n2 [label="3"];
+	n2 -> n3;
+	n3 [label="6"];
+	n3 -> n4;
+	n3 -> n6;
+	n4 [label="4"];
+	n4 -> n5;
+	n5 [label="23"];
+	n6 [label="44"];
+	n6 -> n7;
+	n7 [label="7"];
+	n7 -> n8;
+	n8 [label="96"];
+}
+`
+
+	var b strings.Builder
+	if err := WriteThreadsDOT(&b, renderThreads, nil); err != nil {
+		t.Fatal("Expected no error while rendering threads but got:", err)
+	}
+	if s := b.String(); s != expected {
+		t.Errorf("Invalid DOT output")
+		t.Logf("Want:\n%s", expected)
+		t.Logf("Got:\n%s", s)
+	}
+}
+
+// ((1)(2))((3)(4))
+var dummyRenderThreads = []*Thread{
+	{Children: []*Thread{{Id: 1}, {Id: 2}}},
+	{Children: []*Thread{{Id: 3}, {Id: 4}}},
+}
+
+func TestWriteThreadsDOTDummy(t *testing.T) {
+	expected := `digraph threads {
+	n1 [label="(missing)", style=dashed];
+	n1 -> n2;
+	n1 -> n3;
+	n2 [label="1"];
+	n3 [label="2"];
+	n4 [label="(missing)", style=dashed];
+	n4 -> n5;
+	n4 -> n6;
+	n5 [label="3"];
+	n6 [label="4"];
+}
+`
+
+	var b strings.Builder
+	if err := WriteThreadsDOT(&b, dummyRenderThreads, nil); err != nil {
+		t.Fatal("Expected no error while rendering threads but got:", err)
+	}
+	if s := b.String(); s != expected {
+		t.Errorf("Invalid DOT output")
+		t.Logf("Want:\n%s", expected)
+		t.Logf("Got:\n%s", s)
+	}
+}
+
+var treeTests = []struct {
+	name     string
+	options  *TreeOptions
+	expected string
+}{
+	{
+		name: "unicode",
+		expected: `2
+3
+└─>6
+   ├─>4
+   │  └─>23
+   └─>44
+      └─>7
+         └─>96
+`,
+	},
+	{
+		name:    "ascii",
+		options: &TreeOptions{ASCII: true, Indent: 4},
+		expected: "2\n" +
+			"3\n" +
+			"`-->6\n" +
+			"    |-->4\n" +
+			"    |   `-->23\n" +
+			"    `-->44\n" +
+			"        `-->7\n" +
+			"            `-->96\n",
+	},
+	{
+		name: "label",
+		options: &TreeOptions{Label: func(id uint32) string {
+			if id == 3 {
+				return "Hello"
+			}
+			return "Re: Hello"
+		}},
+		expected: `Re: Hello
+Hello
+└─>Re: Hello
+   ├─>Re: Hello
+   │  └─>Re: Hello
+   └─>Re: Hello
+      └─>Re: Hello
+         └─>Re: Hello
+`,
+	},
+}
+
+func TestWriteThreadsTree(t *testing.T) {
+	for _, test := range treeTests {
+		t.Run(test.name, func(t *testing.T) {
+			var b strings.Builder
+			if err := WriteThreadsTree(&b, renderThreads, test.options); err != nil {
+				t.Fatal("Expected no error while rendering threads but got:", err)
+			}
+			if s := b.String(); s != test.expected {
+				t.Errorf("Invalid tree output")
+				t.Logf("Want:\n%s", test.expected)
+				t.Logf("Got:\n%s", s)
+			}
+		})
+	}
+}
+
+func TestWriteThreadsTreeDummy(t *testing.T) {
+	expected := `(missing)
+├─>1
+└─>2
+(missing)
+├─>3
+└─>4
+`
+
+	var b strings.Builder
+	if err := WriteThreadsTree(&b, dummyRenderThreads, nil); err != nil {
+		t.Fatal("Expected no error while rendering threads but got:", err)
+	}
+	if s := b.String(); s != expected {
+		t.Errorf("Invalid tree output")
+		t.Logf("Want:\n%s", expected)
+		t.Logf("Got:\n%s", s)
+	}
+}
@@ -1,10 +1,12 @@
 package sortthread
 
 import (
+	"errors"
 	"strconv"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
 )
 
 type SortResponse struct {
@@ -71,7 +73,7 @@ func parseThreadResp(fields []interface{}) ([]*Thread, error) {
 			if parent == nil {
 				siblings = append(siblings, &t)
 			} else {
-				parent.Children = append(t.Children, &t)
+				parent.Children = append(parent.Children, &t)
 			}
 			parent = &t
 		case []interface{}:
@@ -95,8 +97,10 @@ func parseThreadResp(fields []interface{}) ([]*Thread, error) {
 
 func formatThread(thread *Thread) []interface{} {
 	f := make([]interface{}, 0, 1+len(thread.Children))
-	f = append(f, imap.RawString(strconv.FormatInt(int64(thread.Id), 10)))
-	if len(thread.Children) == 1 {
+	if thread.Id != 0 {
+		f = append(f, imap.RawString(strconv.FormatInt(int64(thread.Id), 10)))
+	}
+	if len(thread.Children) == 1 && thread.Id != 0 {
 		f = append(f, formatThread(thread.Children[0])...)
 	} else {
 		for _, c := range thread.Children {
@@ -118,3 +122,54 @@ func formatThreadResp(threads []*Thread) []interface{} {
 func (r *ThreadResponse) WriteTo(w *imap.Writer) error {
 	return imap.NewUntaggedResp(formatThreadResp(r.Threads)).WriteTo(w)
 }
+
+// MultiSortResponse is a X-MULTISORT response. Each message is formatted as a
+// list containing the mailbox name, its UIDVALIDITY and the message UID.
+type MultiSortResponse struct {
+	Results []MailboxUid
+}
+
+func (r *MultiSortResponse) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != MultiSortCapability {
+		return responses.ErrUnhandled
+	}
+
+	r.Results = make([]MailboxUid, 0, len(fields))
+	for _, f := range fields {
+		l, ok := f.([]interface{})
+		if !ok || len(l) != 3 {
+			return errors.New("Invalid X-MULTISORT result")
+		}
+
+		var res MailboxUid
+		var err error
+		if res.Mailbox, err = parseMailboxName(l[0]); err != nil {
+			return err
+		}
+		if res.UidValidity, err = imap.ParseNumber(l[1]); err != nil {
+			return err
+		}
+		if res.Uid, err = imap.ParseNumber(l[2]); err != nil {
+			return err
+		}
+		r.Results = append(r.Results, res)
+	}
+
+	return nil
+}
+
+func (r *MultiSortResponse) WriteTo(w *imap.Writer) error {
+	fields := make([]interface{}, 0, len(r.Results)+1)
+	fields = append(fields, imap.RawString(MultiSortCapability))
+	for _, res := range r.Results {
+		name, _ := utf7.Encoding.NewEncoder().String(res.Mailbox)
+		fields = append(fields, []interface{}{
+			imap.FormatMailboxName(name),
+			imap.RawString(strconv.FormatInt(int64(res.UidValidity), 10)),
+			imap.RawString(strconv.FormatInt(int64(res.Uid), 10)),
+		})
+	}
+
+	return imap.NewUntaggedResp(fields).WriteTo(w)
+}
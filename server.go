@@ -1,7 +1,11 @@
 package sortthread
 
 import (
+	"container/heap"
 	"errors"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
@@ -10,11 +14,22 @@ import (
 
 var ErrUnsupportedBackend = errors.New("sortthread: backend not supported")
 
+// SortBackend is a backend supporting SORT. The SORT capability is only
+// advertised if the backend implements this interface and SupportSort returns
+// true.
+type SortBackend interface {
+	backend.Backend
+	SupportSort() bool
+}
+
 type SortMailbox interface {
 	backend.Mailbox
 	Sort(uid bool, sortCrit []SortCriterion, searchCrit *imap.SearchCriteria) ([]uint32, error)
 }
 
+// ThreadBackend is a backend supporting THREAD. Each supported algorithm is
+// advertised as a THREAD= capability, including vendor algorithms such as
+// ReferencesNoSubject.
 type ThreadBackend interface {
 	backend.Backend
 	SupportedThreadAlgorithms() []ThreadAlgorithm
@@ -25,8 +40,229 @@ type ThreadMailbox interface {
 	Thread(uid bool, threading ThreadAlgorithm, searchCrit *imap.SearchCriteria) ([]*Thread, error)
 }
 
+// MultiSortBackend is a backend supporting multi-mailbox SORT. The
+// X-MULTISORT capability is only advertised if the backend implements this
+// interface and SupportMultiSort returns true.
+type MultiSortBackend interface {
+	backend.Backend
+	SupportMultiSort() bool
+}
+
+// ObjectIdBackend is a backend supporting the EMAILID and MAILBOXID items of
+// the OBJECTID extension, in addition to THREADID. The OBJECTID capability is
+// only advertised if the backend implements this interface and
+// SupportObjectId returns true.
+type ObjectIdBackend interface {
+	backend.Backend
+	SupportObjectId() bool
+}
+
+// MultiSortUser is a user supporting multi-mailbox SORT. Backends which don't
+// implement it can rely on MultiSort.
+type MultiSortUser interface {
+	backend.User
+	MultiSort(mailboxes []string, sortCrit []SortCriterion, searchCrit *imap.SearchCriteria) ([]MailboxUid, error)
+}
+
+type multiSortMailbox struct {
+	index       int
+	name        string
+	uidValidity uint32
+	keys        []*SortKeys
+}
+
+// multiSortHeap merges the sorted results of several mailboxes. Only the first
+// remaining message of each mailbox is compared, so the order returned by each
+// mailbox is kept.
+type multiSortHeap struct {
+	mailboxes []*multiSortMailbox
+	criteria  []SortCriterion
+}
+
+func (h *multiSortHeap) Len() int {
+	return len(h.mailboxes)
+}
+
+func (h *multiSortHeap) Less(i, j int) bool {
+	a, b := h.mailboxes[i], h.mailboxes[j]
+	if cmp := compareSortCriteria(a.keys[0], b.keys[0], h.criteria); cmp != 0 {
+		return cmp < 0
+	}
+	return a.index < b.index
+}
+
+func (h *multiSortHeap) Swap(i, j int) {
+	h.mailboxes[i], h.mailboxes[j] = h.mailboxes[j], h.mailboxes[i]
+}
+
+func (h *multiSortHeap) Push(x interface{}) {
+	h.mailboxes = append(h.mailboxes, x.(*multiSortMailbox))
+}
+
+func (h *multiSortHeap) Pop() interface{} {
+	n := len(h.mailboxes) - 1
+	mbox := h.mailboxes[n]
+	h.mailboxes = h.mailboxes[:n]
+	return mbox
+}
+
+func listSortKeys(mbox backend.Mailbox, uids []uint32, sortCrit []SortCriterion) ([]*SortKeys, error) {
+	if len(uids) == 0 {
+		return nil, nil
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchInternalDate, imap.FetchRFC822Size}
+	for _, c := range sortCrit {
+		switch c.Field {
+		case SortDate:
+			items = append(items, DateHeaderSection.FetchItem())
+		case SortModSeq:
+			items = append(items, fetchModSeq)
+		case SortSaveDate:
+			items = append(items, fetchSaveDate)
+		case SortAnnotation, SortRelevancy:
+			return nil, ErrUnsupportedSortField
+		}
+	}
+
+	ch := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- mbox.ListMessages(true, seqSet, items, ch)
+	}()
+	keys := make(map[uint32]*SortKeys, len(uids))
+	for msg := range ch {
+		keys[msg.Uid] = ExtractSortKeys(msg)
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+
+	l := make([]*SortKeys, 0, len(uids))
+	for _, uid := range uids {
+		if k, ok := keys[uid]; ok {
+			l = append(l, k)
+		}
+	}
+	return l, nil
+}
+
+// MultiSort sorts messages across several mailboxes. It runs
+// SortMailbox.Sort on each mailbox and merges the results. The messages of a
+// mailbox are returned in the order of SortMailbox.Sort, and ties between
+// mailboxes are broken by mailbox order.
+func MultiSort(user backend.User, mailboxes []string, sortCrit []SortCriterion, searchCrit *imap.SearchCriteria) ([]MailboxUid, error) {
+	h := &multiSortHeap{criteria: sortCrit}
+	total := 0
+	for i, name := range mailboxes {
+		mbox, err := user.GetMailbox(name)
+		if err != nil {
+			return nil, err
+		}
+		sortMbox, ok := mbox.(SortMailbox)
+		if !ok {
+			return nil, ErrUnsupportedBackend
+		}
+
+		status, err := mbox.Status([]imap.StatusItem{imap.StatusUidValidity})
+		if err != nil {
+			return nil, err
+		}
+
+		uids, err := sortMbox.Sort(true, sortCrit, searchCrit)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := listSortKeys(mbox, uids, sortCrit)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(keys) == 0 {
+			continue
+		}
+		h.mailboxes = append(h.mailboxes, &multiSortMailbox{
+			index:       i,
+			name:        name,
+			uidValidity: status.UidValidity,
+			keys:        keys,
+		})
+		total += len(keys)
+	}
+
+	heap.Init(h)
+	results := make([]MailboxUid, 0, total)
+	for h.Len() > 0 {
+		next := h.mailboxes[0]
+		results = append(results, MailboxUid{
+			Mailbox:     next.name,
+			UidValidity: next.uidValidity,
+			Uid:         next.keys[0].Id,
+		})
+		next.keys = next.keys[1:]
+		if len(next.keys) == 0 {
+			heap.Pop(h)
+		} else {
+			heap.Fix(h, 0)
+		}
+	}
+	return results, nil
+}
+
+// ExtensionOptions contains options for the SORT and THREAD extensions.
+//
+// Limits are enforced if non-zero, and violations are answered with a NO
+// [LIMIT] response. Extensions created with the same options share the
+// MaxConcurrent limit.
+type ExtensionOptions struct {
+	// If set, SORT and THREAD results are cached.
+	Cache *ResultCache
+
+	// The maximum nesting depth of NOT and OR search keys.
+	MaxSearchDepth int
+	// The maximum number of messages in a result.
+	MaxResults int
+	// The maximum duration of a command. The backend can't be cancelled, so a
+	// command which times out keeps running in the background and counts
+	// towards MaxConcurrent until it completes.
+	Timeout time.Duration
+	// The maximum number of concurrent SORT and THREAD commands per user.
+	MaxConcurrent int
+
+	// If set, notified when a SORT or THREAD command completes.
+	Instrumentation Instrumentation
+
+	mu      sync.Mutex
+	running map[string]int
+}
+
+func (options *ExtensionOptions) instrumentation() Instrumentation {
+	if options == nil {
+		return nil
+	}
+	return options.Instrumentation
+}
+
+// checkThreadAlgorithm checks that the backend advertises the threading
+// algorithm, which is compared case-insensitively. It returns the algorithm as
+// advertised.
+func checkThreadAlgorithm(be backend.Backend, algo ThreadAlgorithm) (ThreadAlgorithm, error) {
+	if be, ok := be.(ThreadBackend); ok {
+		for _, supported := range be.SupportedThreadAlgorithms() {
+			if strings.EqualFold(string(supported), string(algo)) {
+				return supported, nil
+			}
+		}
+	}
+	return "", &UnsupportedAlgorithmError{Algorithm: algo}
+}
+
 type SortHandler struct {
 	SortCommand
+
+	options *ExtensionOptions
 }
 
 func (h *SortHandler) handle(uid bool, conn server.Conn) error {
@@ -39,12 +275,39 @@ func (h *SortHandler) handle(uid bool, conn server.Conn) error {
 		return ErrUnsupportedBackend
 	}
 
-	ids, err := mbox.Sort(uid, h.SortCriteria, h.SearchCriteria)
+	if !supportedCharset(h.Charset) {
+		return statusError(&BadCharsetError{Charset: h.Charset})
+	}
+
+	username := conn.Context().User.Username()
+	start := time.Now()
+	v, n, err := h.options.run(username, h.SearchCriteria, func() (interface{}, int, error) {
+		var ids []uint32
+		var err error
+		if h.options != nil && h.options.Cache != nil {
+			ids, err = h.options.Cache.Sort(username, mbox, uid, h.SortCriteria, h.SearchCriteria)
+		} else {
+			ids, err = mbox.Sort(uid, h.SortCriteria, h.SearchCriteria)
+		}
+		if err != nil {
+			return nil, 0, &BackendError{Err: err}
+		}
+		return ids, len(ids), nil
+	})
+	reportCommand(h.options.instrumentation(), &CommandInfo{
+		Name:         "SORT",
+		Uid:          uid,
+		SortCriteria: h.SortCriteria,
+		Search:       summarizeSearchCriteria(h.SearchCriteria),
+		Username:     username,
+		Results:      n,
+		Err:          err,
+	}, start)
 	if err != nil {
-		return err
+		return statusError(err)
 	}
 
-	return conn.WriteResp(&SortResponse{Ids: ids})
+	return conn.WriteResp(&SortResponse{Ids: v.([]uint32)})
 }
 
 func (h *SortHandler) Handle(conn server.Conn) error {
@@ -55,8 +318,57 @@ func (h *SortHandler) UidHandle(conn server.Conn) error {
 	return h.handle(true, conn)
 }
 
+type MultiSortHandler struct {
+	MultiSortCommand
+
+	options *ExtensionOptions
+}
+
+func (h *MultiSortHandler) Handle(conn server.Conn) error {
+	if conn.Context().User == nil {
+		return server.ErrNotAuthenticated
+	}
+
+	if !supportedCharset(h.Charset) {
+		return statusError(&BadCharsetError{Charset: h.Charset})
+	}
+
+	user := conn.Context().User
+	username := user.Username()
+	start := time.Now()
+	v, n, err := h.options.run(username, h.SearchCriteria, func() (interface{}, int, error) {
+		var results []MailboxUid
+		var err error
+		if multiSortUser, ok := user.(MultiSortUser); ok {
+			results, err = multiSortUser.MultiSort(h.Mailboxes, h.SortCriteria, h.SearchCriteria)
+		} else {
+			results, err = MultiSort(user, h.Mailboxes, h.SortCriteria, h.SearchCriteria)
+		}
+		if err != nil {
+			return nil, 0, &BackendError{Err: err}
+		}
+		return results, len(results), nil
+	})
+	reportCommand(h.options.instrumentation(), &CommandInfo{
+		Name:         MultiSortCapability,
+		Uid:          true,
+		SortCriteria: h.SortCriteria,
+		Search:       summarizeSearchCriteria(h.SearchCriteria),
+		Username:     username,
+		Results:      n,
+		Err:          err,
+	}, start)
+	if err != nil {
+		return statusError(err)
+	}
+
+	return conn.WriteResp(&MultiSortResponse{Results: v.([]MailboxUid)})
+}
+
 type ThreadHandler struct {
 	ThreadCommand
+
+	options *ExtensionOptions
 }
 
 func (h *ThreadHandler) handle(uid bool, conn server.Conn) error {
@@ -69,12 +381,45 @@ func (h *ThreadHandler) handle(uid bool, conn server.Conn) error {
 		return ErrUnsupportedBackend
 	}
 
-	thr, err := mbox.Thread(uid, h.Algorithm, h.SearchCriteria)
+	algo, err := checkThreadAlgorithm(conn.Server().Backend, h.Algorithm)
 	if err != nil {
-		return err
+		return statusError(err)
 	}
+	h.Algorithm = algo
 
-	return conn.WriteResp(&ThreadResponse{Threads: thr})
+	if !supportedCharset(h.Charset) {
+		return statusError(&BadCharsetError{Charset: h.Charset})
+	}
+
+	username := conn.Context().User.Username()
+	start := time.Now()
+	v, n, err := h.options.run(username, h.SearchCriteria, func() (interface{}, int, error) {
+		var thr []*Thread
+		var err error
+		if h.options != nil && h.options.Cache != nil {
+			thr, err = h.options.Cache.Thread(username, mbox, uid, h.Algorithm, h.SearchCriteria)
+		} else {
+			thr, err = mbox.Thread(uid, h.Algorithm, h.SearchCriteria)
+		}
+		if err != nil {
+			return nil, 0, &BackendError{Err: err}
+		}
+		return thr, countThreads(thr), nil
+	})
+	reportCommand(h.options.instrumentation(), &CommandInfo{
+		Name:      "THREAD",
+		Uid:       uid,
+		Algorithm: h.Algorithm,
+		Search:    summarizeSearchCriteria(h.SearchCriteria),
+		Username:  username,
+		Results:   n,
+		Err:       err,
+	}, start)
+	if err != nil {
+		return statusError(err)
+	}
+
+	return conn.WriteResp(&ThreadResponse{Threads: v.([]*Thread)})
 }
 
 func (h *ThreadHandler) Handle(conn server.Conn) error {
@@ -85,34 +430,91 @@ func (h *ThreadHandler) UidHandle(conn server.Conn) error {
 	return h.handle(true, conn)
 }
 
-type sortExtension struct{}
+type sortExtension struct {
+	options *ExtensionOptions
+}
 
 func NewSortExtension() server.Extension {
 	return &sortExtension{}
 }
 
+// NewSortExtensionWithOptions creates a SORT extension with the provided
+// options.
+func NewSortExtensionWithOptions(options *ExtensionOptions) server.Extension {
+	return &sortExtension{options: options}
+}
+
 func (s *sortExtension) Capabilities(c server.Conn) []string {
-	if c.Context().State&imap.AuthenticatedState != 0 {
-		return []string{SortCapability}
+	if c.Context().State&imap.AuthenticatedState == 0 {
+		return nil
 	}
-	return nil
+
+	be, ok := c.Server().Backend.(SortBackend)
+	if !ok || !be.SupportSort() {
+		return nil
+	}
+	return []string{SortCapability}
 }
 
 func (s *sortExtension) Command(name string) server.HandlerFactory {
 	if name == "SORT" {
 		return func() server.Handler {
-			return &SortHandler{}
+			return &SortHandler{options: s.options}
 		}
 	}
 	return nil
 }
 
-type threadExtension struct{}
+type multiSortExtension struct {
+	options *ExtensionOptions
+}
+
+// NewMultiSortExtension creates a server extension for multi-mailbox SORT.
+func NewMultiSortExtension() server.Extension {
+	return &multiSortExtension{}
+}
+
+// NewMultiSortExtensionWithOptions creates a multi-mailbox SORT extension with
+// the provided options. The Cache option isn't used.
+func NewMultiSortExtensionWithOptions(options *ExtensionOptions) server.Extension {
+	return &multiSortExtension{options: options}
+}
+
+func (s *multiSortExtension) Capabilities(c server.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState == 0 {
+		return nil
+	}
+
+	be, ok := c.Server().Backend.(MultiSortBackend)
+	if !ok || !be.SupportMultiSort() {
+		return nil
+	}
+	return []string{MultiSortCapability}
+}
+
+func (s *multiSortExtension) Command(name string) server.HandlerFactory {
+	if name == MultiSortCapability {
+		return func() server.Handler {
+			return &MultiSortHandler{options: s.options}
+		}
+	}
+	return nil
+}
+
+type threadExtension struct {
+	options *ExtensionOptions
+}
 
 func NewThreadExtension() server.Extension {
 	return &threadExtension{}
 }
 
+// NewThreadExtensionWithOptions creates a THREAD extension with the provided
+// options.
+func NewThreadExtensionWithOptions(options *ExtensionOptions) server.Extension {
+	return &threadExtension{options: options}
+}
+
 func (s *threadExtension) Capabilities(c server.Conn) []string {
 	if c.Context().State&imap.AuthenticatedState == 0 {
 		return nil
@@ -134,8 +536,33 @@ func (s *threadExtension) Capabilities(c server.Conn) []string {
 func (s *threadExtension) Command(name string) server.HandlerFactory {
 	if name == "THREAD" {
 		return func() server.Handler {
-			return &ThreadHandler{}
+			return &ThreadHandler{options: s.options}
 		}
 	}
 	return nil
 }
+
+type threadIdExtension struct{}
+
+// NewThreadIdExtension creates a server extension advertising the THREADID
+// fetch item. The OBJECTID capability is advertised if the backend implements
+// ObjectIdBackend, and X-THREADID otherwise. The backend must populate the
+// THREADID fetch item, see ThreadIdAssigner.FillThreadId and FormatThreadId.
+func NewThreadIdExtension() server.Extension {
+	return &threadIdExtension{}
+}
+
+func (s *threadIdExtension) Capabilities(c server.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState == 0 {
+		return nil
+	}
+
+	if be, ok := c.Server().Backend.(ObjectIdBackend); ok && be.SupportObjectId() {
+		return []string{ObjectIdCapability}
+	}
+	return []string{ThreadIdCapability}
+}
+
+func (s *threadIdExtension) Command(name string) server.HandlerFactory {
+	return nil
+}
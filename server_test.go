@@ -0,0 +1,327 @@
+package sortthread
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+)
+
+type testBackend struct {
+	backend.Backend
+
+	sort      bool
+	algorithm ThreadAlgorithm
+	// If set, returned by Thread
+	threads []*Thread
+	err     error
+	// If set, Sort and Thread wait until it's closed
+	block chan struct{}
+}
+
+func (be *testBackend) SupportSort() bool {
+	return be.sort
+}
+
+func (be *testBackend) SupportedThreadAlgorithms() []ThreadAlgorithm {
+	return []ThreadAlgorithm{References}
+}
+
+func (be *testBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	user, err := be.Backend.Login(connInfo, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &testUser{User: user, be: be}, nil
+}
+
+type testUser struct {
+	backend.User
+
+	be *testBackend
+}
+
+func (u *testUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return &testMailbox{Mailbox: mbox, be: u.be}, nil
+}
+
+type testMailbox struct {
+	backend.Mailbox
+
+	be *testBackend
+}
+
+func (mbox *testMailbox) Sort(uid bool, sortCrit []SortCriterion, searchCrit *imap.SearchCriteria) ([]uint32, error) {
+	if mbox.be.block != nil {
+		<-mbox.be.block
+	}
+	if mbox.be.err != nil {
+		return nil, mbox.be.err
+	}
+	// Identify the command in the result
+	return []uint32{uint32(len(sortCrit))}, nil
+}
+
+func (mbox *testMailbox) Thread(uid bool, algorithm ThreadAlgorithm, searchCrit *imap.SearchCriteria) ([]*Thread, error) {
+	if mbox.be.block != nil {
+		<-mbox.be.block
+		return []*Thread{{Id: 1}}, nil
+	}
+	mbox.be.algorithm = algorithm
+	if mbox.be.threads != nil {
+		return mbox.be.threads, nil
+	}
+	return []*Thread{{Id: 1}}, nil
+}
+
+// newTestServer starts a server with the SORT and THREAD extensions, unless
+// other extensions are provided, and selects INBOX.
+func newTestServer(t *testing.T, be backend.Backend, extensions ...server.Extension) (c *client.Client, close func()) {
+	if len(extensions) == 0 {
+		extensions = []server.Extension{NewSortExtension(), NewThreadExtension()}
+	}
+
+	s := server.New(be)
+	s.AllowInsecureAuth = true
+	for _, ext := range extensions {
+		s.Enable(ext)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+
+	c, err = client.Dial(l.Addr().String())
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	close = func() {
+		c.Logout()
+		s.Close()
+	}
+	if err := c.Login("username", "password"); err != nil {
+		close()
+		t.Fatal(err)
+	}
+	if _, err := c.Select("INBOX", false); err != nil {
+		close()
+		t.Fatal(err)
+	}
+	return c, close
+}
+
+func TestSortCapability(t *testing.T) {
+	for _, supported := range []bool{false, true} {
+		c, close := newTestServer(t, &testBackend{Backend: memory.New(), sort: supported})
+		ok, err := c.Support(SortCapability)
+		close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != supported {
+			t.Errorf("Expected SORT capability to be %v, got %v", supported, ok)
+		}
+	}
+}
+
+func TestThreadHandlerAlgorithm(t *testing.T) {
+	be := &testBackend{Backend: memory.New()}
+	c, close := newTestServer(t, be)
+	defer close()
+
+	cmd := &ThreadCommand{
+		Algorithm:      OrderedSubject,
+		SearchCriteria: imap.NewSearchCriteria(),
+	}
+	status, err := c.Execute(cmd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Type != imap.StatusRespBad {
+		t.Errorf("Expected BAD for unsupported algorithm, got %v %v", status.Type, status.Info)
+	}
+
+	cmd.Algorithm = "references"
+	status, err = c.Execute(cmd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Type != imap.StatusRespOk {
+		t.Errorf("Expected OK, got %v %v", status.Type, status.Info)
+	}
+	if be.algorithm != References {
+		t.Errorf("Invalid algorithm passed to the backend: got %v, expected %v", be.algorithm, References)
+	}
+}
+
+func TestSortHandlerCharset(t *testing.T) {
+	c, close := newTestServer(t, &testBackend{Backend: memory.New(), sort: true})
+	defer close()
+
+	cmd := &SortCommand{
+		SortCriteria:   []SortCriterion{{Field: SortArrival}},
+		Charset:        "X-UNKNOWN",
+		SearchCriteria: imap.NewSearchCriteria(),
+	}
+	status, err := c.Execute(cmd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Type != imap.StatusRespNo || status.Code != imap.CodeBadCharset {
+		t.Errorf("Expected NO [BADCHARSET], got %v [%v] %v", status.Type, status.Code, status.Info)
+	}
+
+	cmd.Charset = "UTF-8"
+	status, err = c.Execute(cmd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Type != imap.StatusRespOk {
+		t.Errorf("Expected OK, got %v %v", status.Type, status.Info)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	be := &testBackend{Backend: memory.New(), sort: true}
+	c, close := newTestServer(t, be)
+	defer close()
+
+	_, err := NewThreadClient(c).Thread(OrderedSubject, imap.NewSearchCriteria())
+	var algorithmErr *UnsupportedAlgorithmError
+	if !errors.As(err, &algorithmErr) || algorithmErr.Algorithm != OrderedSubject {
+		t.Errorf("Expected UnsupportedAlgorithmError, got %#v", err)
+	}
+
+	_, err = NewSortClient(c).Sort([]SortCriterion{{Field: "COLOR"}}, imap.NewSearchCriteria())
+	if !errors.Is(err, ErrUnsupportedSortField) {
+		t.Errorf("Expected ErrUnsupportedSortField, got %#v", err)
+	}
+
+	be.err = errors.New("disk on fire")
+	sortCrit := []SortCriterion{{Field: SortArrival}}
+	_, err = NewSortClient(c).Sort(sortCrit, imap.NewSearchCriteria())
+	var backendErr *BackendError
+	if !errors.As(err, &backendErr) {
+		t.Fatalf("Expected BackendError, got %#v", err)
+	}
+	var statusErr *imap.ErrStatusResp
+	if !errors.As(err, &statusErr) || statusErr.Resp.Code != CodeServerBug || statusErr.Resp.Info != "disk on fire" {
+		t.Errorf("Expected NO [SERVERBUG] disk on fire, got %v", err)
+	}
+}
+
+func TestThreadClientSortSiblings(t *testing.T) {
+	be := &testBackend{Backend: memory.New()}
+	c, close := newTestServer(t, be)
+	defer close()
+
+	// Replies to the message already in INBOX, with sequence numbers 2 to 4
+	for _, date := range []string{
+		"Fri, 03 Jan 2020 10:00:00 +0000",
+		"Wed, 01 Jan 2020 10:00:00 +0000",
+		// Only supported by ParseDate
+		"Thursday, 2 January 2020 10:00:00 GMT+2",
+	} {
+		msg := "Date: " + date + "\r\nSubject: Re: hello\r\n\r\nHi!\r\n"
+		if err := c.Append("INBOX", nil, time.Date(2020, 1, 4, 0, 0, 0, 0, time.UTC), bytes.NewBufferString(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.Select("INBOX", false); err != nil {
+		t.Fatal(err)
+	}
+	be.threads = []*Thread{{Id: 1, Children: []*Thread{{Id: 2}, {Id: 3}, {Id: 4}}}}
+
+	tc := NewThreadClient(c)
+	threads, err := tc.Thread(References, imap.NewSearchCriteria())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.SortSiblings(threads, []SortCriterion{{Field: SortDate}}); err != nil {
+		t.Fatalf("Expected no error while sorting siblings but got: %v", err)
+	}
+	if s, expected := formatTestThreads(threads), "(1 (3)(4)(2))"; s != expected {
+		t.Errorf("Invalid threads sorted by date: got %v, expected %v", s, expected)
+	}
+	if err := tc.SortSiblings(threads, []SortCriterion{{Field: SortDate, Reverse: true}}); err != nil {
+		t.Fatalf("Expected no error while sorting siblings but got: %v", err)
+	}
+	if s, expected := formatTestThreads(threads), "(1 (2)(4)(3))"; s != expected {
+		t.Errorf("Invalid threads sorted by reverse date: got %v, expected %v", s, expected)
+	}
+	if err := tc.SortSiblings(threads, []SortCriterion{{Field: SortRelevancy}}); err != ErrUnsupportedSortField {
+		t.Errorf("Expected ErrUnsupportedSortField, got %v", err)
+	}
+}
+
+// testSortCriteria returns n sort criteria, for a result of []uint32{n}.
+func testSortCriteria(n int) []SortCriterion {
+	sortCrit := make([]SortCriterion, n)
+	for i := range sortCrit {
+		sortCrit[i] = SortCriterion{Field: SortArrival}
+	}
+	return sortCrit
+}
+
+func TestClientConcurrent(t *testing.T) {
+	c, close := newTestServer(t, &testBackend{Backend: memory.New(), sort: true})
+	defer close()
+
+	// Clients created separately share the connection lock
+	sc := NewSortClient(c)
+	tc := NewThreadClient(c)
+	if sc.conn != tc.conn || NewConn(c) != sc.conn {
+		t.Fatal("Expected clients of the same connection to share a Conn")
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 1; i <= 4; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				ids, err := sc.UidSort(testSortCriteria(n), imap.NewSearchCriteria())
+				if err != nil {
+					errs <- err
+				} else if !reflect.DeepEqual(ids, []uint32{uint32(n)}) {
+					errs <- fmt.Errorf("invalid SORT result: got %v, expected [%v]", ids, n)
+				}
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 10; j++ {
+			threads, err := tc.UidThread(References, imap.NewSearchCriteria())
+			if err != nil {
+				errs <- err
+			} else if s := formatTestThreads(threads); s != "(1)" {
+				errs <- fmt.Errorf("invalid THREAD result: got %v, expected (1)", s)
+			}
+		}
+	}()
+	wg.Wait()
+
+	for len(errs) > 0 {
+		t.Error(<-errs)
+	}
+}
@@ -0,0 +1,494 @@
+package sortthread
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// ErrCorruptSortIndex is returned when a sort index file is corrupted.
+var ErrCorruptSortIndex = errors.New("sortthread: corrupt sort index")
+
+// ErrUnsupportedSortField is returned when a sort field can't be evaluated.
+var ErrUnsupportedSortField = errors.New("sortthread: unsupported sort field")
+
+// ErrSortIndexMissing is returned by SortIndex.Sort when a message isn't in
+// the index.
+var ErrSortIndexMissing = errors.New("sortthread: message missing from sort index")
+
+// ErrSortIndexInvalid is returned by SortIndex.Sort when the index needs to be
+// rebuilt.
+var ErrSortIndexInvalid = errors.New("sortthread: sort index needs to be rebuilt")
+
+const (
+	sortIndexMagic   = "IMAPSORT"
+	sortIndexVersion = 1
+
+	sortIndexRecordAdd    = 'A'
+	sortIndexRecordRemove = 'R'
+)
+
+// SortIndex is a persistent index of SORT keys for a mailbox, indexed by UID.
+//
+// The index is stored in a single append-only file. Each message append or
+// expunge appends a record to the file, and the file is compacted when it
+// contains too many obsolete records. A failed compaction is logged and tried
+// again on the next write and on Close.
+//
+// A SortIndex is safe for concurrent use.
+type SortIndex struct {
+	// ErrorLog specifies an optional logger for compaction errors. It must
+	// be set before the index is used.
+	ErrorLog imap.Logger
+
+	path        string
+	uidValidity uint32
+
+	mu      sync.RWMutex
+	f       *os.File
+	keys    map[uint32]*SortKeys
+	records int
+	valid   bool
+	// size is the offset of the end of the last complete record
+	size int64
+}
+
+// OpenSortIndex opens a sort index file, creating it if necessary.
+//
+// If the file doesn't exist, is corrupted or has been created for another
+// UIDVALIDITY, an empty index is returned and Valid returns false. The caller
+// should then populate it with Rebuild.
+func OpenSortIndex(path string, uidValidity uint32) (*SortIndex, error) {
+	idx := &SortIndex{
+		ErrorLog:    log.New(os.Stderr, "sortthread: ", log.LstdFlags),
+		path:        path,
+		uidValidity: uidValidity,
+		keys:        make(map[uint32]*SortKeys),
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	idx.f = f
+
+	if err := idx.load(); err == nil {
+		idx.valid = true
+		return idx, nil
+	} else if err != ErrCorruptSortIndex && err != io.EOF {
+		f.Close()
+		return nil, err
+	}
+
+	// Start over with an empty index
+	idx.keys = make(map[uint32]*SortKeys)
+	idx.records = 0
+	if err := idx.reset(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return idx, nil
+}
+
+// Valid returns false if the index needs to be rebuilt.
+func (idx *SortIndex) Valid() bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.valid
+}
+
+// UidValidity returns the UIDVALIDITY of the mailbox.
+func (idx *SortIndex) UidValidity() uint32 {
+	return idx.uidValidity
+}
+
+// Len returns the number of messages in the index.
+func (idx *SortIndex) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.keys)
+}
+
+// Close closes the index file. The file is compacted first if it contains too
+// many obsolete records.
+func (idx *SortIndex) Close() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.maybeCompact()
+	return idx.f.Close()
+}
+
+func (idx *SortIndex) load() error {
+	r := bufio.NewReader(idx.f)
+
+	header := make([]byte, len(sortIndexMagic)+1+4)
+	if _, err := io.ReadFull(r, header); err == io.EOF {
+		return io.EOF
+	} else if err != nil {
+		return ErrCorruptSortIndex
+	}
+	if string(header[:len(sortIndexMagic)]) != sortIndexMagic {
+		return ErrCorruptSortIndex
+	}
+	if header[len(sortIndexMagic)] != sortIndexVersion {
+		return ErrCorruptSortIndex
+	}
+	if binary.BigEndian.Uint32(header[len(sortIndexMagic)+1:]) != idx.uidValidity {
+		return ErrCorruptSortIndex
+	}
+
+	for {
+		op, keys, err := readSortIndexRecord(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		idx.apply(op, keys)
+		idx.records++
+	}
+
+	size, err := idx.f.Seek(0, io.SeekEnd)
+	idx.size = size
+	return err
+}
+
+func (idx *SortIndex) apply(op byte, keys *SortKeys) {
+	switch op {
+	case sortIndexRecordAdd:
+		idx.keys[keys.Id] = keys
+	case sortIndexRecordRemove:
+		delete(idx.keys, keys.Id)
+	}
+}
+
+func (idx *SortIndex) header() []byte {
+	var b bytes.Buffer
+	b.WriteString(sortIndexMagic)
+	b.WriteByte(sortIndexVersion)
+	binary.Write(&b, binary.BigEndian, idx.uidValidity)
+	return b.Bytes()
+}
+
+func (idx *SortIndex) reset() error {
+	if err := idx.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := idx.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	header := idx.header()
+	if _, err := idx.f.Write(header); err != nil {
+		return err
+	}
+	idx.size = int64(len(header))
+	return idx.f.Sync()
+}
+
+func (idx *SortIndex) write(op byte, keys *SortKeys) error {
+	record := formatSortIndexRecord(op, keys)
+	if _, err := idx.f.Write(record); err != nil {
+		// The file may now contain a partial record, drop it
+		if idx.f.Truncate(idx.size) != nil {
+			idx.valid = false
+		} else if _, seekErr := idx.f.Seek(idx.size, io.SeekStart); seekErr != nil {
+			idx.valid = false
+		}
+		return err
+	}
+	idx.size += int64(len(record))
+	idx.apply(op, keys)
+	idx.records++
+
+	idx.maybeCompact()
+	return nil
+}
+
+// maybeCompact compacts the index file if it contains too many obsolete
+// records. The record has already been written, so errors are only logged:
+// the file is still valid and compaction is tried again later.
+func (idx *SortIndex) maybeCompact() {
+	if idx.records <= 2*len(idx.keys)+1024 {
+		return
+	}
+	if err := idx.compact(); err != nil {
+		idx.ErrorLog.Printf("failed to compact sort index %q: %v", idx.path, err)
+	}
+}
+
+// compact rewrites the index file with only live records. The new file is
+// written next to the old one and atomically renamed.
+func (idx *SortIndex) compact() error {
+	tmpPath := idx.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	uids := make([]uint32, 0, len(idx.keys))
+	for uid := range idx.keys {
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(i, j int) bool {
+		return uids[i] < uids[j]
+	})
+
+	w := bufio.NewWriter(f)
+	w.Write(idx.header())
+	for _, uid := range uids {
+		w.Write(formatSortIndexRecord(sortIndexRecordAdd, idx.keys[uid]))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, idx.path); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		// The index file has already been replaced
+		idx.f.Close()
+		idx.f = f
+		idx.valid = false
+		return err
+	}
+
+	idx.f.Close()
+	idx.f = f
+	idx.records = len(uids)
+	idx.size = size
+	return nil
+}
+
+// Add adds or updates a message in the index. The message must have its UID,
+// ENVELOPE, INTERNALDATE and RFC822.SIZE items populated. The MODSEQ and
+// SAVEDATE items and DateHeaderSection are used if present.
+func (idx *SortIndex) Add(msg *imap.Message) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.write(sortIndexRecordAdd, ExtractSortKeys(msg))
+}
+
+// Remove removes a message from the index.
+func (idx *SortIndex) Remove(uid uint32) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if _, ok := idx.keys[uid]; !ok {
+		return nil
+	}
+	return idx.write(sortIndexRecordRemove, &SortKeys{Id: uid})
+}
+
+// Rebuild replaces the contents of the index with the provided messages. See
+// Add.
+func (idx *SortIndex) Rebuild(messages []*imap.Message) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.keys = make(map[uint32]*SortKeys, len(messages))
+	for _, msg := range messages {
+		idx.keys[msg.Uid] = ExtractSortKeys(msg)
+	}
+	if err := idx.compact(); err != nil {
+		idx.valid = false
+		return err
+	}
+	idx.valid = true
+	return nil
+}
+
+// Sort sorts the messages with the provided UIDs, e.g. returned by
+// backend.Mailbox.SearchMessages, according to the sort criteria.
+// ErrSortIndexMissing is returned if a message isn't in the index, and
+// ErrSortIndexInvalid if the index needs to be rebuilt.
+//
+// The ANNOTATION and RELEVANCY sort fields aren't stored in the index, and
+// ErrUnsupportedSortField is returned if they are used.
+func (idx *SortIndex) Sort(uids []uint32, criteria []SortCriterion) ([]uint32, error) {
+	for _, c := range criteria {
+		if c.Field == SortAnnotation || c.Field == SortRelevancy {
+			return nil, ErrUnsupportedSortField
+		}
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	if !idx.valid {
+		return nil, ErrSortIndexInvalid
+	}
+
+	keys := make([]*SortKeys, len(uids))
+	for i, uid := range uids {
+		k, ok := idx.keys[uid]
+		if !ok {
+			return nil, ErrSortIndexMissing
+		}
+		keys[i] = k
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return CompareSortKeys(keys[i], keys[j], criteria) < 0
+	})
+
+	sorted := make([]uint32, len(keys))
+	for i, k := range keys {
+		sorted[i] = k.Id
+	}
+	return sorted, nil
+}
+
+// A time is formatted as:
+//
+//	set (byte) | seconds (int64) | nanoseconds (uint32)
+//
+// The set byte is 0 for the zero time, in which case the other fields are 0.
+func writeSortIndexTime(b *bytes.Buffer, t time.Time) {
+	if t.IsZero() {
+		b.WriteByte(0)
+		binary.Write(b, binary.BigEndian, int64(0))
+		binary.Write(b, binary.BigEndian, uint32(0))
+		return
+	}
+	b.WriteByte(1)
+	binary.Write(b, binary.BigEndian, t.Unix())
+	binary.Write(b, binary.BigEndian, uint32(t.Nanosecond()))
+}
+
+func readSortIndexTime(br *bytes.Reader) (time.Time, error) {
+	set, err := br.ReadByte()
+	if err != nil {
+		return time.Time{}, ErrCorruptSortIndex
+	}
+	var sec int64
+	var nsec uint32
+	if err := binary.Read(br, binary.BigEndian, &sec); err != nil {
+		return time.Time{}, ErrCorruptSortIndex
+	}
+	if err := binary.Read(br, binary.BigEndian, &nsec); err != nil {
+		return time.Time{}, ErrCorruptSortIndex
+	}
+	switch {
+	case set == 0 && sec == 0 && nsec == 0:
+		return time.Time{}, nil
+	case set == 1 && nsec < 1e9:
+		return time.Unix(sec, int64(nsec)).UTC(), nil
+	default:
+		return time.Time{}, ErrCorruptSortIndex
+	}
+}
+
+// A record is formatted as:
+//
+//	length (uint32) | op (byte) | UID (uint32) | data | CRC-32 (uint32)
+//
+// The length includes the op, the UID and the data. For removals, data is
+// empty.
+func formatSortIndexRecord(op byte, keys *SortKeys) []byte {
+	var b bytes.Buffer
+	b.Write([]byte{0, 0, 0, 0})
+	b.WriteByte(op)
+	binary.Write(&b, binary.BigEndian, keys.Id)
+	if op == sortIndexRecordAdd {
+		writeSortIndexTime(&b, keys.Arrival)
+		writeSortIndexTime(&b, keys.Date)
+		binary.Write(&b, binary.BigEndian, keys.Size)
+		binary.Write(&b, binary.BigEndian, keys.ModSeq)
+		writeSortIndexTime(&b, keys.SaveDate)
+		for _, s := range []string{keys.Subject, keys.From, keys.To, keys.Cc} {
+			var l [binary.MaxVarintLen64]byte
+			b.Write(l[:binary.PutUvarint(l[:], uint64(len(s)))])
+			b.WriteString(s)
+		}
+	}
+
+	buf := b.Bytes()
+	binary.BigEndian.PutUint32(buf, uint32(len(buf)-4))
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(buf[4:]))
+	return append(buf, crc[:]...)
+}
+
+func readSortIndexRecord(r io.Reader) (byte, *SortKeys, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(r, l[:]); err == io.EOF {
+		return 0, nil, io.EOF
+	} else if err != nil {
+		return 0, nil, ErrCorruptSortIndex
+	}
+	n := binary.BigEndian.Uint32(l[:])
+	if n < 5 || n > 1<<20 {
+		return 0, nil, ErrCorruptSortIndex
+	}
+
+	buf := make([]byte, n+4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, nil, ErrCorruptSortIndex
+	}
+	data, crc := buf[:n], buf[n:]
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(crc) {
+		return 0, nil, ErrCorruptSortIndex
+	}
+
+	op := data[0]
+	keys := &SortKeys{Id: binary.BigEndian.Uint32(data[1:5])}
+	switch op {
+	case sortIndexRecordRemove:
+		return op, keys, nil
+	case sortIndexRecordAdd:
+		// Parsed below
+	default:
+		return 0, nil, ErrCorruptSortIndex
+	}
+
+	br := bytes.NewReader(data[5:])
+	var err error
+	if keys.Arrival, err = readSortIndexTime(br); err != nil {
+		return 0, nil, err
+	}
+	if keys.Date, err = readSortIndexTime(br); err != nil {
+		return 0, nil, err
+	}
+	if err := binary.Read(br, binary.BigEndian, &keys.Size); err != nil {
+		return 0, nil, ErrCorruptSortIndex
+	}
+	if err := binary.Read(br, binary.BigEndian, &keys.ModSeq); err != nil {
+		return 0, nil, ErrCorruptSortIndex
+	}
+	if keys.SaveDate, err = readSortIndexTime(br); err != nil {
+		return 0, nil, err
+	}
+	for _, s := range []*string{&keys.Subject, &keys.From, &keys.To, &keys.Cc} {
+		l, err := binary.ReadUvarint(br)
+		if err != nil || l > uint64(br.Len()) {
+			return 0, nil, ErrCorruptSortIndex
+		}
+		b := make([]byte, l)
+		br.Read(b)
+		*s = string(b)
+	}
+	if br.Len() != 0 {
+		return 0, nil, ErrCorruptSortIndex
+	}
+	return op, keys, nil
+}
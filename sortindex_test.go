@@ -0,0 +1,267 @@
+package sortthread
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+func newTestSortMessage(uid uint32, date time.Time, subject, from string, size uint32) *imap.Message {
+	return &imap.Message{
+		Uid:          uid,
+		InternalDate: date,
+		Size:         size,
+		Envelope: &imap.Envelope{
+			Date:    date,
+			Subject: subject,
+			From:    []*imap.Address{{MailboxName: from, HostName: "example.org"}},
+		},
+	}
+}
+
+var sortIndexMessages = []*imap.Message{
+	newTestSortMessage(1, time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC), "Re: Bbb", "carol", 300),
+	newTestSortMessage(2, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), "aaa", "Bob", 100),
+	newTestSortMessage(3, time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), "Ccc", "alice", 100),
+}
+
+func TestSortIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sortthread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "index")
+
+	idx, err := OpenSortIndex(path, 42)
+	if err != nil {
+		t.Fatal("Expected no error while opening index but got:", err)
+	}
+	if idx.Valid() {
+		t.Error("New index should need a rebuild")
+	}
+	if err := idx.Rebuild(sortIndexMessages[:2]); err != nil {
+		t.Fatal("Expected no error while rebuilding index but got:", err)
+	}
+	if err := idx.Add(sortIndexMessages[2]); err != nil {
+		t.Fatal("Expected no error while adding message but got:", err)
+	}
+	idx.Close()
+
+	idx, err = OpenSortIndex(path, 42)
+	if err != nil {
+		t.Fatal("Expected no error while opening index but got:", err)
+	}
+	if !idx.Valid() || idx.Len() != 3 {
+		t.Fatalf("Index should be valid and contain 3 messages")
+	}
+
+	tests := []struct {
+		criteria []SortCriterion
+		expected []uint32
+	}{
+		{[]SortCriterion{{Field: SortDate}}, []uint32{2, 3, 1}},
+		{[]SortCriterion{{Field: SortSubject}}, []uint32{2, 1, 3}},
+		{[]SortCriterion{{Field: SortFrom, Reverse: true}}, []uint32{1, 2, 3}},
+		{[]SortCriterion{{Field: SortSize}, {Field: SortArrival, Reverse: true}}, []uint32{3, 2, 1}},
+		{[]SortCriterion{{Field: SortSize}}, []uint32{2, 3, 1}},
+	}
+	for _, test := range tests {
+		uids, err := idx.Sort([]uint32{1, 2, 3}, test.criteria)
+		if err != nil {
+			t.Fatal("Expected no error while sorting but got:", err)
+		}
+		if !reflect.DeepEqual(uids, test.expected) {
+			t.Errorf("Sorting by %v: got %v, expected %v", test.criteria, uids, test.expected)
+		}
+	}
+
+	if err := idx.Remove(3); err != nil {
+		t.Fatal("Expected no error while removing message but got:", err)
+	}
+	if _, err := idx.Sort([]uint32{1, 2, 3}, nil); err != ErrSortIndexMissing {
+		t.Errorf("Expected ErrSortIndexMissing but got: %v", err)
+	}
+	idx.Close()
+
+	// Different UIDVALIDITY
+	idx, err = OpenSortIndex(path, 43)
+	if err != nil {
+		t.Fatal("Expected no error while opening index but got:", err)
+	}
+	if idx.Valid() || idx.Len() != 0 {
+		t.Error("Index with another UIDVALIDITY should need a rebuild")
+	}
+	idx.Close()
+}
+
+func TestSortIndexCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sortthread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "index")
+
+	idx, err := OpenSortIndex(path, 1)
+	if err != nil {
+		t.Fatal("Expected no error while opening index but got:", err)
+	}
+	if err := idx.Rebuild(sortIndexMessages); err != nil {
+		t.Fatal("Expected no error while rebuilding index but got:", err)
+	}
+	idx.Close()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-10] ^= 0xFF
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err = OpenSortIndex(path, 1)
+	if err != nil {
+		t.Fatal("Expected no error while opening index but got:", err)
+	}
+	defer idx.Close()
+	if idx.Valid() {
+		t.Error("Corrupted index should need a rebuild")
+	}
+}
+
+func TestSortIndexInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sortthread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	idx, err := OpenSortIndex(filepath.Join(dir, "index"), 1)
+	if err != nil {
+		t.Fatal("Expected no error while opening index but got:", err)
+	}
+	defer idx.Close()
+
+	if _, err := idx.Sort(nil, nil); err != ErrSortIndexInvalid {
+		t.Errorf("Expected ErrSortIndexInvalid but got: %v", err)
+	}
+}
+
+func TestSortIndexCompactError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sortthread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "index")
+
+	idx, err := OpenSortIndex(path, 1)
+	if err != nil {
+		t.Fatal("Expected no error while opening index but got:", err)
+	}
+	var logs bytes.Buffer
+	idx.ErrorLog = log.New(&logs, "", 0)
+	if err := idx.Rebuild(sortIndexMessages[:1]); err != nil {
+		t.Fatal("Expected no error while rebuilding index but got:", err)
+	}
+
+	// Prevent the compacted file from being created
+	if err := os.Mkdir(path+".tmp", 0700); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1100; i++ {
+		if err := idx.Add(sortIndexMessages[0]); err != nil {
+			t.Fatal("Expected no error while adding message but got:", err)
+		}
+	}
+	if logs.Len() == 0 {
+		t.Error("Expected the compaction error to be logged")
+	}
+	if idx.records <= 1024 {
+		t.Errorf("Expected the index not to be compacted, got %v records", idx.records)
+	}
+
+	if err := os.Remove(path + ".tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Close(); err != nil {
+		t.Fatal("Expected no error while closing index but got:", err)
+	}
+	if idx.records != 1 {
+		t.Errorf("Expected the index to be compacted on close, got %v records", idx.records)
+	}
+
+	idx, err = OpenSortIndex(path, 1)
+	if err != nil {
+		t.Fatal("Expected no error while opening index but got:", err)
+	}
+	defer idx.Close()
+	if !idx.Valid() || idx.Len() != 1 || idx.records != 1 {
+		t.Errorf("Expected a valid compacted index with 1 message, got %v messages in %v records", idx.Len(), idx.records)
+	}
+}
+
+func TestSortIndexTimes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sortthread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "index")
+
+	dates := []time.Time{
+		{},
+		time.Unix(0, 0).UTC(),
+		time.Date(1601, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2500, 6, 1, 12, 0, 0, 123456789, time.UTC),
+	}
+
+	idx, err := OpenSortIndex(path, 1)
+	if err != nil {
+		t.Fatal("Expected no error while opening index but got:", err)
+	}
+	var messages []*imap.Message
+	for i, date := range dates {
+		messages = append(messages, newTestSortMessage(uint32(i)+1, date, "", "", 0))
+	}
+	if err := idx.Rebuild(messages); err != nil {
+		t.Fatal("Expected no error while rebuilding index but got:", err)
+	}
+	idx.Close()
+
+	idx, err = OpenSortIndex(path, 1)
+	if err != nil {
+		t.Fatal("Expected no error while opening index but got:", err)
+	}
+	defer idx.Close()
+	if !idx.Valid() {
+		t.Fatal("Index should be valid")
+	}
+
+	for i, date := range dates {
+		keys := idx.keys[uint32(i)+1]
+		if !keys.Date.Equal(date) || keys.Date.IsZero() != date.IsZero() {
+			t.Errorf("Date of message %v: got %v, expected %v", i+1, keys.Date, date)
+		}
+		if !keys.Arrival.Equal(date) || keys.Arrival.IsZero() != date.IsZero() {
+			t.Errorf("Arrival of message %v: got %v, expected %v", i+1, keys.Arrival, date)
+		}
+	}
+
+	uids, err := idx.Sort([]uint32{1, 2, 3, 4}, []SortCriterion{{Field: SortArrival}})
+	if err != nil {
+		t.Fatal("Expected no error while sorting but got:", err)
+	}
+	if expected := []uint32{1, 3, 2, 4}; !reflect.DeepEqual(uids, expected) {
+		t.Errorf("Sorting by arrival: got %v, expected %v", uids, expected)
+	}
+}
@@ -0,0 +1,322 @@
+package sortthread
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+)
+
+// SortKeys contains the values used to compare messages for SORT, as defined
+// in RFC 5256 section 3. Backends with their own storage can persist them and
+// compare them with CompareSortKeys.
+//
+// Strings are folded for comparison, and dates are in UTC.
+type SortKeys struct {
+	// Id is used to break ties, it's the sequence number or the UID.
+	Id      uint32
+	Arrival time.Time
+	Date    time.Time
+	Size    uint32
+	// The base subject, see GetBaseSubject.
+	Subject string
+	// The mailbox name (the local part) of the first address.
+	From string
+	To   string
+	Cc   string
+
+	ModSeq      uint64
+	SaveDate    time.Time
+	Annotations map[AnnotationSortKey]string
+	Relevancy   uint32
+}
+
+// Fetch items used by sort keys defined in other extensions.
+const (
+	fetchModSeq     imap.FetchItem = "MODSEQ"
+	fetchSaveDate   imap.FetchItem = "SAVEDATE"
+	fetchAnnotation imap.FetchItem = "ANNOTATION"
+	fetchRelevancy  imap.FetchItem = "RELEVANCY"
+)
+
+func parseUint64Item(v interface{}) (uint64, bool) {
+	switch v := v.(type) {
+	case []interface{}:
+		// MODSEQ is returned as a list, e.g. "MODSEQ (42)"
+		if len(v) != 1 {
+			return 0, false
+		}
+		return parseUint64Item(v[0])
+	case uint64:
+		return v, true
+	case uint32:
+		return uint64(v), true
+	case string:
+		n, err := strconv.ParseUint(v, 10, 64)
+		return n, err == nil
+	case imap.RawString:
+		return parseUint64Item(string(v))
+	}
+	return 0, false
+}
+
+func parseTimeItem(v interface{}) (time.Time, bool) {
+	switch v := v.(type) {
+	case time.Time:
+		return v, true
+	case string:
+		t, err := time.Parse(imap.DateTimeLayout, v)
+		return t, err == nil
+	}
+	return time.Time{}, false
+}
+
+// parseAnnotationItem parses an ANNOTATION fetch item, e.g.
+// "ANNOTATION (/comment (value.priv "My comment"))".
+func parseAnnotationItem(v interface{}) map[AnnotationSortKey]string {
+	fields, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	annotations := make(map[AnnotationSortKey]string)
+	for i := 0; i+1 < len(fields); i += 2 {
+		entry, err := imap.ParseString(fields[i])
+		if err != nil {
+			continue
+		}
+		attrs, ok := fields[i+1].([]interface{})
+		if !ok {
+			continue
+		}
+		for j := 0; j+1 < len(attrs); j += 2 {
+			attr, err := imap.ParseString(attrs[j])
+			if err != nil {
+				continue
+			}
+			value, _ := imap.ParseString(attrs[j+1])
+			annotations[AnnotationSortKey{entry, strings.ToLower(attr)}] = value
+		}
+	}
+	return annotations
+}
+
+// foldSortKey folds a string for comparison. This approximates the
+// i;unicode-casemap collation required by RFC 5256.
+func foldSortKey(s string) string {
+	return strings.ToLower(s)
+}
+
+func addressSortKey(addrs []*imap.Address) string {
+	if len(addrs) == 0 {
+		return ""
+	}
+	return foldSortKey(addrs[0].MailboxName)
+}
+
+// DateHeaderSection is the body section containing the Date header field,
+// i.e. BODY.PEEK[HEADER.FIELDS (Date)]. See ExtractSortKeys.
+var DateHeaderSection = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{
+		Specifier: imap.HeaderSpecifier,
+		Fields:    []string{"Date"},
+	},
+	Peek: true,
+}
+
+// dateHeader returns the raw Date header field of a message, if the message
+// contains DateHeaderSection. The section is replaced so that it can still be
+// read by the caller.
+func dateHeader(msg *imap.Message) (string, bool) {
+	section := *DateHeaderSection
+	section.Peek = false
+	for s, lit := range msg.Body {
+		if !section.Equal(s) || lit == nil {
+			continue
+		}
+		b, err := ioutil.ReadAll(lit)
+		msg.Body[s] = bytes.NewReader(b)
+		if err != nil {
+			return "", false
+		}
+		h, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(b)))
+		if err != nil {
+			return "", false
+		}
+		return h.Get("Date"), true
+	}
+	return "", false
+}
+
+// sentDate returns the sent date of a message, in UTC. See ExtractSortKeys.
+func sentDate(msg *imap.Message) time.Time {
+	if header, ok := dateHeader(msg); ok {
+		return DefaultDatePolicy.SentDate(header, msg.InternalDate)
+	}
+	if msg.Envelope != nil && DefaultDatePolicy.Plausible(msg.Envelope.Date, msg.InternalDate) {
+		return msg.Envelope.Date.UTC()
+	}
+	// If the sent date can't be determined or is implausible, use the
+	// internal date
+	return msg.InternalDate.UTC()
+}
+
+// ExtractSortKeys computes the sort keys of a message. The message should
+// contain the envelope, the internal date, the size and the items used by sort
+// keys defined in other extensions.
+//
+// If the message contains DateHeaderSection, the date is parsed leniently from
+// the raw Date header field with DefaultDatePolicy.SentDate. Otherwise, the
+// envelope date is used. In both cases, the date falls back to the internal
+// date if it's missing, invalid or implausible according to
+// DefaultDatePolicy.
+//
+// The ID is set to the message UID. Callers sorting by sequence number should
+// overwrite it.
+func ExtractSortKeys(msg *imap.Message) *SortKeys {
+	keys := &SortKeys{
+		Id:      msg.Uid,
+		Arrival: msg.InternalDate.UTC(),
+		Date:    sentDate(msg),
+		Size:    msg.Size,
+	}
+	if msg.Envelope != nil {
+		subject, _ := GetBaseSubject(msg.Envelope.Subject)
+		keys.Subject = foldSortKey(subject)
+		keys.From = addressSortKey(msg.Envelope.From)
+		keys.To = addressSortKey(msg.Envelope.To)
+		keys.Cc = addressSortKey(msg.Envelope.Cc)
+	}
+	if v, ok := msg.Items[fetchModSeq]; ok {
+		keys.ModSeq, _ = parseUint64Item(v)
+	}
+	if v, ok := msg.Items[fetchSaveDate]; ok {
+		if t, ok := parseTimeItem(v); ok {
+			keys.SaveDate = t.UTC()
+		}
+	}
+	// RFC 8514: if the save date is unknown, the internal date is used
+	if keys.SaveDate.IsZero() {
+		keys.SaveDate = keys.Arrival
+	}
+	if v, ok := msg.Items[fetchAnnotation]; ok {
+		keys.Annotations = parseAnnotationItem(v)
+	}
+	if v, ok := msg.Items[fetchRelevancy]; ok {
+		n, _ := parseUint64Item(v)
+		keys.Relevancy = uint32(n)
+	}
+	return keys
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+func compareUint32(a, b uint32) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareUint64(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// CompareSortKeys compares two messages according to the sort criteria. Ties
+// are broken by ID. It returns a negative number if a sorts before b, a
+// positive number if a sorts after b, and zero if they're equal.
+func CompareSortKeys(a, b *SortKeys, criteria []SortCriterion) int {
+	if cmp := compareSortCriteria(a, b, criteria); cmp != 0 {
+		return cmp
+	}
+	return compareUint32(a.Id, b.Id)
+}
+
+// compareSortCriteria is like CompareSortKeys, but doesn't break ties.
+func compareSortCriteria(a, b *SortKeys, criteria []SortCriterion) int {
+	for _, c := range criteria {
+		var cmp int
+		switch c.Field {
+		case SortArrival:
+			cmp = compareTimes(a.Arrival, b.Arrival)
+		case SortDate:
+			cmp = compareTimes(a.Date, b.Date)
+		case SortSize:
+			cmp = compareUint32(a.Size, b.Size)
+		case SortSubject:
+			cmp = strings.Compare(a.Subject, b.Subject)
+		case SortFrom:
+			cmp = strings.Compare(a.From, b.From)
+		case SortTo:
+			cmp = strings.Compare(a.To, b.To)
+		case SortCc:
+			cmp = strings.Compare(a.Cc, b.Cc)
+		case SortModSeq:
+			cmp = compareUint64(a.ModSeq, b.ModSeq)
+		case SortSaveDate:
+			cmp = compareTimes(a.SaveDate, b.SaveDate)
+		case SortAnnotation:
+			if c.Annotation != nil {
+				k := AnnotationSortKey{c.Annotation.Entry, strings.ToLower(c.Annotation.Attribute)}
+				cmp = strings.Compare(foldSortKey(a.Annotations[k]), foldSortKey(b.Annotations[k]))
+			}
+		case SortRelevancy:
+			cmp = compareUint32(a.Relevancy, b.Relevancy)
+		}
+		if c.Reverse {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp
+		}
+	}
+	return 0
+}
+
+// SortMessages sorts messages according to the sort criteria, as defined in
+// RFC 5256. The messages must contain the envelope, the internal date, the
+// size and the items used by sort keys defined in other extensions. If uid is
+// true, the UIDs of the messages are returned, otherwise their sequence
+// numbers.
+func SortMessages(messages []*imap.Message, uid bool, criteria []SortCriterion) []uint32 {
+	keys := make([]*SortKeys, len(messages))
+	for i, msg := range messages {
+		keys[i] = ExtractSortKeys(msg)
+		if !uid {
+			keys[i].Id = msg.SeqNum
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return CompareSortKeys(keys[i], keys[j], criteria) < 0
+	})
+
+	ids := make([]uint32, len(keys))
+	for i, k := range keys {
+		ids[i] = k.Id
+	}
+	return ids
+}
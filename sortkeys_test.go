@@ -0,0 +1,110 @@
+package sortthread
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+func newSortKeysTestMessage(uid uint32, date time.Time, subject, from string) *imap.Message {
+	msg := imap.NewMessage(uid, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchInternalDate, imap.FetchRFC822Size})
+	msg.Uid = uid + 100
+	msg.InternalDate = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(uid) * time.Hour)
+	msg.Size = 1000 - uid
+	msg.Envelope = &imap.Envelope{
+		Date:    date,
+		Subject: subject,
+		From:    []*imap.Address{{PersonalName: "Someone", MailboxName: from, HostName: "example.org"}},
+	}
+	return msg
+}
+
+func TestExtractSortKeys(t *testing.T) {
+	date := time.Date(2020, 1, 2, 12, 0, 0, 0, time.FixedZone("", 2*60*60))
+	msg := newSortKeysTestMessage(1, date, "Re: =?UTF-8?Q?Caf=C3=A9?= menu (fwd)", "Alice")
+	msg.Envelope.To = []*imap.Address{
+		{MailboxName: "Bob", HostName: "example.org"},
+		{MailboxName: "carol", HostName: "example.org"},
+	}
+
+	keys := ExtractSortKeys(msg)
+	expected := &SortKeys{
+		Id:       101,
+		Arrival:  msg.InternalDate,
+		Date:     time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC),
+		Size:     999,
+		Subject:  "café menu",
+		From:     "alice",
+		To:       "bob",
+		SaveDate: msg.InternalDate,
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Invalid sort keys: got %+v, expected %+v", keys, expected)
+	}
+
+	// The internal date is used when the sent date is missing
+	msg = newSortKeysTestMessage(2, time.Time{}, "", "bob")
+	if keys := ExtractSortKeys(msg); !keys.Date.Equal(msg.InternalDate) {
+		t.Errorf("Invalid fallback date: got %v, expected %v", keys.Date, msg.InternalDate)
+	}
+
+	// So is it when the sent date is implausible
+	msg = newSortKeysTestMessage(3, time.Date(2038, 1, 1, 0, 0, 0, 0, time.UTC), "", "bob")
+	if keys := ExtractSortKeys(msg); !keys.Date.Equal(msg.InternalDate) {
+		t.Errorf("Invalid fallback date: got %v, expected %v", keys.Date, msg.InternalDate)
+	}
+}
+
+func TestExtractSortKeysDateHeader(t *testing.T) {
+	// The envelope date couldn't be parsed strictly
+	msg := newSortKeysTestMessage(1, time.Time{}, "", "bob")
+	section := *DateHeaderSection
+	section.Peek = false
+	header := "Date: Thursday, 2 January 2020 12:00:00 GMT+2\r\n\r\n"
+	msg.Body = map[*imap.BodySectionName]imap.Literal{
+		&section: bytes.NewBufferString(header),
+	}
+
+	keys := ExtractSortKeys(msg)
+	if expected := time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC); !keys.Date.Equal(expected) {
+		t.Errorf("Invalid date: got %v, expected %v", keys.Date, expected)
+	}
+	if b, _ := ioutil.ReadAll(msg.GetBody(DateHeaderSection)); string(b) != header {
+		t.Errorf("Invalid body section after extracting sort keys: got %q, expected %q", b, header)
+	}
+
+	// The header section takes precedence over the envelope
+	msg = newSortKeysTestMessage(2, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), "", "bob")
+	msg.Body = map[*imap.BodySectionName]imap.Literal{
+		&section: bytes.NewBufferString("\r\n"),
+	}
+	if keys := ExtractSortKeys(msg); !keys.Date.Equal(msg.InternalDate) {
+		t.Errorf("Invalid fallback date: got %v, expected %v", keys.Date, msg.InternalDate)
+	}
+}
+
+func TestCompareSortKeys(t *testing.T) {
+	date := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	a := ExtractSortKeys(newSortKeysTestMessage(1, date, "Hello", "bob"))
+	b := ExtractSortKeys(newSortKeysTestMessage(2, date, "Re: hello", "Alice"))
+
+	tests := []struct {
+		criteria []SortCriterion
+		expected int
+	}{
+		{[]SortCriterion{{Field: SortSubject}}, -1},
+		{[]SortCriterion{{Field: SortFrom}}, 1},
+		{[]SortCriterion{{Field: SortFrom, Reverse: true}}, -1},
+		{[]SortCriterion{{Field: SortSize}}, 1},
+		{[]SortCriterion{{Field: SortDate}, {Field: SortArrival, Reverse: true}}, 1},
+	}
+	for _, test := range tests {
+		if cmp := CompareSortKeys(a, b, test.criteria); cmp != test.expected {
+			t.Errorf("CompareSortKeys(%v) = %v, expected %v", test.criteria, cmp, test.expected)
+		}
+	}
+}
@@ -1,10 +1,20 @@
 // Package sortthread implements SORT and THREAD for go-imap.
 //
 // SORT and THREAD are defined in RFC 5256.
+//
+// # Clients
+//
+// SortClient and ThreadClient send one command at a time per connection.
+// Commands aren't pipelined, since the go-imap v1 client doesn't allow it:
+// Client.Execute writes a command and blocks until its tagged response, it
+// isn't safe for concurrent use, and untagged responses such as SORT and
+// THREAD carry no tag, so they can't be routed to the command which caused
+// them. Concurrent commands are serialized instead, see Conn.
 package sortthread
 
 import (
 	"fmt"
+	"mime"
 	"regexp"
 	"strings"
 
@@ -13,6 +23,10 @@ import (
 
 const SortCapability = "SORT"
 
+// MultiSortCapability is the capability of the multi-mailbox SORT extension.
+// This is a vendor extension, modeled on RFC 7377.
+const MultiSortCapability = "X-MULTISORT"
+
 var ThreadCapabilities = []string{"THREAD=ORDEREDSUBJECT", "THREAD=REF", "THREAD=REFERENCES"}
 
 // ThreadAlgorithm is the algorithm used by the server to sort messages
@@ -23,6 +37,11 @@ const (
 	References                     = "REFERENCES"
 )
 
+// ReferencesNoSubject is a vendor threading algorithm: REFERENCES without
+// merging threads by subject, see ReferencesOptions.NoSubjectGathering.
+// Backends supporting it list it in ThreadBackend.SupportedThreadAlgorithms.
+const ReferencesNoSubject ThreadAlgorithm = "X-REFERENCES-NOSUBJECT"
+
 func formatThreadAlgorithm(algorithm ThreadAlgorithm) imap.RawString {
 	return imap.RawString(algorithm)
 }
@@ -40,10 +59,42 @@ const (
 	SortTo                = "TO"
 )
 
+// Sort fields defined by other extensions.
+const (
+	// SortModSeq sorts by modification sequence, see RFC 7162.
+	SortModSeq SortField = "MODSEQ"
+	// SortSaveDate sorts by save date, see RFC 8514.
+	SortSaveDate SortField = "SAVEDATE"
+	// SortAnnotation sorts by annotation value, see RFC 5257. The
+	// annotation is specified in SortCriterion.Annotation.
+	SortAnnotation SortField = "ANNOTATION"
+	// SortRelevancy sorts by fuzzy search relevancy score, see RFC 6203.
+	SortRelevancy SortField = "RELEVANCY"
+)
+
+// sortFieldCapabilities contains the capabilities required by sort fields not
+// defined in RFC 5256.
+var sortFieldCapabilities = map[SortField]string{
+	SortModSeq:     "CONDSTORE",
+	SortSaveDate:   "SAVEDATE",
+	SortAnnotation: "ANNOTATE-EXPERIMENT-1",
+	SortRelevancy:  "SEARCH=FUZZY",
+}
+
+// AnnotationSortKey is the annotation used by SortAnnotation.
+type AnnotationSortKey struct {
+	// The annotation entry, e.g. "/comment".
+	Entry string
+	// The attribute, e.g. "value.priv" or "value.shared".
+	Attribute string
+}
+
 // SortCriterion is a criterion that can be used to sort messages.
 type SortCriterion struct {
 	Field   SortField
 	Reverse bool
+	// The annotation, if Field is SortAnnotation.
+	Annotation *AnnotationSortKey
 }
 
 func formatSortCriteria(criteria []SortCriterion) interface{} {
@@ -53,16 +104,32 @@ func formatSortCriteria(criteria []SortCriterion) interface{} {
 			fields = append(fields, imap.RawString("REVERSE"))
 		}
 		fields = append(fields, imap.RawString(c.Field))
+		if c.Field == SortAnnotation && c.Annotation != nil {
+			fields = append(fields, c.Annotation.Entry, c.Annotation.Attribute)
+		}
 	}
 	return fields
 }
 
+// MailboxUid identifies a message in a mailbox.
+type MailboxUid struct {
+	Mailbox     string
+	UidValidity uint32
+	Uid         uint32
+}
+
+// Thread is a message and its replies.
+//
+// Id is zero for a dummy thread root, which groups threads sharing the same
+// base subject when no actual message is their common parent.
 type Thread struct {
 	Id       uint32
 	Children []*Thread
 }
 
 var (
+	subjectDecoder = new(mime.WordDecoder)
+
 	tabsContinuation = regexp.MustCompile(`[\t\\]`)
 	repeatedSpaces   = regexp.MustCompile("[ ]+")
 
@@ -75,7 +142,10 @@ var (
 
 	// BLOBCHAR        = %x01-5a / %x5c / %x5e-ff
 	// subj-blob       = "[" *BLOBCHAR "]" *WSP
-	subjBlob       = `\[\x01-\x5a\x5c\x5e-\xff]\]\s*`
+	//
+	// BLOBCHAR is any octet but NUL, "[" and "]". Subjects are decoded to
+	// UTF-8, so it's matched as any character but these.
+	subjBlob       = `\[[^\x00\[\]]*\]\s*`
 	subjBlobPrefix = regexp.MustCompile(fmt.Sprintf("^%s", subjBlob))
 
 	// subj-refwd      = ("re" / ("fw" ["d"])) *WSP [subj-blob] ":"
@@ -145,6 +215,9 @@ func GetBaseSubject(subject string) (string, bool) {
 	// as described in "Internationalization Considerations".
 	// Convert all tabs and continuations to space.  Convert all
 	// multiple spaces to a single space.
+	if decoded, err := subjectDecoder.DecodeHeader(baseSubject); err == nil {
+		baseSubject = decoded
+	}
 	baseSubject = tabsContinuation.ReplaceAllString(baseSubject, " ")
 	baseSubject = repeatedSpaces.ReplaceAllString(baseSubject, " ")
 
@@ -156,10 +229,8 @@ func GetBaseSubject(subject string) (string, bool) {
 		// ends with the subj-fwd-trl ABNF, remove the subj-fwd-hdr and
 		// subj-fwd-trl and repeat from step (2).
 		submatches := subjFwd.FindStringSubmatch(baseSubject)
-		if len(submatches) == 0 {
+		if len(submatches) != 2 {
 			break
-		} else if len(submatches) != 2 {
-			panic(fmt.Errorf("Regex undefined behavior on subject %s", baseSubject))
 		}
 		baseSubject = submatches[1]
 		isReplyFwd = true
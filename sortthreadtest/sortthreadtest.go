@@ -0,0 +1,361 @@
+// Package sortthreadtest provides a conformance test suite for SORT and THREAD
+// backends.
+//
+// Backends adopt it by providing a function creating a mailbox from a list of
+// messages:
+//
+//	func TestSort(t *testing.T) {
+//		sortthreadtest.TestSort(t, newTestMailbox)
+//	}
+//
+// The messages in the corpus exercise RFC 5256 edge cases: missing and
+// invalid Date headers, encoded subjects, multiple From addresses, reference
+// loops, duplicate Message-IDs and "[fwd: ...]" subjects.
+package sortthreadtest
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap-sortthread"
+	"github.com/emersion/go-imap/backend"
+)
+
+// Message is a message of the test corpus.
+type Message struct {
+	// The internal date.
+	Date time.Time
+	// The raw message, with CRLF line endings.
+	Body []byte
+}
+
+// MailboxFactory creates a mailbox containing messages. The sequence number of
+// messages[i] must be i+1. UIDs may be arbitrary.
+type MailboxFactory func(t *testing.T, messages []*Message) backend.Mailbox
+
+func newMessage(day int, header ...string) *Message {
+	body := strings.Join(header, "\r\n") + "\r\n\r\n" + "Message " + strconv.Itoa(day) + ".\r\n"
+	return &Message{
+		Date: time.Date(2020, 1, day, 12, 0, 0, 0, time.UTC),
+		Body: []byte(body),
+	}
+}
+
+// Corpus returns the messages used by the test suite, in mailbox order.
+func Corpus() []*Message {
+	return []*Message{
+		newMessage(1,
+			"Message-Id: <1@example.org>",
+			"Date: Sun, 05 Jan 2020 10:00:00 +0000",
+			`From: "Zed" <zed@example.org>`,
+			"To: bob@example.org",
+			"Subject: Project kickoff"),
+		// No Date header: the internal date is used
+		newMessage(2,
+			"Message-Id: <2@example.org>",
+			"From: alice@example.org",
+			"To: Bob <bob@example.org>",
+			"Cc: carol@example.org",
+			"Subject: Re: Project kickoff",
+			"In-Reply-To: <1@example.org>",
+			"References: <1@example.org>"),
+		newMessage(3,
+			"Message-Id: <3@example.org>",
+			"Date: Fri, 03 Jan 2020 09:00:00 -0500",
+			"From: =?UTF-8?Q?Ren=C3=A9?= <rene@example.org>",
+			"To: dave@example.org",
+			"Subject: =?UTF-8?Q?Caf=C3=A9_menu?="),
+		// Multiple From addresses: the first one is used
+		newMessage(4,
+			"Message-Id: <4@example.org>",
+			"Date: Sat, 04 Jan 2020 08:00:00 +0000",
+			"From: Carol <carol@example.org>, Alice <alice@example.org>",
+			"To: zoe@example.org",
+			"Subject: [fwd: =?UTF-8?Q?Caf=C3=A9?= menu]"),
+		// Reference loop between messages 5 and 6
+		newMessage(5,
+			"Message-Id: <5@example.org>",
+			"Date: Mon, 06 Jan 2020 12:00:00 +0000",
+			"From: mallory@example.org",
+			"To: alice@example.org",
+			"Subject: Loop",
+			"References: <6@example.org>"),
+		newMessage(6,
+			"Message-Id: <6@example.org>",
+			"Date: Tue, 07 Jan 2020 12:00:00 +0000",
+			"From: mallory@example.org",
+			"To: alice@example.org",
+			"Subject: Re: Loop",
+			"References: <5@example.org>"),
+		// Duplicate Message-ID: treated as if the message had none
+		newMessage(7,
+			"Message-Id: <1@example.org>",
+			"Date: Wed, 08 Jan 2020 12:00:00 +0000",
+			"From: bob@example.org",
+			"Subject: Duplicate"),
+		newMessage(8,
+			"Message-Id: <8@example.org>",
+			"Date: Thu, 09 Jan 2020 12:00:00 +0000",
+			"From: bob@example.org",
+			"To: carol@example.org",
+			"Cc: alice@example.org",
+			"Subject: Re: Project kickoff",
+			"In-Reply-To: <1@example.org>"),
+		newMessage(9,
+			"Message-Id: <9@example.org>",
+			"Date: Fri, 10 Jan 2020 10:00:00 +0000",
+			"From: eve@example.org",
+			"Subject: Re: re: Fwd: Lunch (fwd)"),
+		// Invalid Date header: the internal date is used
+		newMessage(10,
+			"Message-Id: <10@example.org>",
+			"Date: not a date",
+			"From: frank@example.org",
+			"To: bob@example.org",
+			"Subject: Lunch"),
+		// Unrelated messages with the same subject: grouped under a dummy
+		newMessage(11,
+			"Message-Id: <11@example.org>",
+			"Date: Sat, 11 Jan 2020 12:00:00 +0000",
+			"From: grace@example.org",
+			"Subject: Status report"),
+		newMessage(12,
+			"Message-Id: <12@example.org>",
+			"Date: Sat, 11 Jan 2020 12:00:00 +0000",
+			"From: heidi@example.org",
+			"Subject: Status report"),
+	}
+}
+
+type sortTest struct {
+	name         string
+	sortCriteria []sortthread.SortCriterion
+	seqSet       string
+	expected     []uint32
+}
+
+var sortTests = []sortTest{
+	{
+		name:         "arrival",
+		sortCriteria: []sortthread.SortCriterion{{Field: sortthread.SortArrival}},
+		expected:     []uint32{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+	},
+	{
+		name:         "reverse_arrival",
+		sortCriteria: []sortthread.SortCriterion{{Field: sortthread.SortArrival, Reverse: true}},
+		expected:     []uint32{12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+	},
+	{
+		name:         "date",
+		sortCriteria: []sortthread.SortCriterion{{Field: sortthread.SortDate}},
+		expected:     []uint32{2, 3, 4, 1, 5, 6, 7, 8, 9, 10, 11, 12},
+	},
+	{
+		// Ties are still broken by ascending sequence number
+		name:         "reverse_date",
+		sortCriteria: []sortthread.SortCriterion{{Field: sortthread.SortDate, Reverse: true}},
+		expected:     []uint32{11, 12, 10, 9, 8, 7, 6, 5, 1, 4, 3, 2},
+	},
+	{
+		name:         "subject",
+		sortCriteria: []sortthread.SortCriterion{{Field: sortthread.SortSubject}},
+		expected:     []uint32{3, 4, 7, 5, 6, 9, 10, 1, 2, 8, 11, 12},
+	},
+	{
+		name:         "from",
+		sortCriteria: []sortthread.SortCriterion{{Field: sortthread.SortFrom}},
+		expected:     []uint32{2, 7, 8, 4, 9, 10, 11, 12, 5, 6, 3, 1},
+	},
+	{
+		name:         "to",
+		sortCriteria: []sortthread.SortCriterion{{Field: sortthread.SortTo}},
+		expected:     []uint32{7, 9, 11, 12, 5, 6, 1, 2, 10, 8, 3, 4},
+	},
+	{
+		name:         "cc",
+		sortCriteria: []sortthread.SortCriterion{{Field: sortthread.SortCc}},
+		expected:     []uint32{1, 3, 4, 5, 6, 7, 9, 10, 11, 12, 8, 2},
+	},
+	{
+		name:         "size",
+		sortCriteria: []sortthread.SortCriterion{{Field: sortthread.SortSize}},
+		expected:     []uint32{7, 10, 11, 12, 9, 1, 5, 6, 3, 2, 4, 8},
+	},
+	{
+		name: "subject_reverse_date",
+		sortCriteria: []sortthread.SortCriterion{
+			{Field: sortthread.SortSubject},
+			{Field: sortthread.SortDate, Reverse: true},
+		},
+		expected: []uint32{4, 3, 7, 6, 5, 10, 9, 8, 1, 2, 11, 12},
+	},
+	{
+		name:         "search",
+		sortCriteria: []sortthread.SortCriterion{{Field: sortthread.SortDate}},
+		seqSet:       "1:5",
+		expected:     []uint32{2, 3, 4, 1, 5},
+	},
+}
+
+// Expected REFERENCES threads, in the format of the THREAD response.
+const expectedReferences = "(3 4)(1 (2)(8))(6 5)(7)(10 9)((11)(12))"
+
+// listUids returns the UIDs of the messages in a mailbox, indexed by sequence
+// number minus one.
+func listUids(t *testing.T, mbox backend.Mailbox, n int) []uint32 {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(1, uint32(n))
+
+	ch := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- mbox.ListMessages(false, seqSet, []imap.FetchItem{imap.FetchUid}, ch)
+	}()
+	uids := make([]uint32, n)
+	for msg := range ch {
+		if msg.SeqNum >= 1 && int(msg.SeqNum) <= n {
+			uids[msg.SeqNum-1] = msg.Uid
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal("Expected no error while listing messages but got:", err)
+	}
+	return uids
+}
+
+func mapUids(uids []uint32, seqNums []uint32) []uint32 {
+	l := make([]uint32, len(seqNums))
+	for i, seqNum := range seqNums {
+		l[i] = uids[seqNum-1]
+	}
+	return l
+}
+
+func formatIds(ids []uint32) string {
+	l := make([]string, len(ids))
+	for i, id := range ids {
+		l[i] = strconv.FormatUint(uint64(id), 10)
+	}
+	return strings.Join(l, " ")
+}
+
+// formatThreads formats threads like a THREAD response, with IDs converted
+// by f.
+func formatThreads(threads []*sortthread.Thread, f func(uint32) uint32) string {
+	var s string
+	for _, t := range threads {
+		s += formatThread(t, f)
+	}
+	return s
+}
+
+func formatThread(t *sortthread.Thread, f func(uint32) uint32) string {
+	s := "("
+	if t.Id != 0 {
+		s += strconv.FormatUint(uint64(f(t.Id)), 10)
+	}
+	for len(t.Children) == 1 && t.Id != 0 {
+		t = t.Children[0]
+		s += " " + strconv.FormatUint(uint64(f(t.Id)), 10)
+	}
+	if len(t.Children) > 0 && s != "(" {
+		s += " "
+	}
+	for _, c := range t.Children {
+		s += formatThread(c, f)
+	}
+	return s + ")"
+}
+
+// TestSort checks that the mailboxes created by newMailbox implement
+// sortthread.SortMailbox according to RFC 5256.
+func TestSort(t *testing.T, newMailbox MailboxFactory) {
+	messages := Corpus()
+
+	for _, test := range sortTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			mbox, ok := newMailbox(t, messages).(sortthread.SortMailbox)
+			if !ok {
+				t.Fatal("Mailbox doesn't implement SortMailbox")
+			}
+			uids := listUids(t, mbox, len(messages))
+
+			searchCriteria := imap.NewSearchCriteria()
+			if test.seqSet != "" {
+				seqSet, err := imap.ParseSeqSet(test.seqSet)
+				if err != nil {
+					t.Fatal(err)
+				}
+				searchCriteria.SeqNum = seqSet
+			}
+
+			ids, err := mbox.Sort(false, test.sortCriteria, searchCriteria)
+			if err != nil {
+				t.Fatal("Expected no error while sorting but got:", err)
+			}
+			if got, want := formatIds(ids), formatIds(test.expected); got != want {
+				t.Errorf("Invalid SORT result: got %v, expected %v", got, want)
+			}
+
+			ids, err = mbox.Sort(true, test.sortCriteria, searchCriteria)
+			if err != nil {
+				t.Fatal("Expected no error while sorting by UID but got:", err)
+			}
+			if got, want := formatIds(ids), formatIds(mapUids(uids, test.expected)); got != want {
+				t.Errorf("Invalid UID SORT result: got %v, expected %v", got, want)
+			}
+		})
+	}
+}
+
+// TestThread checks that the mailboxes created by newMailbox implement
+// sortthread.ThreadMailbox according to RFC 5256, with the REFERENCES
+// algorithm.
+func TestThread(t *testing.T, newMailbox MailboxFactory) {
+	messages := Corpus()
+
+	t.Run("references", func(t *testing.T) {
+		mbox, ok := newMailbox(t, messages).(sortthread.ThreadMailbox)
+		if !ok {
+			t.Fatal("Mailbox doesn't implement ThreadMailbox")
+		}
+
+		threads, err := mbox.Thread(false, sortthread.References, imap.NewSearchCriteria())
+		if err != nil {
+			t.Fatal("Expected no error while threading but got:", err)
+		}
+		got := formatThreads(threads, func(id uint32) uint32 {
+			return id
+		})
+		if got != expectedReferences {
+			t.Errorf("Invalid THREAD result: got %v, expected %v", got, expectedReferences)
+		}
+	})
+
+	t.Run("uid_references", func(t *testing.T) {
+		mbox, ok := newMailbox(t, messages).(sortthread.ThreadMailbox)
+		if !ok {
+			t.Fatal("Mailbox doesn't implement ThreadMailbox")
+		}
+		uids := listUids(t, mbox, len(messages))
+		seqNums := make(map[uint32]uint32, len(uids))
+		for i, uid := range uids {
+			seqNums[uid] = uint32(i) + 1
+		}
+
+		threads, err := mbox.Thread(true, sortthread.References, imap.NewSearchCriteria())
+		if err != nil {
+			t.Fatal("Expected no error while threading by UID but got:", err)
+		}
+		got := formatThreads(threads, func(uid uint32) uint32 {
+			return seqNums[uid]
+		})
+		if got != expectedReferences {
+			t.Errorf("Invalid UID THREAD result: got %v, expected %v", got, expectedReferences)
+		}
+	})
+}
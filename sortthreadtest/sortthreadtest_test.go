@@ -0,0 +1,149 @@
+package sortthreadtest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap-sortthread"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+)
+
+// referenceMailbox implements SORT and THREAD on top of the memory backend,
+// with the engines provided by the sortthread package.
+type referenceMailbox struct {
+	*memory.Mailbox
+
+	t *testing.T
+}
+
+func (mbox *referenceMailbox) search(uid bool, searchCrit *imap.SearchCriteria) ([]uint32, map[uint32]uint32) {
+	ids, err := mbox.SearchMessages(uid, searchCrit)
+	if err != nil {
+		mbox.t.Fatal(err)
+	}
+	// Maps UIDs to the IDs used in results
+	resultIds := make(map[uint32]uint32)
+	for i, msg := range mbox.Messages {
+		if uid {
+			resultIds[msg.Uid] = msg.Uid
+		} else {
+			resultIds[msg.Uid] = uint32(i) + 1
+		}
+	}
+	return ids, resultIds
+}
+
+func (mbox *referenceMailbox) Sort(uid bool, sortCrit []sortthread.SortCriterion, searchCrit *imap.SearchCriteria) ([]uint32, error) {
+	dir, err := ioutil.TempDir("", "sortthreadtest")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	idx, err := sortthread.OpenSortIndex(filepath.Join(dir, "index"), 1)
+	if err != nil {
+		return nil, err
+	}
+	defer idx.Close()
+
+	var messages []*imap.Message
+	for i, m := range mbox.Messages {
+		items := []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchInternalDate, imap.FetchRFC822Size}
+		msg, err := m.Fetch(uint32(i)+1, items)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	if err := idx.Rebuild(messages); err != nil {
+		return nil, err
+	}
+
+	ids, resultIds := mbox.search(uid, searchCrit)
+	if !uid {
+		// Convert sequence numbers to UIDs
+		for i, id := range ids {
+			ids[i] = mbox.Messages[id-1].Uid
+		}
+	}
+	sorted, err := idx.Sort(ids, sortCrit)
+	if err != nil {
+		return nil, err
+	}
+	for i, id := range sorted {
+		sorted[i] = resultIds[id]
+	}
+	return sorted, nil
+}
+
+func (mbox *referenceMailbox) Thread(uid bool, algorithm sortthread.ThreadAlgorithm, searchCrit *imap.SearchCriteria) ([]*sortthread.Thread, error) {
+	ids, _ := mbox.search(uid, searchCrit)
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	var messages []*sortthread.ThreadMessage
+	for i, m := range mbox.Messages {
+		id := uint32(i) + 1
+		if uid {
+			id = m.Uid
+		}
+		if n := sort.Search(len(ids), func(i int) bool { return ids[i] >= id }); n == len(ids) || ids[n] != id {
+			continue
+		}
+
+		msg, err := mail.ReadMessage(bytes.NewReader(m.Body))
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, &sortthread.ThreadMessage{
+			Id:         id,
+			Date:       sortthread.DefaultDatePolicy.SentDate(msg.Header.Get("Date"), m.Date),
+			Subject:    msg.Header.Get("Subject"),
+			MessageId:  msg.Header.Get("Message-Id"),
+			InReplyTo:  msg.Header.Get("In-Reply-To"),
+			References: msg.Header.Get("References"),
+		})
+	}
+	return sortthread.ThreadReferences(messages), nil
+}
+
+func newReferenceMailbox(t *testing.T, messages []*Message) backend.Mailbox {
+	be := memory.New()
+	user, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := user.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	memMbox := mbox.(*memory.Mailbox)
+	memMbox.Messages = nil
+	for i, msg := range messages {
+		memMbox.Messages = append(memMbox.Messages, &memory.Message{
+			// Make sure UIDs don't match sequence numbers
+			Uid:  uint32(100 + 3*i),
+			Date: msg.Date,
+			Size: uint32(len(msg.Body)),
+			Body: msg.Body,
+		})
+	}
+	return &referenceMailbox{Mailbox: memMbox, t: t}
+}
+
+func TestReferenceSort(t *testing.T) {
+	TestSort(t, newReferenceMailbox)
+}
+
+func TestReferenceThread(t *testing.T) {
+	TestThread(t, newReferenceMailbox)
+}
@@ -177,3 +177,54 @@ func TestThreadFormatting(t *testing.T) {
 		})
 	}
 }
+
+func TestThreadFormattingDummy(t *testing.T) {
+	threads := []*Thread{
+		&Thread{
+			Id: 0,
+			Children: []*Thread{
+				&Thread{Id: 3},
+				&Thread{Id: 5},
+			},
+		},
+	}
+	expected := []interface{}{
+		[]interface{}{
+			[]interface{}{imap.RawString("3")},
+			[]interface{}{imap.RawString("5")},
+		},
+	}
+
+	fields := formatThreadResp(threads)
+	if !reflect.DeepEqual(fields[1:], expected) {
+		t.Errorf("Could not format dummy thread properly")
+		t.Logf("Want: %#+v", expected)
+		t.Logf("Got:  %#+v", fields)
+	}
+}
+
+func TestThreadParsingMalformed(t *testing.T) {
+	// Not valid according to RFC 5256, but siblings must not be lost
+	response := []interface{}{
+		imap.RawString("1"),
+		[]interface{}{imap.RawString("2")},
+		imap.RawString("3"),
+	}
+	expected := []*Thread{
+		&Thread{
+			Id: 1,
+			Children: []*Thread{
+				&Thread{Id: 2},
+				&Thread{Id: 3},
+			},
+		},
+	}
+
+	threads, err := parseThreadResp(response)
+	if err != nil {
+		t.Fatal("Expected no error while parsing thread but got:", err)
+	}
+	if !reflect.DeepEqual(threads, expected) {
+		t.Errorf("Could not parse malformed thread properly")
+	}
+}
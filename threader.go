@@ -0,0 +1,824 @@
+package sortthread
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap-sortthread/msgid"
+)
+
+// ThreadMessage contains the message data needed by the REFERENCES threading
+// algorithm.
+type ThreadMessage struct {
+	// The message sequence number or UID.
+	Id uint32
+	// The sent date, see RFC 5256 section 2.2. Zero if it can't be determined.
+	// DatePolicy.SentDate computes it from the Date header field.
+	Date time.Time
+	// The internal date, used if Date is zero. Optional.
+	InternalDate time.Time
+	// The raw Subject header.
+	Subject string
+	// The raw Message-ID, In-Reply-To and References headers.
+	MessageId  string
+	InReplyTo  string
+	References string
+	// The addresses of the sender and recipients (From, To and Cc). Only used
+	// if ReferencesOptions.SameParticipants is set.
+	Participants []string
+}
+
+// ReferencesOptions contains options for the REFERENCES algorithm. They
+// restrict step 5, which merges threads whose base subjects match. The zero
+// value follows RFC 5256.
+type ReferencesOptions struct {
+	// If set, threads with the same base subject are never merged.
+	NoSubjectGathering bool
+	// If non-zero, threads are only merged if the dates of their first
+	// messages are at most SubjectWindow apart.
+	SubjectWindow time.Duration
+	// If set, threads are only merged if their messages have the same
+	// participants, compared case-insensitively.
+	SameParticipants bool
+}
+
+// ReferencesAlgorithmOptions returns the options of a REFERENCES-based
+// threading algorithm: REFERENCES or the vendor algorithm
+// X-REFERENCES-NOSUBJECT. ok is false for other algorithms.
+func ReferencesAlgorithmOptions(algorithm ThreadAlgorithm) (options *ReferencesOptions, ok bool) {
+	switch ThreadAlgorithm(strings.ToUpper(string(algorithm))) {
+	case References:
+		return nil, true
+	case ReferencesNoSubject:
+		return &ReferencesOptions{NoSubjectGathering: true}, true
+	}
+	return nil, false
+}
+
+type threadContainer struct {
+	msg         *ThreadMessage
+	baseSubject string
+	isReplyFwd  bool
+
+	parent   *threadContainer
+	children []*threadContainer
+
+	// The key in the ID table, empty if the container isn't in the table
+	id string
+	// The IDs of the messages whose step 1 used this container
+	msgs []uint32
+	// Set once the container is discarded by Threader.relink
+	removed bool
+}
+
+func (c *threadContainer) root() *threadContainer {
+	for c.parent != nil {
+		c = c.parent
+	}
+	return c
+}
+
+func (c *threadContainer) hasAncestor(ancestor *threadContainer) bool {
+	for p := c; p != nil; p = p.parent {
+		if p == ancestor {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *threadContainer) unlink() {
+	if c.parent == nil {
+		return
+	}
+	siblings := c.parent.children
+	for i, s := range siblings {
+		if s == c {
+			c.parent.children = append(siblings[:i:i], siblings[i+1:]...)
+			break
+		}
+	}
+	c.parent = nil
+}
+
+// link makes child a child of c, unless this would introduce a loop.
+func (c *threadContainer) link(child *threadContainer) {
+	if c.hasAncestor(child) {
+		return
+	}
+	child.unlink()
+	child.parent = c
+	c.children = append(c.children, child)
+}
+
+// Threader incrementally threads messages with the REFERENCES algorithm
+// defined in RFC 5256 section 3.
+//
+// Step 1 of the algorithm, which links messages with their references, is
+// only performed for the messages related to an added or removed message.
+// Adding a message with an ID greater than all others only links this
+// message. Steps 2 to 6 are only performed again for the threads which
+// changed, and for the threads sharing their base subject. In all cases, the
+// result is identical to ThreadReferences called with all messages.
+//
+// Since sequence numbers change on expunge, a long-lived Threader should be
+// used with UIDs. A Threader isn't safe for concurrent use.
+type Threader struct {
+	options  *ReferencesOptions
+	messages map[uint32]*ThreadMessage
+	lastId   uint32
+
+	// Step 1 state
+	idTable map[string]*threadContainer
+	touched map[uint32][]*threadContainer
+
+	// Steps 2 to 6 state
+	dirty   map[*threadContainer]bool
+	roots   map[*threadContainer]*threadNode
+	groups  map[string]*subjectGroup
+	outputs []*threadNode
+}
+
+// subjectGroup contains the roots sharing a base subject, and the result of
+// step 5 for these roots.
+type subjectGroup struct {
+	members []*threadNode
+	outputs []*threadNode
+}
+
+func (g *subjectGroup) remove(n *threadNode) {
+	for i, m := range g.members {
+		if m == n {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			return
+		}
+	}
+}
+
+// NewThreader creates a new threader.
+func NewThreader() *Threader {
+	return NewThreaderWithOptions(nil)
+}
+
+// NewThreaderWithOptions creates a new threader with the provided options. If
+// options is nil, RFC 5256 is followed.
+func NewThreaderWithOptions(options *ReferencesOptions) *Threader {
+	return &Threader{
+		options:  options,
+		messages: make(map[uint32]*ThreadMessage),
+		idTable:  make(map[string]*threadContainer),
+		touched:  make(map[uint32][]*threadContainer),
+		dirty:    make(map[*threadContainer]bool),
+		roots:    make(map[*threadContainer]*threadNode),
+		groups:   make(map[string]*subjectGroup),
+	}
+}
+
+// Len returns the number of messages in the threader.
+func (t *Threader) Len() int {
+	return len(t.messages)
+}
+
+// Add adds a message. If a message with the same ID already exists, it's
+// replaced.
+func (t *Threader) Add(msg *ThreadMessage) {
+	if _, ok := t.messages[msg.Id]; ok {
+		t.Remove(msg.Id)
+	}
+	t.messages[msg.Id] = msg
+
+	if msg.Id > t.lastId {
+		// Step 1 links messages in ID order, so it can simply go on
+		t.lastId = msg.Id
+		t.link(msg)
+		return
+	}
+
+	// Messages with a greater ID may have used the same containers, link
+	// them again along with this one
+	var seeds []*threadContainer
+	if id := msgid.Parse(msg.MessageId); id != "" {
+		if c, ok := t.idTable[id]; ok {
+			seeds = append(seeds, c)
+		}
+	}
+	for _, ref := range msgid.References(msg.MessageId, msg.InReplyTo, msg.References) {
+		if c, ok := t.idTable[ref]; ok {
+			seeds = append(seeds, c)
+		}
+	}
+	t.relink(seeds, msg.Id)
+}
+
+// Remove removes a message. It's a no-op if the message doesn't exist.
+func (t *Threader) Remove(id uint32) {
+	if _, ok := t.messages[id]; !ok {
+		return
+	}
+	delete(t.messages, id)
+	seeds := t.touched[id]
+	delete(t.touched, id)
+	t.relink(seeds)
+}
+
+func (t *Threader) container(msgId string) *threadContainer {
+	c, ok := t.idTable[msgId]
+	if !ok {
+		c = &threadContainer{id: msgId}
+		t.idTable[msgId] = c
+	}
+	return c
+}
+
+// relink discards the seed containers, along with all the containers related
+// to them through the messages which used them, and performs step 1 again for
+// these messages and the messages with the provided IDs.
+//
+// Other messages only use unrelated containers, so their links are left
+// unchanged.
+func (t *Threader) relink(seeds []*threadContainer, ids ...uint32) {
+	queued := make(map[uint32]bool, len(ids))
+	for _, id := range ids {
+		queued[id] = true
+	}
+	discarded := make(map[*threadContainer]bool)
+	for len(seeds) > 0 {
+		c := seeds[len(seeds)-1]
+		seeds = seeds[:len(seeds)-1]
+		if discarded[c] {
+			continue
+		}
+		discarded[c] = true
+		for _, id := range c.msgs {
+			if queued[id] || t.messages[id] == nil {
+				continue
+			}
+			queued[id] = true
+			ids = append(ids, id)
+			seeds = append(seeds, t.touched[id]...)
+		}
+	}
+
+	for c := range discarded {
+		c.removed = true
+		t.dirty[c] = true
+		if c.id != "" && t.idTable[c.id] == c {
+			delete(t.idTable, c.id)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	for _, id := range ids {
+		t.link(t.messages[id])
+	}
+}
+
+// link performs step 1 of the REFERENCES algorithm for a single message.
+func (t *Threader) link(msg *ThreadMessage) {
+	// Record the containers used by the message, and mark their threads as
+	// changed before and after linking
+	var touched []*threadContainer
+	touch := func(c *threadContainer) *threadContainer {
+		if n := len(c.msgs); n == 0 || c.msgs[n-1] != msg.Id {
+			c.msgs = append(c.msgs, msg.Id)
+			touched = append(touched, c)
+			t.dirty[c.root()] = true
+		}
+		return c
+	}
+	defer func() {
+		for _, c := range touched {
+			t.dirty[c.root()] = true
+		}
+		t.touched[msg.Id] = touched
+	}()
+
+	// (A) If the message doesn't have a valid and unique Message ID, assign
+	// it a unique one.
+	var c *threadContainer
+	if id := msgid.Parse(msg.MessageId); id != "" {
+		c = touch(t.container(id))
+		if c.msg != nil {
+			c = nil
+		}
+	}
+	if c == nil {
+		c = touch(new(threadContainer))
+	}
+	c.msg = msg
+	c.baseSubject, c.isReplyFwd = GetBaseSubject(msg.Subject)
+
+	// (B) Link each reference with its successor, unless the successor already
+	// has a parent.
+	var prev *threadContainer
+	for _, ref := range msgid.References(msg.MessageId, msg.InReplyTo, msg.References) {
+		ref := touch(t.container(ref))
+		if prev != nil && ref.parent == nil {
+			prev.link(ref)
+		}
+		prev = ref
+	}
+
+	// (C) Make the message a child of the last reference, breaking any
+	// existing link.
+	if prev != nil && !prev.hasAncestor(c) {
+		prev.link(c)
+	} else if prev == nil {
+		c.unlink()
+	}
+}
+
+// Threads returns the current threads. The result is a new copy on each call,
+// so it can be modified, e.g. with SortThreads.
+//
+// Dummy thread roots, which group unrelated messages sharing the same base
+// subject, have a zero ID.
+func (t *Threader) Threads() []*Thread {
+	t.update()
+
+	// Allocate all threads at once, since the result is copied on each call
+	size := 0
+	for _, n := range t.outputs {
+		size += len(n.flat)
+	}
+	a := &threadAllocator{
+		threads:  make([]Thread, size),
+		children: make([]*Thread, size-len(t.outputs)),
+	}
+	threads := make([]*Thread, len(t.outputs))
+	for i, n := range t.outputs {
+		entries := n.flat
+		threads[i] = a.thread(&entries)
+	}
+	return threads
+}
+
+// threadEntry is a message of a flattened thread, listed in pre-order.
+type threadEntry struct {
+	id       uint32
+	children int
+}
+
+// threadAllocator converts flattened threads to threads, allocated from
+// preallocated slices.
+type threadAllocator struct {
+	threads  []Thread
+	children []*Thread
+}
+
+func (a *threadAllocator) thread(entries *[]threadEntry) *Thread {
+	e := (*entries)[0]
+	*entries = (*entries)[1:]
+
+	t := &a.threads[0]
+	a.threads = a.threads[1:]
+	t.Id = e.id
+	if e.children > 0 {
+		// Limit the capacity, so that appending doesn't overwrite other
+		// children
+		t.Children = a.children[:e.children:e.children]
+		a.children = a.children[e.children:]
+		for i := range t.Children {
+			t.Children[i] = a.thread(entries)
+		}
+	}
+	return t
+}
+
+// group returns the subject group of a root and records it in changed. It
+// returns nil if the root isn't subject to step 5.
+func (t *Threader) group(n *threadNode, changed map[string]*subjectGroup) *subjectGroup {
+	if t.options != nil && t.options.NoSubjectGathering {
+		return nil
+	}
+	subject := n.subject()
+	if subject == "" {
+		return nil
+	}
+	g, ok := t.groups[subject]
+	if !ok {
+		g = new(subjectGroup)
+		t.groups[subject] = g
+	}
+	changed[subject] = g
+	return g
+}
+
+// update performs steps 2 to 6 for the threads which changed since the last
+// call.
+func (t *Threader) update() {
+	if len(t.dirty) == 0 {
+		return
+	}
+
+	removed := make(map[*threadNode]bool)
+	var added []*threadNode
+	changed := make(map[string]*subjectGroup)
+	for c := range t.dirty {
+		if n, ok := t.roots[c]; ok {
+			delete(t.roots, c)
+			if g := t.group(n, changed); g != nil {
+				g.remove(n)
+			} else {
+				removed[n] = true
+			}
+		}
+		if c.removed || c.parent != nil {
+			continue
+		}
+
+		// (2) Gather the root set, (3) prune dummy messages and (6) sort
+		// siblings, which only depends on the thread itself
+		pruned := pruneThreadNodes([]*threadNode{newThreadNode(c)}, true)
+		if len(pruned) == 0 {
+			continue
+		}
+		n := pruned[0]
+		sortThreadNodesRecursive(n.children)
+		t.roots[c] = n
+		if g := t.group(n, changed); g != nil {
+			g.members = append(g.members, n)
+		} else {
+			added = append(added, n)
+		}
+	}
+	t.dirty = make(map[*threadContainer]bool)
+
+	for subject, g := range changed {
+		for _, n := range g.outputs {
+			removed[n] = true
+		}
+		if len(g.members) == 0 {
+			delete(t.groups, subject)
+			continue
+		}
+
+		// (4) Sort the root set and (5) gather messages with the same base
+		// subject
+		sortThreadNodes(g.members)
+		g.outputs = gatherThreadNodes(g.members, t.options)
+		added = append(added, g.outputs...)
+	}
+
+	for _, n := range added {
+		if n.flat == nil {
+			n.flat = n.flatten(nil)
+		}
+	}
+
+	// (6) Sort the root set
+	if len(removed) > 0 {
+		outputs := t.outputs[:0]
+		for _, n := range t.outputs {
+			if !removed[n] {
+				outputs = append(outputs, n)
+			}
+		}
+		for i := len(outputs); i < len(t.outputs); i++ {
+			t.outputs[i] = nil
+		}
+		t.outputs = outputs
+	}
+	if len(added) > 32 {
+		t.outputs = append(t.outputs, added...)
+		sortThreadNodes(t.outputs)
+	} else {
+		for _, n := range added {
+			key := n.sortKey()
+			i := sort.Search(len(t.outputs), func(i int) bool {
+				return compareThreadMessages(key, t.outputs[i].sortKey())
+			})
+			t.outputs = append(t.outputs, nil)
+			copy(t.outputs[i+1:], t.outputs[i:])
+			t.outputs[i] = n
+		}
+	}
+}
+
+// threadNode is a copy of a container, mutated by steps 2 to 6. Nodes are
+// cached by the Threader once these steps are done, so they don't change when
+// containers are linked again.
+type threadNode struct {
+	msg         *ThreadMessage
+	baseSubject string
+	isReplyFwd  bool
+	children    []*threadNode
+
+	// The flattened tree, set by the Threader for the final roots
+	flat []threadEntry
+}
+
+func (n *threadNode) isDummy() bool {
+	return n.msg == nil
+}
+
+// flatten appends the tree to entries, in pre-order.
+func (n *threadNode) flatten(entries []threadEntry) []threadEntry {
+	var id uint32
+	if !n.isDummy() {
+		id = n.msg.Id
+	}
+	entries = append(entries, threadEntry{id, len(n.children)})
+	for _, c := range n.children {
+		entries = c.flatten(entries)
+	}
+	return entries
+}
+
+// copy returns a shallow copy of the node, whose children can be modified.
+func (n *threadNode) copy() *threadNode {
+	cp := *n
+	cp.children = append([]*threadNode(nil), n.children...)
+	cp.flat = nil
+	return &cp
+}
+
+// sortKey returns the message used for sorting: the node's message, or the
+// first child's for a dummy.
+func (n *threadNode) sortKey() *ThreadMessage {
+	for n.isDummy() {
+		if len(n.children) == 0 {
+			return nil
+		}
+		n = n.children[0]
+	}
+	return n.msg
+}
+
+// subject returns the thread subject, as defined in step 5.B.i.
+func (n *threadNode) subject() string {
+	if !n.isDummy() {
+		return n.baseSubject
+	}
+	if len(n.children) > 0 && !n.children[0].isDummy() {
+		return n.children[0].baseSubject
+	}
+	return ""
+}
+
+func newThreadNode(c *threadContainer) *threadNode {
+	n := &threadNode{msg: c.msg, baseSubject: c.baseSubject, isReplyFwd: c.isReplyFwd}
+	for _, child := range c.children {
+		n.children = append(n.children, newThreadNode(child))
+	}
+	return n
+}
+
+// pruneThreadNodes performs step 3 on a set of siblings.
+func pruneThreadNodes(nodes []*threadNode, root bool) []*threadNode {
+	var pruned []*threadNode
+	for _, n := range nodes {
+		n.children = pruneThreadNodes(n.children, false)
+		if !n.isDummy() {
+			pruned = append(pruned, n)
+		} else if len(n.children) == 0 {
+			continue
+		} else if !root || len(n.children) == 1 {
+			pruned = append(pruned, n.children...)
+		} else {
+			pruned = append(pruned, n)
+		}
+	}
+	return pruned
+}
+
+// sentDate returns the date used for sorting: the sent date or, if unknown,
+// the internal date.
+func (msg *ThreadMessage) sentDate() time.Time {
+	if msg.Date.IsZero() {
+		return msg.InternalDate
+	}
+	return msg.Date
+}
+
+// compareThreadMessages orders messages by sent date, then by ID. Messages
+// without any date come first.
+func compareThreadMessages(a, b *ThreadMessage) bool {
+	if a == nil || b == nil {
+		return a != nil
+	}
+	if da, db := a.sentDate(), b.sentDate(); !da.Equal(db) {
+		return da.Before(db)
+	}
+	return a.Id < b.Id
+}
+
+func sortThreadNodes(nodes []*threadNode) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return compareThreadMessages(nodes[i].sortKey(), nodes[j].sortKey())
+	})
+}
+
+// sortThreadNodesRecursive performs step 6: grandchildren are sorted before
+// children.
+func sortThreadNodesRecursive(nodes []*threadNode) {
+	for _, n := range nodes {
+		sortThreadNodesRecursive(n.children)
+	}
+	sortThreadNodes(nodes)
+}
+
+func (n *threadNode) participants(set map[string]bool) {
+	if !n.isDummy() {
+		for _, addr := range n.msg.Participants {
+			set[strings.ToLower(addr)] = true
+		}
+	}
+	for _, c := range n.children {
+		c.participants(set)
+	}
+}
+
+func sameParticipants(a, b map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for addr := range a {
+		if !b[addr] {
+			return false
+		}
+	}
+	return true
+}
+
+// subjectCluster is a group of roots with the same base subject which can be
+// merged according to ReferencesOptions.
+type subjectCluster struct {
+	key          string
+	date         time.Time
+	participants map[string]bool
+}
+
+func (options *ReferencesOptions) accepts(cluster *subjectCluster, date time.Time, participants map[string]bool) bool {
+	if options.SubjectWindow > 0 && !cluster.date.IsZero() && !date.IsZero() {
+		d := date.Sub(cluster.date)
+		if d < 0 {
+			d = -d
+		}
+		if d > options.SubjectWindow {
+			return false
+		}
+	}
+	if options.SameParticipants && !sameParticipants(cluster.participants, participants) {
+		return false
+	}
+	return true
+}
+
+// subjectKeys returns the subject table key of each root. Roots with the same
+// key are merged by step 5. Roots without a key are never merged.
+func subjectKeys(roots []*threadNode, options *ReferencesOptions) map[*threadNode]string {
+	keys := make(map[*threadNode]string, len(roots))
+	if options != nil && options.NoSubjectGathering {
+		return keys
+	}
+	if options == nil || (options.SubjectWindow == 0 && !options.SameParticipants) {
+		for _, n := range roots {
+			keys[n] = n.subject()
+		}
+		return keys
+	}
+
+	// Roots are sorted by date, so each cluster starts with its oldest root
+	clusters := make(map[string][]*subjectCluster)
+	for _, n := range roots {
+		subject := n.subject()
+		if subject == "" {
+			continue
+		}
+
+		var date time.Time
+		if msg := n.sortKey(); msg != nil {
+			date = msg.sentDate()
+		}
+		var participants map[string]bool
+		if options.SameParticipants {
+			participants = make(map[string]bool)
+			n.participants(participants)
+		}
+
+		var cluster *subjectCluster
+		for _, c := range clusters[subject] {
+			if options.accepts(c, date, participants) {
+				cluster = c
+				break
+			}
+		}
+		if cluster == nil {
+			cluster = &subjectCluster{
+				key:          subject + "\x00" + strconv.Itoa(len(clusters[subject])),
+				date:         date,
+				participants: participants,
+			}
+			clusters[subject] = append(clusters[subject], cluster)
+		}
+		keys[n] = cluster.key
+	}
+	return keys
+}
+
+// gatherThreadNodes performs step 5 on the root set. The children of the
+// modified roots are sorted again, as done by step 6.
+func gatherThreadNodes(roots []*threadNode, options *ReferencesOptions) []*threadNode {
+	keys := subjectKeys(roots, options)
+
+	// (B) Populate the subject table
+	subjectTable := make(map[string]*threadNode)
+	for _, n := range roots {
+		subject := keys[n]
+		if subject == "" {
+			continue
+		}
+		old, ok := subjectTable[subject]
+		if !ok {
+			subjectTable[subject] = n
+		} else if !old.isDummy() && (n.isDummy() || (old.isReplyFwd && !n.isReplyFwd)) {
+			subjectTable[subject] = n
+		}
+	}
+
+	// (C) Merge threads with the same subject. Roots are copied before being
+	// modified, since they're cached by the Threader.
+	removed := make(map[*threadNode]bool)
+	replaced := make(map[*threadNode]*threadNode)
+	copiedFrom := make(map[*threadNode]*threadNode)
+	for _, n := range roots {
+		subject := keys[n]
+		if subject == "" {
+			continue
+		}
+		old := subjectTable[subject]
+		if old == n || copiedFrom[old] == n {
+			continue
+		}
+		if _, ok := copiedFrom[old]; !ok {
+			cp := old.copy()
+			copiedFrom[cp] = old
+			subjectTable[subject] = cp
+			replaced[old] = cp
+			old = cp
+		}
+
+		switch {
+		case old.isDummy() && n.isDummy():
+			old.children = append(old.children, n.children...)
+		case old.isDummy():
+			old.children = append(old.children, n)
+		case n.isReplyFwd && !old.isReplyFwd:
+			old.children = append(old.children, n)
+		default:
+			dummy := &threadNode{children: []*threadNode{old, n}}
+			copiedFrom[dummy] = nil
+			subjectTable[subject] = dummy
+			replaced[old] = dummy
+		}
+		removed[n] = true
+	}
+
+	for n := range copiedFrom {
+		sortThreadNodes(n.children)
+	}
+
+	var gathered []*threadNode
+	for _, n := range roots {
+		if removed[n] {
+			continue
+		}
+		for replaced[n] != nil {
+			n = replaced[n]
+		}
+		gathered = append(gathered, n)
+	}
+	return gathered
+}
+
+func (n *threadNode) thread() *Thread {
+	t := new(Thread)
+	if !n.isDummy() {
+		t.Id = n.msg.Id
+	}
+	for _, c := range n.children {
+		t.Children = append(t.Children, c.thread())
+	}
+	return t
+}
+
+// ThreadReferences threads messages with the REFERENCES algorithm defined in
+// RFC 5256 section 3.
+func ThreadReferences(messages []*ThreadMessage) []*Thread {
+	return ThreadReferencesWithOptions(messages, nil)
+}
+
+// ThreadReferencesWithOptions is like ThreadReferences, but with options. If
+// options is nil, RFC 5256 is followed.
+func ThreadReferencesWithOptions(messages []*ThreadMessage, options *ReferencesOptions) []*Thread {
+	t := NewThreaderWithOptions(options)
+	for _, msg := range messages {
+		t.Add(msg)
+	}
+	return t.Threads()
+}
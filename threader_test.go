@@ -0,0 +1,669 @@
+package sortthread
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap-sortthread/msgid"
+)
+
+var threaderDate = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newTestThreadMessage(id uint32, subject, msgId, refs string) *ThreadMessage {
+	return &ThreadMessage{
+		Id:         id,
+		Date:       threaderDate.Add(time.Duration(id) * time.Hour),
+		Subject:    subject,
+		MessageId:  msgId,
+		References: refs,
+	}
+}
+
+var threadReferencesTests = []struct {
+	name     string
+	messages []*ThreadMessage
+	expected string
+}{
+	{
+		name: "simple",
+		messages: []*ThreadMessage{
+			newTestThreadMessage(1, "Hello", "<1@example.org>", ""),
+			newTestThreadMessage(2, "Re: Hello", "<2@example.org>", "<1@example.org>"),
+			newTestThreadMessage(3, "Re: Hello", "<3@example.org>", "<1@example.org> <2@example.org>"),
+			newTestThreadMessage(4, "Re: Hello", "<4@example.org>", "<1@example.org>"),
+		},
+		expected: "(1 (2 3)(4))",
+	},
+	{
+		name: "missing_parent",
+		messages: []*ThreadMessage{
+			newTestThreadMessage(1, "Re: Hello", "<2@example.org>", "<1@example.org>"),
+			newTestThreadMessage(2, "Re: Hello", "<3@example.org>", "<1@example.org>"),
+			newTestThreadMessage(3, "Bye", "<4@example.org>", ""),
+		},
+		expected: "((1)(2))(3)",
+	},
+	{
+		name: "subject",
+		messages: []*ThreadMessage{
+			newTestThreadMessage(1, "Hello", "<1@example.org>", ""),
+			newTestThreadMessage(2, "Re: Hello", "<2@example.org>", ""),
+			newTestThreadMessage(3, "Hello", "<3@example.org>", ""),
+		},
+		expected: "((1 2)(3))",
+	},
+	{
+		name: "duplicate",
+		messages: []*ThreadMessage{
+			newTestThreadMessage(1, "Hello", "<1@example.org>", ""),
+			newTestThreadMessage(2, "Bye", "<1@example.org>", ""),
+			newTestThreadMessage(3, "Re: Hello", "<3@example.org>", "<1@example.org>"),
+		},
+		expected: "(1 3)(2)",
+	},
+	{
+		name: "loop",
+		messages: []*ThreadMessage{
+			newTestThreadMessage(1, "Hello", "<1@example.org>", "<2@example.org>"),
+			newTestThreadMessage(2, "Bye", "<2@example.org>", "<1@example.org>"),
+		},
+		expected: "(2 1)",
+	},
+	{
+		name: "date",
+		messages: []*ThreadMessage{
+			newTestThreadMessage(1, "Hello", "<1@example.org>", ""),
+			{Id: 2, Date: threaderDate, Subject: "Bye", MessageId: "<2@example.org>"},
+		},
+		expected: "(2)(1)",
+	},
+	{
+		name: "zero_date",
+		messages: []*ThreadMessage{
+			{Id: 1, Date: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC), Subject: "A", MessageId: "<1@example.org>"},
+			{Id: 2, Subject: "B", MessageId: "<2@example.org>"},
+			{Id: 3, Date: time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC), Subject: "C", MessageId: "<3@example.org>"},
+		},
+		expected: "(2)(3)(1)",
+	},
+	{
+		name: "internal_date",
+		messages: []*ThreadMessage{
+			{Id: 1, Date: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC), Subject: "A", MessageId: "<1@example.org>"},
+			{Id: 2, InternalDate: time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC), Subject: "B", MessageId: "<2@example.org>"},
+			{Id: 3, Date: time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC), Subject: "C", MessageId: "<3@example.org>"},
+		},
+		expected: "(3)(1)(2)",
+	},
+	{
+		name: "broken_references",
+		messages: []*ThreadMessage{
+			newTestThreadMessage(1, "Hello", "1@example.org", ""),
+			newTestThreadMessage(2, "Bye", "<2@example.org>", "<1@example.org> <2@example.org>"),
+			newTestThreadMessage(3, "Bye", "<3@example.org>", "(reply to <2@example.org>) <1@example.org> <2@exa"),
+		},
+		expected: "(1 (2)(3))",
+	},
+}
+
+func formatTestThreads(threads []*Thread) string {
+	var s string
+	for _, t := range threads {
+		s += formatTestThread(t)
+	}
+	return s
+}
+
+func formatTestThread(t *Thread) string {
+	s := "("
+	if t.Id != 0 {
+		s += defaultThreadLabel(t.Id)
+	}
+	for len(t.Children) == 1 && t.Id != 0 {
+		t = t.Children[0]
+		s += " " + defaultThreadLabel(t.Id)
+	}
+	if len(t.Children) > 0 && s != "(" {
+		s += " "
+	}
+	for _, c := range t.Children {
+		s += formatTestThread(c)
+	}
+	return s + ")"
+}
+
+func TestThreadReferences(t *testing.T) {
+	for _, test := range threadReferencesTests {
+		t.Run(test.name, func(t *testing.T) {
+			threads := ThreadReferences(test.messages)
+			if s := formatTestThreads(threads); s != test.expected {
+				t.Errorf("Got %s, expected %s", s, test.expected)
+			}
+			if s := formatTestThreads(referenceThreads(test.messages, nil)); s != test.expected {
+				t.Errorf("Reference implementation: got %s, expected %s", s, test.expected)
+			}
+		})
+	}
+}
+
+func newTestAlert(id uint32, hours int, from string) *ThreadMessage {
+	msg := newTestThreadMessage(id, "Alert: disk full", "<"+strconv.Itoa(int(id))+"@example.org>", "")
+	msg.Date = threaderDate.Add(time.Duration(hours) * time.Hour)
+	msg.Participants = []string{from, "ops@example.org"}
+	return msg
+}
+
+var threadReferencesOptionsTests = []struct {
+	name     string
+	options  *ReferencesOptions
+	expected string
+}{
+	{
+		name:     "default",
+		expected: "((1)(2)(3)(4)(5))",
+	},
+	{
+		name:     "no_subject",
+		options:  &ReferencesOptions{NoSubjectGathering: true},
+		expected: "(1)(2)(3)(4)(5)",
+	},
+	{
+		name:     "window",
+		options:  &ReferencesOptions{SubjectWindow: 2 * time.Hour},
+		expected: "((1)(2))(3)((4)(5))",
+	},
+	{
+		name:     "participants",
+		options:  &ReferencesOptions{SameParticipants: true},
+		expected: "((1)(2)(4))((3)(5))",
+	},
+	{
+		name:     "window_participants",
+		options:  &ReferencesOptions{SubjectWindow: 2 * time.Hour, SameParticipants: true},
+		expected: "((1)(2))(3)(4)(5)",
+	},
+}
+
+func TestThreadReferencesWithOptions(t *testing.T) {
+	messages := []*ThreadMessage{
+		newTestAlert(1, 0, "monitor@example.org"),
+		newTestAlert(2, 1, "Monitor@example.org"),
+		newTestAlert(3, 5, "backup@example.org"),
+		newTestAlert(4, 10, "monitor@example.org"),
+		newTestAlert(5, 11, "backup@example.org"),
+	}
+
+	for _, test := range threadReferencesOptionsTests {
+		t.Run(test.name, func(t *testing.T) {
+			threads := ThreadReferencesWithOptions(messages, test.options)
+			if s := formatTestThreads(threads); s != test.expected {
+				t.Errorf("Got %s, expected %s", s, test.expected)
+			}
+			if s := formatTestThreads(referenceThreads(messages, test.options)); s != test.expected {
+				t.Errorf("Reference implementation: got %s, expected %s", s, test.expected)
+			}
+		})
+	}
+}
+
+func TestReferencesAlgorithmOptions(t *testing.T) {
+	if options, ok := ReferencesAlgorithmOptions("references"); !ok || options != nil {
+		t.Errorf("Invalid options for REFERENCES: %v %v", options, ok)
+	}
+	if options, ok := ReferencesAlgorithmOptions(ReferencesNoSubject); !ok || options == nil || !options.NoSubjectGathering {
+		t.Errorf("Invalid options for X-REFERENCES-NOSUBJECT: %v %v", options, ok)
+	}
+	if _, ok := ReferencesAlgorithmOptions(OrderedSubject); ok {
+		t.Errorf("Expected ORDEREDSUBJECT not to be a REFERENCES algorithm")
+	}
+}
+
+// refContainer is a container of the straightforward REFERENCES
+// implementation used to check the Threader.
+type refContainer struct {
+	msg      *ThreadMessage
+	parent   *refContainer
+	children []*refContainer
+}
+
+// isAncestorOf checks whether c is c2 or one of its ancestors.
+func (c *refContainer) isAncestorOf(c2 *refContainer) bool {
+	for ; c2 != nil; c2 = c2.parent {
+		if c2 == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *refContainer) setParent(parent *refContainer) {
+	if c.parent != nil {
+		var children []*refContainer
+		for _, child := range c.parent.children {
+			if child != c {
+				children = append(children, child)
+			}
+		}
+		c.parent.children = children
+	}
+	c.parent = parent
+	if parent != nil {
+		parent.children = append(parent.children, c)
+	}
+}
+
+// first returns the message used to sort c: its own, or its first child's
+// for a dummy.
+func (c *refContainer) first() *ThreadMessage {
+	if c.msg == nil && len(c.children) > 0 {
+		return c.children[0].msg
+	}
+	return c.msg
+}
+
+func (c *refContainer) addParticipants(set map[string]bool) {
+	if c.msg != nil {
+		for _, addr := range c.msg.Participants {
+			set[strings.ToLower(addr)] = true
+		}
+	}
+	for _, child := range c.children {
+		child.addParticipants(set)
+	}
+}
+
+func refDate(msg *ThreadMessage) time.Time {
+	if msg.Date.IsZero() {
+		return msg.InternalDate
+	}
+	return msg.Date
+}
+
+func sortRefContainers(containers []*refContainer) {
+	sort.Slice(containers, func(i, j int) bool {
+		a, b := containers[i].first(), containers[j].first()
+		if da, db := refDate(a), refDate(b); !da.Equal(db) {
+			return da.Before(db)
+		}
+		return a.Id < b.Id
+	})
+}
+
+// pruneRefContainers performs step 3 on a set of siblings.
+func pruneRefContainers(containers []*refContainer, root bool) []*refContainer {
+	var result []*refContainer
+	for _, c := range containers {
+		c.children = pruneRefContainers(c.children, false)
+		switch {
+		case c.msg != nil:
+			// (C) Keep non-dummy messages
+			result = append(result, c)
+		case len(c.children) == 0:
+			// (A) Remove dummies without children
+		case root && len(c.children) > 1:
+			// (B) Keep dummy roots with several children
+			result = append(result, c)
+		default:
+			// (B) Promote the children of other dummies
+			for _, child := range c.children {
+				child.parent = c.parent
+				result = append(result, child)
+			}
+		}
+	}
+	return result
+}
+
+func refThread(c *refContainer) *Thread {
+	t := new(Thread)
+	if c.msg != nil {
+		t.Id = c.msg.Id
+	}
+	for _, child := range c.children {
+		sortRefContainers(child.children)
+		t.Children = append(t.Children, refThread(child))
+	}
+	return t
+}
+
+// referenceThreads threads messages by following RFC 5256 section 3 step by
+// step, without sharing any code with the Threader besides header parsing.
+// Step 5 is restricted by options like the Threader does.
+func referenceThreads(messages []*ThreadMessage, options *ReferencesOptions) []*Thread {
+	if options == nil {
+		options = new(ReferencesOptions)
+	}
+
+	sorted := append([]*ThreadMessage(nil), messages...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Id < sorted[j].Id
+	})
+
+	// (1) Link messages with their references
+	var all []*refContainer
+	idTable := make(map[string]*refContainer)
+	get := func(id string) *refContainer {
+		c, ok := idTable[id]
+		if !ok {
+			c = new(refContainer)
+			idTable[id] = c
+			all = append(all, c)
+		}
+		return c
+	}
+	for _, msg := range sorted {
+		var c *refContainer
+		if id := msgid.Parse(msg.MessageId); id != "" && (idTable[id] == nil || idTable[id].msg == nil) {
+			c = get(id)
+		} else {
+			c = new(refContainer)
+			all = append(all, c)
+		}
+		c.msg = msg
+
+		var last *refContainer
+		for _, ref := range msgid.References(msg.MessageId, msg.InReplyTo, msg.References) {
+			r := get(ref)
+			if last != nil && r.parent == nil && !r.isAncestorOf(last) {
+				r.setParent(last)
+			}
+			last = r
+		}
+		if last == nil {
+			c.setParent(nil)
+		} else if !c.isAncestorOf(last) {
+			c.setParent(last)
+		}
+	}
+
+	// (2) Gather the root set
+	var roots []*refContainer
+	for _, c := range all {
+		if c.parent == nil {
+			roots = append(roots, c)
+		}
+	}
+
+	// (3) Prune dummy messages
+	roots = pruneRefContainers(roots, true)
+
+	// (4) Sort the root set, using the first child of dummies
+	for _, c := range roots {
+		if c.msg == nil {
+			sortRefContainers(c.children)
+		}
+	}
+	sortRefContainers(roots)
+
+	// (5) Gather messages with the same base subject. Options split the roots
+	// sharing a base subject into clusters, each with its own key.
+	type cluster struct {
+		key          string
+		date         time.Time
+		participants map[string]bool
+	}
+	clusters := make(map[string][]*cluster)
+	keys := make(map[*refContainer]string)
+	for _, c := range roots {
+		if options.NoSubjectGathering {
+			break
+		}
+		// (B.i) Use the subject of the first child of dummies
+		subject, _ := GetBaseSubject(c.first().Subject)
+		if subject == "" {
+			continue
+		}
+		date := refDate(c.first())
+		participants := make(map[string]bool)
+		c.addParticipants(participants)
+
+		var found *cluster
+		for _, cl := range clusters[subject] {
+			if options.SubjectWindow > 0 && !date.IsZero() && !cl.date.IsZero() &&
+				(date.Sub(cl.date) > options.SubjectWindow || cl.date.Sub(date) > options.SubjectWindow) {
+				continue
+			}
+			if options.SameParticipants && !reflect.DeepEqual(participants, cl.participants) {
+				continue
+			}
+			found = cl
+			break
+		}
+		if found == nil {
+			found = &cluster{
+				key:          subject + "/" + strconv.Itoa(len(clusters[subject])),
+				date:         date,
+				participants: participants,
+			}
+			clusters[subject] = append(clusters[subject], found)
+		}
+		keys[c] = found.key
+	}
+
+	isReplyFwd := func(c *refContainer) bool {
+		_, ok := GetBaseSubject(c.msg.Subject)
+		return ok
+	}
+
+	// (B) Populate the subject table, preferring dummies, then non-replies
+	subjectTable := make(map[string]*refContainer)
+	for _, c := range roots {
+		key, ok := keys[c]
+		if !ok {
+			continue
+		}
+		old := subjectTable[key]
+		if old == nil || (old.msg != nil && (c.msg == nil || (isReplyFwd(old) && !isReplyFwd(c)))) {
+			subjectTable[key] = c
+		}
+	}
+
+	// (C) Merge the other roots into the subject table entries
+	var gathered []*refContainer
+	for _, c := range roots {
+		key, ok := keys[c]
+		if !ok {
+			gathered = append(gathered, c)
+			continue
+		}
+		table := subjectTable[key]
+		if table == c {
+			gathered = append(gathered, c)
+			continue
+		}
+		switch {
+		case table.msg == nil && c.msg == nil:
+			for _, child := range c.children {
+				child.parent = table
+			}
+			table.children = append(table.children, c.children...)
+		case table.msg == nil:
+			c.parent = table
+			table.children = append(table.children, c)
+		case isReplyFwd(c) && !isReplyFwd(table):
+			c.parent = table
+			table.children = append(table.children, c)
+		default:
+			dummy := &refContainer{children: []*refContainer{table, c}}
+			table.parent = dummy
+			c.parent = dummy
+			subjectTable[key] = dummy
+			for i, g := range gathered {
+				if g == table {
+					gathered[i] = dummy
+				}
+			}
+		}
+	}
+
+	// (6) Sort all siblings, and the root set again
+	threads := make([]*Thread, len(gathered))
+	for _, c := range gathered {
+		sortRefContainers(c.children)
+	}
+	sortRefContainers(gathered)
+	for i, c := range gathered {
+		threads[i] = refThread(c)
+	}
+	return threads
+}
+
+func newRandomThreadMessages(r *rand.Rand, n int) []*ThreadMessage {
+	var messages []*ThreadMessage
+	for i := 1; i <= n; i++ {
+		var refs []string
+		for j := r.Intn(4); j > 0 && i > 1; j-- {
+			refs = append(refs, "<"+defaultThreadLabel(uint32(r.Intn(i-1)+1))+"@example.org>")
+		}
+		msgId := "<" + defaultThreadLabel(uint32(i)) + "@example.org>"
+		switch r.Intn(20) {
+		case 0:
+			msgId = ""
+		case 1:
+			// Duplicate Message-ID
+			msgId = "<" + defaultThreadLabel(uint32(r.Intn(i)+1)) + "@example.org>"
+		}
+		subjects := []string{"Hello", "Re: Hello", "Bye", "Re: Bye", ""}
+		msg := newTestThreadMessage(uint32(i), subjects[r.Intn(len(subjects))], msgId, strings.Join(refs, " "))
+		msg.Participants = []string{"user" + strconv.Itoa(r.Intn(2)) + "@example.org"}
+		if r.Intn(10) == 0 {
+			msg.Date = time.Time{}
+		}
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+func TestThreaderIncremental(t *testing.T) {
+	optionsList := []*ReferencesOptions{
+		nil,
+		{NoSubjectGathering: true},
+		{SubjectWindow: 20 * time.Hour, SameParticipants: true},
+	}
+	for _, options := range optionsList {
+		r := rand.New(rand.NewSource(42))
+		messages := newRandomThreadMessages(r, 200)
+
+		threader := NewThreaderWithOptions(options)
+		present := make(map[uint32]*ThreadMessage)
+		for i := 0; i < 500; i++ {
+			msg := messages[r.Intn(len(messages))]
+			if _, ok := present[msg.Id]; ok && r.Intn(2) == 0 {
+				threader.Remove(msg.Id)
+				delete(present, msg.Id)
+			} else {
+				threader.Add(msg)
+				present[msg.Id] = msg
+			}
+
+			var all []*ThreadMessage
+			for _, msg := range messages {
+				if present[msg.Id] != nil {
+					all = append(all, msg)
+				}
+			}
+			want := referenceThreads(all, options)
+			got := threader.Threads()
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("Incremental result differs from reference implementation with options %+v after %v operations:\n%s\n%s",
+					options, i+1, formatTestThreads(got), formatTestThreads(want))
+			}
+			if !reflect.DeepEqual(ThreadReferencesWithOptions(all, options), want) {
+				t.Fatalf("ThreadReferencesWithOptions result differs from reference implementation with options %+v after %v operations",
+					options, i+1)
+			}
+		}
+	}
+}
+
+func TestThreaderThreadsCopy(t *testing.T) {
+	threader := NewThreader()
+	threader.Add(newTestThreadMessage(1, "Hello", "<1@example.org>", ""))
+	threader.Add(newTestThreadMessage(2, "Bye", "<2@example.org>", ""))
+	threader.Add(newTestThreadMessage(3, "Re: Bye", "<3@example.org>", "<2@example.org>"))
+
+	threads := threader.Threads()
+	SortThreads(threads, []uint32{2, 1}, nil)
+	threads[0].Children = nil
+
+	if s := formatTestThreads(threader.Threads()); s != "(1)(2 3)" {
+		t.Errorf("Threads result changed by the caller: got %v, expected (1)(2 3)", s)
+	}
+}
+
+// newBenchmarkThreadMessages returns n messages in threads of up to 8
+// messages, some of them sharing their base subject.
+func newBenchmarkThreadMessages(n int) []*ThreadMessage {
+	r := rand.New(rand.NewSource(42))
+	messages := make([]*ThreadMessage, n)
+	var root int
+	for i := range messages {
+		id := uint32(i + 1)
+		msg := &ThreadMessage{
+			Id:        id,
+			Date:      threaderDate.Add(time.Duration(i) * time.Minute),
+			MessageId: "<" + defaultThreadLabel(id) + "@example.org>",
+		}
+		if i > 0 && r.Intn(4) != 0 && i-root < 8 {
+			parent := messages[root+r.Intn(i-root)]
+			msg.Subject = "Re: " + messages[root].Subject
+			msg.References = strings.TrimSpace(parent.References + " " + parent.MessageId)
+		} else {
+			root = i
+			msg.Subject = "Topic " + strconv.Itoa(r.Intn(n/4+1))
+		}
+		messages[i] = msg
+	}
+	return messages
+}
+
+const benchmarkThreaderSize = 200000
+
+func BenchmarkThreadReferences(b *testing.B) {
+	messages := newBenchmarkThreadMessages(benchmarkThreaderSize)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ThreadReferences(messages)
+	}
+}
+
+func BenchmarkThreaderAdd(b *testing.B) {
+	messages := newBenchmarkThreadMessages(benchmarkThreaderSize + b.N)
+	threader := NewThreader()
+	for _, msg := range messages[:benchmarkThreaderSize] {
+		threader.Add(msg)
+	}
+	threader.Threads()
+
+	b.ResetTimer()
+	for _, msg := range messages[benchmarkThreaderSize:] {
+		threader.Add(msg)
+		threader.Threads()
+	}
+}
+
+func BenchmarkThreaderRemove(b *testing.B) {
+	messages := newBenchmarkThreadMessages(benchmarkThreaderSize)
+	threader := NewThreader()
+	for _, msg := range messages {
+		threader.Add(msg)
+	}
+	threader.Threads()
+	r := rand.New(rand.NewSource(42))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Remove a message, and add it back out of order
+		msg := messages[r.Intn(len(messages))]
+		threader.Remove(msg.Id)
+		threader.Threads()
+		threader.Add(msg)
+		threader.Threads()
+	}
+}
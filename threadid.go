@@ -0,0 +1,184 @@
+package sortthread
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/emersion/go-imap"
+)
+
+// ObjectIdCapability is the capability of the OBJECTID extension, defined in
+// RFC 8474.
+const ObjectIdCapability = "OBJECTID"
+
+// ThreadIdCapability is advertised by servers supporting only the THREADID
+// fetch item of the OBJECTID extension, without EMAILID and MAILBOXID. This
+// is a vendor extension. Servers supporting all of them advertise
+// ObjectIdCapability instead.
+const ThreadIdCapability = "X-THREADID"
+
+// FetchThreadId is the THREADID fetch item, defined in RFC 8474.
+const FetchThreadId imap.FetchItem = "THREADID"
+
+// FormatThreadId formats a thread ID as a THREADID fetch item value. An empty
+// ID is formatted as NIL. Backends should store the result in
+// imap.Message.Items[FetchThreadId].
+func FormatThreadId(id string) interface{} {
+	if id == "" {
+		return nil
+	}
+	return []interface{}{imap.RawString(id)}
+}
+
+// ParseThreadId parses the THREADID fetch item of a message. It returns false
+// if the message doesn't have a thread ID.
+func ParseThreadId(msg *imap.Message) (string, bool, error) {
+	v, ok := msg.Items[FetchThreadId]
+	if !ok || v == nil {
+		return "", false, nil
+	}
+	fields, ok := v.([]interface{})
+	if !ok || len(fields) != 1 {
+		return "", false, errors.New("THREADID is not a list with a single item")
+	}
+	id, err := imap.ParseString(fields[0])
+	if err != nil {
+		return "", false, err
+	}
+	if !isObjectId(id) {
+		return "", false, errors.New("Invalid object ID: " + id)
+	}
+	return id, true, nil
+}
+
+// isObjectId checks that the string matches the objectid ABNF rule.
+func isObjectId(s string) bool {
+	if len(s) == 0 || len(s) > 255 {
+		return false
+	}
+	for _, ch := range s {
+		switch {
+		case 'a' <= ch && ch <= 'z', 'A' <= ch && ch <= 'Z', '0' <= ch && ch <= '9':
+		case ch == '_' || ch == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ThreadIdAssigner assigns stable thread IDs to messages from THREAD results.
+//
+// RFC 8474 requires a message's THREADID to never change. Once a message has
+// been assigned an ID, it keeps it: when two threads are merged, the new
+// messages take the ID of their nearest ancestor, and existing messages keep
+// theirs.
+//
+// Messages are identified by UID. The assignments should be persisted with Ids
+// to keep thread IDs stable across sessions.
+//
+// A ThreadIdAssigner is safe for concurrent use.
+type ThreadIdAssigner struct {
+	uidValidity uint32
+
+	mu  sync.RWMutex
+	ids map[uint32]string
+}
+
+// NewThreadIdAssigner creates a new thread ID assigner for a mailbox. ids
+// contains the previously persisted assignments and may be nil.
+func NewThreadIdAssigner(uidValidity uint32, ids map[uint32]string) *ThreadIdAssigner {
+	a := &ThreadIdAssigner{
+		uidValidity: uidValidity,
+		ids:         make(map[uint32]string, len(ids)),
+	}
+	for uid, id := range ids {
+		a.ids[uid] = id
+	}
+	return a
+}
+
+// newThreadId generates a thread ID for a thread started by a message. The ID
+// is unique for the mailbox as long as UIDVALIDITY doesn't change.
+func (a *ThreadIdAssigner) newThreadId(uid uint32) string {
+	return fmt.Sprintf("T%08x%08x", a.uidValidity, uid)
+}
+
+// Assign assigns thread IDs to the messages of a REFERENCES or REFS THREAD
+// result. The threads must contain UIDs.
+func (a *ThreadIdAssigner) Assign(threads []*Thread) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, t := range threads {
+		// The thread ID used for messages without an assigned ancestor: the
+		// ID of the first message with one, or a new ID
+		var threadId string
+		walkThread(t, func(t *Thread) {
+			if threadId == "" && t.Id != 0 {
+				threadId = a.ids[t.Id]
+			}
+		})
+		if threadId == "" {
+			walkThread(t, func(t *Thread) {
+				if threadId == "" && t.Id != 0 {
+					threadId = a.newThreadId(t.Id)
+				}
+			})
+		}
+
+		a.assign(t, threadId)
+	}
+}
+
+func (a *ThreadIdAssigner) assign(t *Thread, inherited string) {
+	if t.Id != 0 {
+		if id, ok := a.ids[t.Id]; ok {
+			inherited = id
+		} else {
+			a.ids[t.Id] = inherited
+		}
+	}
+	for _, c := range t.Children {
+		a.assign(c, inherited)
+	}
+}
+
+// ThreadId returns the thread ID of a message.
+func (a *ThreadIdAssigner) ThreadId(uid uint32) (string, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	id, ok := a.ids[uid]
+	return id, ok
+}
+
+// FillThreadId populates the THREADID fetch item of a message with the thread
+// ID of uid, if the item has been requested. The item is NIL if the message
+// hasn't been assigned a thread ID. Backends can call it from
+// backend.Mailbox.ListMessages.
+func (a *ThreadIdAssigner) FillThreadId(msg *imap.Message, uid uint32) {
+	if _, ok := msg.Items[FetchThreadId]; !ok {
+		return
+	}
+	id, _ := a.ThreadId(uid)
+	msg.Items[FetchThreadId] = FormatThreadId(id)
+}
+
+// Remove forgets about an expunged message.
+func (a *ThreadIdAssigner) Remove(uid uint32) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.ids, uid)
+}
+
+// Ids returns a copy of all assignments, suitable for persistence.
+func (a *ThreadIdAssigner) Ids() map[uint32]string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	ids := make(map[uint32]string, len(a.ids))
+	for uid, id := range a.ids {
+		ids[uid] = id
+	}
+	return ids
+}
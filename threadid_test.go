@@ -0,0 +1,127 @@
+package sortthread
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+)
+
+func TestThreadIdAssigner(t *testing.T) {
+	a := NewThreadIdAssigner(42, nil)
+
+	a.Assign([]*Thread{
+		{Id: 1, Children: []*Thread{{Id: 2}}},
+		{Id: 3},
+	})
+	id1, _ := a.ThreadId(1)
+	id2, _ := a.ThreadId(2)
+	id3, _ := a.ThreadId(3)
+	if id1 != "T0000002a00000001" || id2 != id1 {
+		t.Errorf("Invalid thread IDs for first thread: %v, %v", id1, id2)
+	}
+	if id3 == id1 {
+		t.Errorf("Unrelated threads should have different IDs")
+	}
+
+	// Merge both threads, add a reply to 3
+	a = NewThreadIdAssigner(42, a.Ids())
+	a.Assign([]*Thread{
+		{Id: 4, Children: []*Thread{
+			{Id: 1, Children: []*Thread{{Id: 2}}},
+			{Id: 3, Children: []*Thread{{Id: 5}}},
+		}},
+	})
+	for uid, expected := range map[uint32]string{1: id1, 2: id1, 3: id3, 4: id1, 5: id3} {
+		if id, ok := a.ThreadId(uid); !ok || id != expected {
+			t.Errorf("Message %v: got thread ID %q, expected %q", uid, id, expected)
+		}
+	}
+}
+
+func TestParseThreadId(t *testing.T) {
+	msg := imap.NewMessage(1, []imap.FetchItem{FetchThreadId})
+	msg.Items[FetchThreadId] = FormatThreadId("T64b478a75b7ea9def")
+
+	var b bytes.Buffer
+	w := imap.NewWriter(&b)
+	resp := imap.NewUntaggedResp([]interface{}{imap.RawString("1"), imap.RawString("FETCH"), msg.Format()})
+	if err := resp.WriteTo(w); err != nil {
+		t.Fatal("Expected no error while writing message but got:", err)
+	}
+	w.Flush()
+
+	if s := b.String(); s != "* 1 FETCH (THREADID (T64b478a75b7ea9def))\r\n" {
+		t.Errorf("Invalid FETCH response: %q", s)
+	}
+
+	fields, err := imap.NewReader(bufio.NewReader(&b)).ReadLine()
+	if err != nil {
+		t.Fatal("Expected no error while reading FETCH response but got:", err)
+	}
+	parsed := new(imap.Message)
+	if err := parsed.Parse(fields[3].([]interface{})); err != nil {
+		t.Fatal("Expected no error while parsing message but got:", err)
+	}
+	if id, ok, err := ParseThreadId(parsed); err != nil || !ok || id != "T64b478a75b7ea9def" {
+		t.Errorf("Got thread ID %q (%v, %v)", id, ok, err)
+	}
+}
+
+func TestThreadIdCapability(t *testing.T) {
+	c, close := newTestServer(t, &testBackend{Backend: memory.New()}, NewThreadIdExtension())
+	defer close()
+
+	if ok, err := c.Support(ThreadIdCapability); err != nil || !ok {
+		t.Errorf("Expected %v capability, got %v %v", ThreadIdCapability, ok, err)
+	}
+	// EMAILID and MAILBOXID aren't supported
+	if ok, err := c.Support(ObjectIdCapability); err != nil || ok {
+		t.Errorf("Expected no %v capability, got %v %v", ObjectIdCapability, ok, err)
+	}
+}
+
+type objectIdTestBackend struct {
+	*testBackend
+}
+
+func (be *objectIdTestBackend) SupportObjectId() bool {
+	return true
+}
+
+func TestObjectIdCapability(t *testing.T) {
+	be := &objectIdTestBackend{&testBackend{Backend: memory.New()}}
+	c, close := newTestServer(t, be, NewThreadIdExtension())
+	defer close()
+
+	if ok, err := c.Support(ObjectIdCapability); err != nil || !ok {
+		t.Errorf("Expected %v capability, got %v %v", ObjectIdCapability, ok, err)
+	}
+	if ok, err := c.Support(ThreadIdCapability); err != nil || ok {
+		t.Errorf("Expected no %v capability, got %v %v", ThreadIdCapability, ok, err)
+	}
+}
+
+func TestThreadIdAssignerFillThreadId(t *testing.T) {
+	a := NewThreadIdAssigner(42, map[uint32]string{1: "T1"})
+
+	msg := imap.NewMessage(1, []imap.FetchItem{FetchThreadId})
+	a.FillThreadId(msg, 1)
+	if id, ok, err := ParseThreadId(msg); err != nil || !ok || id != "T1" {
+		t.Errorf("Got thread ID %q (%v, %v), expected T1", id, ok, err)
+	}
+
+	msg = imap.NewMessage(2, []imap.FetchItem{FetchThreadId})
+	a.FillThreadId(msg, 2)
+	if v, ok := msg.Items[FetchThreadId]; !ok || v != nil {
+		t.Errorf("Expected a NIL thread ID for an unassigned message, got %v", v)
+	}
+
+	msg = imap.NewMessage(1, []imap.FetchItem{imap.FetchUid})
+	a.FillThreadId(msg, 1)
+	if _, ok := msg.Items[FetchThreadId]; ok {
+		t.Errorf("Expected THREADID not to be added when not requested")
+	}
+}